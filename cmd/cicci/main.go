@@ -1,17 +1,24 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"os"
 
 	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/progress"
 )
 
 func main() {
 	showHelp := flag.Bool("help", false, "displays a help text")
 	flag.BoolVar(showHelp, "h", false, "displays a help text")
 
+	archiveFlags := cicci.RegisterFlags(flag.CommandLine)
+	vendorOutput := flag.String("vendor.output", "vendor-data", "file to write the vendor-data archive to")
+	progressFlags := progress.RegisterFlags(flag.CommandLine, "stderr")
+
 	flag.Parse()
 
 	if *showHelp {
@@ -19,6 +26,17 @@ func main() {
 		os.Exit(0)
 	}
 
+	// stdout carries the archive, everything else goes to stderr
+	reporter, err := progressFlags.New(os.Stderr, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fail := func(code int, format string, args ...interface{}) {
+		reporter.Error(fmt.Errorf(format, args...))
+		os.Exit(code)
+	}
+
 	args := flag.Args()
 	if len(args) == 0 {
 		args = []string{"."}
@@ -28,38 +46,76 @@ func main() {
 
 	files, err := cicci.CollectFiles(args)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "can't find files to merge:", err)
-		os.Exit(1)
+		fail(1, "can't find files to merge: %s", err)
 	}
+	vendorFiles, err := cicci.CollectFiles(archiveFlags.Vendor)
+	if err != nil {
+		fail(1, "can't find vendor files to merge: %s", err)
+	}
+	files = files.Without(vendorFiles)
 	if len(files) == 0 {
-		fmt.Fprintln(os.Stderr, "no files found, refusing to create empty archive")
-		os.Exit(2)
+		fail(2, "no files found, refusing to create empty archive")
 	}
+	reporter.Step(fmt.Sprintf("merging %d files", len(files)))
 
 	// 2. load / expand templates
 
 	expanded, err := files.LoadAndExpand(nil)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "can't load/expand files:", err)
-		os.Exit(3)
+		fail(3, "can't load/expand files: %s", err)
 	}
 
 	// 3. validate
 
-	errors := expanded.Validate()
-	for _, err := range errors {
-		fmt.Fprintln(os.Stderr, "WARNING:", err)
+	for _, err := range expanded.Validate() {
+		reporter.Warning(err)
 	}
 
 	// 4. generate multipart archive
 
-	archive, err := cicci.CreateMultipartArchive(expanded)
+	archive, err := cicci.BuildArchive(args, expanded, archiveFlags.Reproducible)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "can't create multipart archive:", err)
-		os.Exit(4)
+		fail(4, "can't create multipart archive: %s", err)
+	}
+	// the hash covers stdout, including the trailing newline
+	summary := archiveSummary{Files: expanded.Filenames(), SHA256: sha256Hex(archive + "\n")}
+
+	// 5. build the vendor-data archive the same way
+
+	if len(vendorFiles) != 0 {
+		reporter.Step(fmt.Sprintf("merging %d vendor files into %s", len(vendorFiles), *vendorOutput))
+		expandedVendor, err := vendorFiles.LoadAndExpand(nil)
+		if err != nil {
+			fail(3, "can't load/expand vendor files: %s", err)
+		}
+		for _, err := range expandedVendor.Validate() {
+			reporter.Warning(err)
+		}
+		vendorArchive, err := cicci.BuildArchive(archiveFlags.Vendor, expandedVendor, archiveFlags.Reproducible)
+		if err != nil {
+			fail(4, "can't create vendor multipart archive: %s", err)
+		}
+		if err := os.WriteFile(*vendorOutput, []byte(vendorArchive), os.FileMode(0644)); err != nil {
+			fail(5, "can't write vendor-data: %s", err)
+		}
+		summary.VendorFiles, summary.VendorSHA256 = expandedVendor.Filenames(), sha256Hex(vendorArchive)
 	}
 
-	// 5. write multipart archive to stdout
+	// 6. write multipart archive to stdout
 
 	fmt.Println(archive)
+	reporter.Summary(summary)
+}
+
+// archiveSummary is the --log-format=json summary of a merge
+type archiveSummary struct {
+	Files        []string `json:"files"`
+	SHA256       string   `json:"sha256"`
+	VendorFiles  []string `json:"vendor_files,omitempty"`
+	VendorSHA256 string   `json:"vendor_sha256,omitempty"`
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/flags"
+	"github.com/rtreffer/piccu/pkg/piccu"
+	"github.com/rtreffer/piccu/pkg/progress"
+	"github.com/rtreffer/piccu/pkg/secretary"
+)
+
+//go:embed build.txt
+var buildHelp string
+
+// inputFlags are the flags of the commands that generate user-data
+type inputFlags struct {
+	secrets       *secretary.Flags
+	archive       *cicci.Flags
+	progress      *progress.Flags
+	release       *string
+	baseImage     *string
+	cacheDir      *string
+	bootPartition *int
+	partitions    piccu.DataPartitions
+}
+
+func registerInputFlags(flagSet *flag.FlagSet, progressTarget string) *inputFlags {
+	f := &inputFlags{
+		secrets:    secretary.RegisterFlags(flagSet),
+		archive:    cicci.RegisterFlags(flagSet),
+		progress:   progress.RegisterFlags(flagSet, progressTarget),
+		partitions: make(piccu.DataPartitions, 0),
+	}
+	f.release = flagSet.String("ubuntu", piccu.DefaultRelease, "ubuntu release to use (supported releases: "+releaseNames()+")")
+	f.baseImage = flagSet.String("image", "", "local base image to use instead of the --ubuntu release")
+	f.cacheDir = flagSet.String("cache.dir", "", "directory holding downloaded images, default .cache")
+	f.bootPartition = flagSet.Int("boot.partition", 0, "index of the boot partition, default: the FAT partition labelled system-boot, boot, bootfs or CIDATA")
+	flagSet.Var(&f.partitions, "partition", "append a data partition mounted by label (LABEL:SIZE:vfat|ext4[:SRC[:MOUNTPOINT]])")
+	return f
+}
+
+// builder loads the secrets and returns the builder for the inputs
+func (f *inputFlags) builder(inputs []string, reporter progress.Reporter) (*piccu.Builder, error) {
+	secrets, err := f.secrets.Secrets()
+	if err != nil {
+		return nil, err
+	}
+	return &piccu.Builder{
+		Release:        *f.release,
+		BaseImage:      *f.baseImage,
+		CacheDir:       *f.cacheDir,
+		Inputs:         inputs,
+		VendorInputs:   f.archive.Vendor,
+		Secrets:        secrets,
+		BootPartition:  *f.bootPartition,
+		DataPartitions: f.partitions,
+		Reproducible:   f.archive.Reproducible,
+		Progress:       reporter,
+	}, nil
+}
+
+// build implements `piccu build [OPTIONS]... [FILE|DIR|GLOB]...`
+func build(args []string) int {
+	flagSet := flag.NewFlagSet("build", flag.ExitOnError)
+	flagSet.Usage = usage(flagSet, buildHelp)
+	input := registerInputFlags(flagSet, "stdout")
+	flagSet.Lookup("reproducible").Usage = "build byte-identical images from identical inputs, times come from SOURCE_DATE_EPOCH"
+
+	projectFile := flagSet.String("project", piccu.ProjectFile, "project file with the defaults of the flags, \"\" to ignore it")
+	explain := flagSet.Bool("explain", false, "print the effective configuration (project file, flags and defaults) and exit")
+	lockTimeout := flagSet.Duration("lock.timeout", piccu.DefaultLockTimeout, "how long to wait for another piccu fetching the same image")
+	output := flagSet.String("output", "disk.img", "output image")
+	formats := make(piccu.OutputFormats, 0)
+	flagSet.Var(&formats, "format", "file to write, repeatable: img (--output), img.gz (--output.gz) or user-data (--output with .img replaced by .user-data)")
+	force := flagSet.Bool("force", false, "rebuild even if the build key of the outputs matches, overwrite an output that is a symlink (its target) or a device (in place)")
+	lockFile := flagSet.String("lock", "", "lock file pinning the base image, input hashes and secret names, default piccu.lock next to the project file")
+	locked := flagSet.Bool("locked", false, "fail instead of building if anything drifted from the lock file")
+	manifestKey := flagSet.String("manifest.key", "", "sign the manifest written next to the output with this ed25519 private key (OpenSSH or PKCS#8 PEM)")
+	inventoryFile := flagSet.String("inventory", "", "build an image per host of this inventory (hosts.yaml) instead of --output")
+	workers := flagSet.Int("inventory.workers", piccu.DefaultWorkers, "number of inventory hosts built at once")
+	diskID := piccu.DiskIDKeep
+	flagSet.Var(&diskID, "disk.id", "disk signature and partition UUIDs of the output: keep, random or hostname (derived from the hostname)")
+	verify := flagSet.Bool("verify", true, "read back the injected files and check the boot partition after the build")
+	var imageSize flags.ByteSize
+	flagSet.Var(&imageSize, "size", "grow the output image and its last partition to this size (e.g. 8G)")
+	growRootFS := flagSet.Bool("size.rootfs", false, "grow the ext4 root file system together with --size")
+
+	networkConfigFile := flagSet.String("network-config", "", "network-config (netplan v2 or v1) file or template to add to /boot/firmware")
+
+	metaDataFile := flagSet.String("meta-data", "", "meta-data file or template with extra keys (e.g. instance-id)")
+	metaDataSet, _ := flags.NewStringMap()
+	flagSet.Var(metaDataSet, "meta-data.set", "set a meta-data key (e.g. local-hostname=pi1)")
+	hostname := flagSet.String("hostname", "", "local-hostname for meta-data, defaults to the cloud-config hostname")
+
+	injectBootFile := make(flags.StringArray, 0)
+	flagSet.Var(&injectBootFile, "boot.firmware.file", "inject the given file under /boot/firmware (e.g. a patched start4.elf)")
+
+	rootFiles := make(piccu.RootFiles, 0)
+	flagSet.Var(&rootFiles, "root.file", "copy a file or directory into the root file system (SRC:DEST[:UID:GID[:MODE]])")
+
+	configTxtEdits, configTxtSet, configTxtAdd, configTxtRemove := piccu.NewConfigTxtFlagset()
+	flagSet.Var(configTxtSet, "config.txt.set", "set a config.txt value, replacing existing ones (e.g. [pi4]enable_uart=1)")
+	flagSet.Var(configTxtAdd, "config.txt.add", "add a config.txt value, keeping existing ones (e.g. dtoverlay=i2c-rtc,ds3231)")
+	flagSet.Var(configTxtRemove, "config.txt.remove", "remove a config.txt key or key=value (e.g. dtparam=audio=on)")
+
+	cmdlineEdits, cmdlineSet, cmdlineAdd, cmdlineRemove := piccu.NewCmdlineFlagset()
+	flagSet.Var(cmdlineSet, "cmdline.set", "set a kernel parameter, replacing existing ones (e.g. root=/dev/sda2)")
+	flagSet.Var(cmdlineAdd, "cmdline.add", "add a kernel parameter, keeping existing ones (e.g. cgroup_enable=memory)")
+	flagSet.Var(cmdlineRemove, "cmdline.remove", "remove a kernel parameter key or key=value (e.g. console=tty1)")
+
+	flagSet.Parse(args)
+
+	explicitProject := false
+	flagSet.Visit(func(f *flag.Flag) {
+		explicitProject = explicitProject || f.Name == "project"
+	})
+	project, err := loadProject(flagSet, input.secrets, *projectFile, explicitProject)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *explain {
+		project.explain(os.Stdout)
+		return 0
+	}
+
+	var inventory *piccu.Inventory
+	if *inventoryFile != "" {
+		if *locked {
+			fmt.Fprintln(os.Stderr, "--locked is not supported with --inventory")
+			return 1
+		}
+		if inventory, err = piccu.LoadInventory(*inventoryFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// progress bars of parallel builds would overwrite each other
+		if input.progress.Format == "text" {
+			input.progress.Format = "plain"
+		}
+	}
+
+	reporter, err := input.progress.New(os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// the inventory lists the inputs of its hosts, only the ones given on the
+	// command line are shared by all of them
+	inputs := project.inputs
+	if inventory != nil {
+		inputs = flagSet.Args()
+	}
+	builder, err := input.builder(inputs, reporter)
+	if err != nil {
+		reporter.Error(err)
+		return 1
+	}
+	builder.ExcludeInputs = project.excludeInputs()
+	builder.LockTimeout = *lockTimeout
+	builder.NetworkConfig = *networkConfigFile
+	builder.MetaData = *metaDataFile
+	builder.MetaDataSet = *metaDataSet
+	builder.Hostname = *hostname
+	builder.BootFiles = injectBootFile
+	builder.ConfigTxtEdits = *configTxtEdits
+	builder.CmdlineEdits = *cmdlineEdits
+	builder.RootFiles = rootFiles
+	builder.Size = int64(imageSize)
+	builder.GrowRootFS = *growRootFS
+	builder.DiskID = diskID
+	builder.SkipVerify = !*verify
+	builder.Output = *output
+	builder.Formats = formats
+	builder.Force = *force
+	builder.ManifestKey = *manifestKey
+	if inventory == nil {
+		builder.LockFile = project.lockFile(*lockFile, *locked)
+		builder.Locked = *locked
+	}
+
+	// SIGINT and SIGTERM cancel the build, partial outputs are removed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// the builder reports its errors and the summary
+	if inventory != nil {
+		if _, err := piccu.BuildInventory(ctx, builder, inventory, *workers); err != nil {
+			reporter.Error(err)
+			return exitCode(err)
+		}
+		return 0
+	}
+	if _, err := builder.Build(ctx); err != nil {
+		return exitCode(err)
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/rtreffer/piccu/pkg/flags"
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// cache implements `piccu cache [list|clean]`
+func cache(args []string) int {
+	flagSet := flag.NewFlagSet("cache", flag.ExitOnError)
+	cacheDir := flagSet.String("cache.dir", "", "directory holding downloaded images, default .cache")
+	jsonOutput := flagSet.Bool("json", false, "print the cache entries as JSON")
+	downloads := flagSet.Bool("downloads", false, "clean: remove the downloads as well, they are fetched again on the next build")
+	lockTimeout := flagSet.Duration("lock.timeout", piccu.DefaultLockTimeout, "how long to wait for a piccu fetching an image that is cleaned")
+	flagSet.Usage = usage(flagSet, `Usage: piccu cache [OPTIONS]... [list|clean]
+List the downloaded and extracted base images (list, the default) or remove
+the extracted images (clean), they are extracted from the download again on
+the next build. clean waits for builds fetching the same release.`)
+	flagSet.Parse(args)
+	action := "list"
+	if flagSet.NArg() > 1 {
+		flagSet.Usage()
+		return 1
+	}
+	if flagSet.NArg() == 1 {
+		action = flagSet.Arg(0)
+	}
+
+	var entries []piccu.CacheEntry
+	var err error
+	switch action {
+	case "list":
+		entries, err = piccu.ListCache(*cacheDir)
+	case "clean":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		entries, err = piccu.CleanCache(ctx, *cacheDir, *downloads, *lockTimeout)
+	default:
+		flagSet.Usage()
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't %s the cache: %s\n", action, err)
+		return 2
+	}
+
+	if *jsonOutput {
+		if entries == nil {
+			entries = []piccu.CacheEntry{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+	prefix := ""
+	if action == "clean" {
+		prefix = "removed "
+	}
+	var total int64
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, entry := range entries {
+		size := flags.ByteSize(entry.Size)
+		fmt.Fprintf(table, "%s%s\t%s\t%s\t%s\t%s\n", prefix, entry.Path, entry.Kind, entry.Image, size.String(), entry.ModTime.Format("2006-01-02 15:04"))
+		total += entry.Size
+	}
+	table.Flush()
+	size := flags.ByteSize(total)
+	fmt.Printf("%s%d files, %s\n", prefix, len(entries), size.String())
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// extract implements `piccu extract [--vendor] <image|user-data> <dir>`
+func extract(args []string) int {
+	flagSet := flag.NewFlagSet("extract", flag.ExitOnError)
+	vendor := flagSet.Bool("vendor", false, "extract vendor-data instead of user-data from an image")
+	bootPartition := flagSet.Int("boot.partition", 0, "index of the boot partition, default: selected by label")
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: piccu extract [--vendor] [--boot.partition N] IMAGE|USER-DATA DIR")
+		fmt.Fprintln(flagSet.Output(), "Write each part of the user-data of an image, a card or a raw/gzipped user-data file to DIR.")
+		fmt.Fprintln(flagSet.Output(), "Parts are named NN-<filename>.yaml or .sh, their names, headers and the boundary are kept in")
+		fmt.Fprintln(flagSet.Output(), "DIR/.cicci-archive.yaml, so building from DIR recreates an archive with the same parts.")
+		fmt.Fprintln(flagSet.Output(), "Archives written by piccu come back byte for byte, others can differ in header order, extra")
+		fmt.Fprintln(flagSet.Output(), "headers and transfer encoding. Extracted parts contain expanded templates, including secrets.")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if flagSet.NArg() != 2 {
+		flagSet.Usage()
+		return 1
+	}
+	source, dir := flagSet.Arg(0), flagSet.Arg(1)
+
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		fmt.Fprintln(os.Stderr, dir, "is not empty, refusing to mix extracted parts with other files")
+		return 1
+	}
+
+	name := "user-data"
+	if *vendor {
+		name = "vendor-data"
+	}
+	var data []byte
+	if img, err := piccu.OpenImageWith(source, piccu.OpenOptions{ReadOnly: true, BootPartition: *bootPartition}); err == nil {
+		data, err = img.ReadFile(name)
+		img.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't read %s from %s: %s\n", name, source, err)
+			return 2
+		}
+	} else if data, err = os.ReadFile(source); err != nil {
+		fmt.Fprintln(os.Stderr, "can't read", source+":", err)
+		return 2
+	}
+	data, err := piccu.Gunzip(data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't decompress", name+":", err)
+		return 2
+	}
+
+	metadata, err := cicci.ExtractArchive(string(data), dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't extract", name+":", err)
+		return 2
+	}
+	for _, part := range metadata.Parts {
+		fmt.Printf("%s <- %s (%s)\n", part.File, part.Filename, part.ContentType)
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rtreffer/piccu/pkg/piccu"
+	"github.com/rtreffer/piccu/pkg/progress"
+)
+
+// flash implements `piccu flash [OPTIONS]... IMAGE DEVICE`
+func flash(args []string) int {
+	flagSet := flag.NewFlagSet("flash", flag.ExitOnError)
+	progressFlags := progress.RegisterFlags(flagSet, "stdout")
+	force := flagSet.Bool("force", false, "write to a target that is not a device")
+	verify := flagSet.Bool("verify", true, "read the device back and compare it with the image")
+	flagSet.Usage = usage(flagSet, `Usage: piccu flash [OPTIONS]... IMAGE DEVICE
+Write an image to a card, e.g. piccu flash disk.img /dev/sdb. Devices with
+mounted partitions are refused. The device is synced and read back.`)
+	flagSet.Parse(args)
+	if flagSet.NArg() != 2 {
+		flagSet.Usage()
+		return 1
+	}
+
+	reporter, err := progressFlags.New(os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := piccu.Flash(ctx, flagSet.Arg(0), flagSet.Arg(1), *force, *verify, reporter); err != nil {
+		reporter.Error(fmt.Errorf("can't flash %s: %w", flagSet.Arg(1), err))
+		if ctx.Err() != nil {
+			return 130
+		}
+		return 2
+	}
+	return 0
+}
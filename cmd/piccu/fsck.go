@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// fsck implements `piccu fsck <image>`
+func fsck(args []string) int {
+	flagSet := flag.NewFlagSet("fsck", flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: piccu fsck IMAGE")
+		fmt.Fprintln(flagSet.Output(), "Check the FAT partitions of an image or card without mounting them: boot sector, FAT copies, directory entries and cluster chains.")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 1
+	}
+
+	problems, err := piccu.CheckImageFAT(flagSet.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't check image:", err)
+		return 2
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d problems found\n", flagSet.Arg(0), len(problems))
+		return 3
+	}
+	fmt.Println(flagSet.Arg(0) + ": clean")
+	return 0
+}
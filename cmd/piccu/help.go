@@ -1,15 +1,14 @@
 package main
 
 import (
-	_ "embed"
 	"flag"
 	"fmt"
 )
 
-//go:embed help.txt
-var helpText string
-
-func printHelp() {
-	fmt.Println(helpText)
-	flag.PrintDefaults()
+// usage prints the help text and the defaults of a command
+func usage(flagSet *flag.FlagSet, text string) func() {
+	return func() {
+		fmt.Fprintln(flagSet.Output(), text)
+		flagSet.PrintDefaults()
+	}
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rtreffer/piccu/pkg/flags"
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// images implements `piccu images [--json]`
+func images(args []string) int {
+	flagSet := flag.NewFlagSet("images", flag.ExitOnError)
+	jsonOutput := flagSet.Bool("json", false, "print the image sources as JSON")
+	flagSet.Usage = usage(flagSet, `Usage: piccu images [--json]
+List the ubuntu releases --ubuntu accepts. A release can be given as
+codename or version, optionally with :arm64 or :armhf, arm64 is preferred.`)
+	flagSet.Parse(args)
+	if flagSet.NArg() != 0 {
+		flagSet.Usage()
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(piccu.ImageSources); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	defaultImage := piccu.ImagesByKey()[piccu.DefaultRelease]
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer table.Flush()
+	fmt.Fprintln(table, "RELEASE\tCODENAME\tARCH\tBOARDS\tSIZE\tURL")
+	for _, img := range piccu.ImageSources {
+		size := flags.ByteSize(img.ExtractedFilesize)
+		marker := ""
+		if img.URL == defaultImage.URL {
+			marker = "  (default)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s%s\n", img.Release, img.Codename, img.Architecture, strings.Join(img.Raspberry, ","), size.String(), img.URL, marker)
+	}
+	return 0
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/flags"
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// inspect implements `piccu inspect [--json] <image>`
+func inspect(args []string) int {
+	flagSet := flag.NewFlagSet("inspect", flag.ExitOnError)
+	jsonOutput := flagSet.Bool("json", false, "print the inspection as JSON")
+	bootPartition := flagSet.Int("boot.partition", 0, "index of the boot partition, default: selected by label")
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: piccu inspect [--json] [--boot.partition N] IMAGE")
+		fmt.Fprintln(flagSet.Output(), "Show the partitions, boot files, user-data, vendor-data, meta-data and network-config of an image or card.")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 1
+	}
+
+	img, err := piccu.OpenImageWith(flagSet.Arg(0), piccu.OpenOptions{ReadOnly: true, BootPartition: *bootPartition})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't open image:", err)
+		return 2
+	}
+	defer img.Close()
+	inspection, err := piccu.Inspect(img)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "can't inspect image:", err)
+		return 2
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(inspection); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+
+	fmt.Println("image:", inspection.Image)
+	fmt.Println("boot partition:", inspection.BootPartition)
+	fmt.Println("\npartitions:")
+	for _, p := range inspection.Partitions {
+		size := flags.ByteSize(p.Size)
+		fmt.Printf("  %d  type %s  start %d  size %s  %s %s %s\n", p.Index, p.Type, p.Start, size.String(), p.FSType, p.FSLabel, p.Label)
+	}
+	fmt.Println("\nboot files:")
+	for _, f := range inspection.BootFiles {
+		if f.IsDir {
+			fmt.Printf("  %s/\n", f.Name)
+			continue
+		}
+		fmt.Printf("  %-40s %10d  %s\n", f.Name, f.Size, f.ModTime.Format("2006-01-02 15:04:05"))
+	}
+	printParts("user-data", inspection.UserData)
+	printParts("vendor-data", inspection.VendorData)
+	printFile("meta-data", inspection.MetaData)
+	printFile("network-config", inspection.NetworkConfig)
+	return 0
+}
+
+func printParts(name string, parts []cicci.ArchivePart) {
+	if len(parts) == 0 {
+		fmt.Printf("\n%s: none\n", name)
+		return
+	}
+	fmt.Printf("\n%s: %d parts\n", name, len(parts))
+	for i, part := range parts {
+		fmt.Printf("\n--- %d: %s\n", i+1, part.Filename)
+		fmt.Println("Content-Type:", part.ContentType)
+		if part.MergeType != "" {
+			fmt.Println("Merge-Type:", part.MergeType)
+		}
+		fmt.Println()
+		fmt.Println(strings.TrimRight(part.Content, "\n"))
+	}
+}
+
+func printFile(name, content string) {
+	if content == "" {
+		fmt.Printf("\n%s: none\n", name)
+		return
+	}
+	fmt.Printf("\n%s:\n%s\n", name, strings.TrimRight(content, "\n"))
+}
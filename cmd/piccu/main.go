@@ -1,184 +1,112 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/rtreffer/piccu/pkg/cicci"
-	"github.com/rtreffer/piccu/pkg/flags"
-	"github.com/rtreffer/piccu/pkg/ioutils"
 	"github.com/rtreffer/piccu/pkg/piccu"
-	"github.com/rtreffer/piccu/pkg/secretary"
 )
 
-func main() {
-	showHelp := flag.Bool("help", false, "displays a help text")
-	flag.BoolVar(showHelp, "h", false, "displays a help text")
-
-	fileFlags, plainVar, passVar, setVar, unsetVar := secretary.NewMultiFlagset()
-	flag.Var(plainVar, "plain", "plain environment file to load")
-	flag.Var(passVar, "pass", "pass secret name to load")
-	flag.Var(setVar, "set", "set environment variables")
-	flag.Var(unsetVar, "unset", "unset environmenr variables")
-	passConfig := flag.String("pass.config", "", "pass config file to load")
-	passStoreDir := flag.String("pass.store.dir", "", "pass store directory to use")
-
-	release := flag.String("ubuntu", "jammy:arm64", "ubuntu release to use (supported releases: "+strings.Join(piccu.GetImageNames(), ",")+")")
-	output := flag.String("output", "disk.img", "output image")
-
-	injectBootFile := make(flags.StringArray, 0)
-	flag.Var(&injectBootFile, "boot.firmware.file", "inject the give file under /boot/firmware (e.g. meta-data)")
-
-	flag.Parse()
-
-	if *showHelp {
-		printHelp()
-		os.Exit(0)
-	}
-
-	// resolve the image and load it
-	image, found := piccu.ImagesByKey()[*release]
-	if !found {
-		fmt.Fprintln(os.Stderr, "could not find image", *release)
-		os.Exit(1)
-	}
-	cached, err := piccu.Fetch(image, "", 7*24*time.Hour)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "could not download", *release, err)
-		os.Exit(2)
-	}
-	_ = cached
-
-	// load secrets
+// command is a piccu subcommand, run gets the arguments after its name and
+// returns the exit code
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
 
-	if *passConfig != "" {
-		secretary.PassSetConfig(*passConfig)
-	}
-	if *passStoreDir != "" {
-		secretary.PassSetStoreDir(*passStoreDir)
+var commands []command
+
+func init() {
+	// help refers to commands, so the table is filled at init time
+	commands = []command{
+		{"build", "build an image from cloud-config files and templates (default)", build},
+		{"render", "print the user-data archive without building an image", render},
+		{"images", "list the supported ubuntu releases", images},
+		{"cache", "list or clean the downloaded base images", cache},
+		{"inspect", "show the partitions and cloud-init files of an image", inspect},
+		{"extract", "write the parts of the user-data of an image to a directory", extract},
+		{"fsck", "check the FAT partitions of an image", fsck},
+		{"flash", "write an image to a card", flash},
+		{"verify-manifest", "check an image or card against its build manifest", verifyManifest},
+		{"version", "print the piccu version", version},
+		{"help", "show the help of piccu or of a command", help},
 	}
+}
 
-	secretKeys := make(map[string]string)
-	for _, flagValue := range *fileFlags {
-		if flagValue.Type == secretary.LoadPlainFile {
-			env, err := secretary.PlainLoadSecret(flagValue.Name)
-			if err != nil {
-				panic(err)
-			}
-			for k, v := range env {
-				secretKeys[k] = v
-			}
-			continue
-		}
-
-		if flagValue.Type == secretary.LoadPass {
-			env, err := secretary.PassLoadSecret(flagValue.Name)
-			if err != nil {
-				panic(err)
-			}
-			if len(env) == 0 {
-				fmt.Fprintln(os.Stderr, "no secrets loaded from", flagValue.Name)
-				os.Exit(1)
-			}
-			for k, v := range env {
-				secretKeys[k] = v
-			}
-		}
-
-		if flagValue.Type == secretary.Unset {
-			delete(secretKeys, flagValue.Name)
-		}
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-		if flagValue.Type == secretary.Set {
-			parts := strings.SplitN(flagValue.Name, "=", 2)
-			if len(parts) == 1 {
-				secretKeys[parts[0]] = ""
-				continue
+// run dispatches to the command named by the first argument, piccu without
+// a command builds like it always did
+func run(args []string) int {
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name {
+				return c.run(args[1:])
 			}
-			secretKeys[parts[0]] = parts[1]
 		}
-	}
-
-	// build the cloud-config
-	args := flag.Args()
-	if len(args) == 0 {
-		args = []string{"."}
-	}
-	files, err := cicci.CollectFiles(args)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "can't find files to merge:", err)
-		os.Exit(1)
-	}
-	cloudConfigArchive := ""
-	if len(files) != 0 {
-		expanded, err := files.LoadAndExpand(secretKeys)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "can't load/expand files:", err)
-			os.Exit(3)
-		}
-		errors := expanded.Validate()
-		for _, err := range errors {
-			fmt.Fprintln(os.Stderr, "WARNING:", err)
-		}
-		cloudConfigArchive, err = cicci.CreateMultipartArchive(expanded)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "can't create multipart archive:", err)
-			os.Exit(4)
+		switch args[0] {
+		case "-h", "-help", "--help":
+			return help(nil)
+		case "-version", "--version":
+			return version(nil)
 		}
 	}
+	return build(args)
+}
 
-	// copy the file to the output
-	if stat, err := os.Stat(*output); err == nil {
-		if stat.Mode().IsRegular() {
-			os.Remove(*output)
+// help implements `piccu help [COMMAND]`
+func help(args []string) int {
+	if len(args) > 0 {
+		for _, c := range commands {
+			if args[0] == c.name && c.name != "help" {
+				return c.run([]string{"--help"})
+			}
 		}
+		fmt.Fprintln(os.Stderr, "unknown command", args[0])
+		return 1
 	}
-
-	err = ioutils.Copy(cached, *output)
-	if err != nil {
-		os.Remove(*output)
-		panic(err)
+	fmt.Println("Usage: piccu [COMMAND] [OPTIONS]... [ARGS]...")
+	fmt.Println("Build ubuntu raspberry pi images with cloud-config, without root privileges.")
+	fmt.Println("\nCommands:")
+	for _, c := range commands {
+		fmt.Printf("  %-15s  %s\n", c.name, c.summary)
 	}
+	fmt.Println("\n`piccu COMMAND --help` shows the options of a command. Without a command")
+	fmt.Println("piccu builds, `piccu [OPTIONS]... [FILE|DIR|GLOB]...` is `piccu build`.")
+	return 0
+}
 
-	// inject the cloud-config
-	fmt.Println("modifying", *output)
-
-	img, err := piccu.OpenImage(*output)
-	if err != nil {
-		os.Remove(*output)
-		panic(err)
+// exitCode maps build errors to the exit codes piccu always used
+func exitCode(err error) int {
+	if errors.Is(err, context.Canceled) {
+		return 130
 	}
-	if cloudConfigArchive != "" {
-		userData, err := piccu.GzipString(cloudConfigArchive)
-		if err != nil {
-			os.Remove(*output)
-			panic(err)
-		}
-		fmt.Println("adding user-data")
-		if err := img.InjectFile("user-data", userData); err != nil {
-			os.Remove(*output)
-			panic(err)
-		}
+	var buildErr *piccu.BuildError
+	if !errors.As(err, &buildErr) {
+		return 1
 	}
-
-	for _, bootfile := range injectBootFile {
-		data, err := os.ReadFile(bootfile)
-		if err != nil {
-			os.Remove(*output)
-			panic(err)
-		}
-		name := filepath.Base(bootfile)
-		fmt.Println("adding", name)
-		if err := img.InjectFile(name, data); err != nil {
-			os.Remove(*output)
-			panic(err)
-		}
+	switch buildErr.Stage {
+	case piccu.StageFetch:
+		return 2
+	case piccu.StageExpand:
+		return 3
+	case piccu.StageGenerate:
+		return 4
+	case piccu.StageVerify:
+		return 5
+	case piccu.StageImage:
+		return 6
 	}
+	return 1
+}
 
-	fmt.Println("syncing", *output)
-	img.Close()
+// releaseNames lists the --ubuntu values for flag help texts
+func releaseNames() string {
+	return strings.Join(piccu.GetImageNames(), ",")
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtreffer/piccu/pkg/piccu"
+	"github.com/rtreffer/piccu/pkg/secretary"
+)
+
+// secretFlags share one ordered list, project secrets are loaded before the
+// ones given on the command line
+var secretFlags = map[string]bool{"plain": true, "pass": true, "set": true, "unset": true}
+
+// projectFlags tracks where the values of the build flags came from
+type projectFlags struct {
+	flagSet *flag.FlagSet
+	secrets *secretary.Flags
+	project *piccu.Project
+	// sources maps flag names to the project file or "command line"
+	sources map[string]string
+	// projectSecrets is the number of secrets loaded from the project
+	projectSecrets int
+	inputs         []string
+	inputsSource   string
+}
+
+// loadProject applies the project file to the parsed flagSet, flags given
+// on the command line win and flags the command doesn't have are skipped. A
+// missing default project file is skipped.
+func loadProject(flagSet *flag.FlagSet, secrets *secretary.Flags, path string, explicit bool) (*projectFlags, error) {
+	p := &projectFlags{flagSet: flagSet, secrets: secrets, sources: make(map[string]string)}
+	flagSet.Visit(func(f *flag.Flag) {
+		p.sources[f.Name] = "command line"
+	})
+	p.inputs, p.inputsSource = flagSet.Args(), "command line"
+	if path == "" {
+		return p, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) && !explicit {
+		return p, nil
+	}
+	project, err := piccu.LoadProject(path)
+	if err != nil {
+		return nil, err
+	}
+	p.project = project
+
+	cliSecrets := secrets.Loads
+	secrets.Loads = make(secretary.LoadFlags, 0)
+	for _, projectFlag := range project.Flags() {
+		if flagSet.Lookup(projectFlag.Name) == nil {
+			continue
+		}
+		if !secretFlags[projectFlag.Name] && p.sources[projectFlag.Name] == "command line" {
+			continue
+		}
+		if err := flagSet.Set(projectFlag.Name, projectFlag.Value); err != nil {
+			return nil, fmt.Errorf("%s: invalid %s: %w", path, projectFlag.Name, err)
+		}
+		if !secretFlags[projectFlag.Name] {
+			p.sources[projectFlag.Name] = path
+		}
+	}
+	p.projectSecrets = len(secrets.Loads)
+	secrets.Loads = append(secrets.Loads, cliSecrets...)
+
+	if len(p.inputs) == 0 && len(project.Inputs) > 0 {
+		p.inputs, p.inputsSource = project.InputPaths(), path
+	}
+	return p, nil
+}
+
+// excludeInputs keeps the project file out of user-data when it is among
+// the inputs
+func (p *projectFlags) excludeInputs() []string {
+	if p.project == nil {
+		return nil
+	}
+	return []string{p.project.Path}
+}
+
+// lockFile returns the lock file of a build: the --lock flag, piccu.lock
+// next to the project file or, for --locked builds, in the current directory
+func (p *projectFlags) lockFile(flagValue string, locked bool) string {
+	switch {
+	case flagValue != "":
+		return flagValue
+	case p.project != nil:
+		return filepath.Join(filepath.Dir(p.project.Path), piccu.LockFile)
+	case locked:
+		return piccu.LockFile
+	}
+	return ""
+}
+
+// explain prints the effective configuration of a build, secrets are shown
+// by name only
+func (p *projectFlags) explain(out io.Writer) {
+	if p.project != nil {
+		fmt.Fprintln(out, "project:", p.project.Path)
+	} else {
+		fmt.Fprintln(out, "project: none")
+	}
+	if len(p.inputs) == 0 {
+		fmt.Fprintln(out, "inputs: . (default)")
+	} else {
+		fmt.Fprintf(out, "inputs: %s (%s)\n", strings.Join(p.inputs, " "), p.inputsSource)
+	}
+	fmt.Fprintln(out, "flags:")
+	p.flagSet.VisitAll(func(f *flag.Flag) {
+		if secretFlags[f.Name] || f.Name == "explain" || f.Name == "project" {
+			return
+		}
+		source, found := p.sources[f.Name]
+		if !found {
+			source = "default"
+		}
+		fmt.Fprintf(out, "  --%s=%s (%s)\n", f.Name, f.Value.String(), source)
+	})
+	fmt.Fprintln(out, "secrets, in load order:")
+	for i, load := range p.secrets.Loads {
+		source := "command line"
+		if i < p.projectSecrets {
+			source = p.project.Path
+		}
+		switch load.Type {
+		case secretary.LoadPlainFile:
+			fmt.Fprintf(out, "  plain %s (%s)\n", load.Name, source)
+		case secretary.LoadPass:
+			fmt.Fprintf(out, "  pass %s (%s)\n", load.Name, source)
+		case secretary.Set:
+			fmt.Fprintf(out, "  set %s (%s)\n", strings.SplitN(load.Name, "=", 2)[0], source)
+		case secretary.Unset:
+			fmt.Fprintf(out, "  unset %s (%s)\n", load.Name, source)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// render implements `piccu render [OPTIONS]... [FILE|DIR|GLOB]...`
+func render(args []string) int {
+	flagSet := flag.NewFlagSet("render", flag.ExitOnError)
+	input := registerInputFlags(flagSet, "stderr")
+	output := flagSet.String("output", "-", "file to write the user-data archive to, - for stdout")
+	projectFile := flagSet.String("project", piccu.ProjectFile, "project file with the defaults of the flags, \"\" to ignore it")
+	flagSet.Usage = usage(flagSet, `Usage: piccu render [OPTIONS]... [FILE|DIR|GLOB]...
+Merge the inputs into the user-data archive a build would inject, without
+downloading or writing an image. Like piccu build, the inputs, secrets,
+variables and image of piccu.yaml apply unless given on the command line,
+its output and image edits are ignored. Image facts (IMAGE_*) are read from
+--image or from the --ubuntu release if it is already cached. The archive
+is plain text, builds gzip it.`)
+	flagSet.Parse(args)
+
+	// the output of the project is an image, not the archive
+	explicitProject, explicitOutput := false, false
+	flagSet.Visit(func(f *flag.Flag) {
+		explicitProject = explicitProject || f.Name == "project"
+		explicitOutput = explicitOutput || f.Name == "output"
+	})
+	project, err := loadProject(flagSet, input.secrets, *projectFile, explicitProject)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !explicitOutput {
+		*output = "-"
+	}
+
+	// stdout may carry the archive
+	reporter, err := input.progress.New(os.Stderr, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	builder, err := input.builder(project.inputs, reporter)
+	if err != nil {
+		reporter.Error(err)
+		return 1
+	}
+	builder.ExcludeInputs = project.excludeInputs()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	userData, err := builder.Render(ctx)
+	if err != nil {
+		reporter.Error(err)
+		return exitCode(err)
+	}
+	if userData == "" {
+		reporter.Error(fmt.Errorf("no files found, refusing to create empty archive"))
+		return 1
+	}
+	// stdout ends with a newline like cicci, files hold the injected archive
+	if *output == "-" {
+		fmt.Println(userData)
+		return 0
+	}
+	if err := os.WriteFile(*output, []byte(userData), os.FileMode(0644)); err != nil {
+		reporter.Error(fmt.Errorf("can't write %s: %s", *output, err))
+		return 1
+	}
+	return 0
+}
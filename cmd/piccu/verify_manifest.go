@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rtreffer/piccu/pkg/piccu"
+	"github.com/rtreffer/piccu/pkg/progress"
+)
+
+// verifyManifest implements `piccu verify-manifest [OPTIONS]... IMAGE`
+func verifyManifest(args []string) int {
+	flagSet := flag.NewFlagSet("verify-manifest", flag.ExitOnError)
+	progressFlags := progress.RegisterFlags(flagSet, "stdout")
+	manifestFile := flagSet.String("manifest", "", "manifest to check against, default IMAGE"+piccu.ManifestSuffix)
+	keyFile := flagSet.String("key", "", "ed25519 public key (authorized_keys or PEM) that must have signed the manifest")
+	flagSet.Usage = usage(flagSet, `Usage: piccu verify-manifest [OPTIONS]... IMAGE
+Check the sha256 of an image, or of a card it was flashed to, against the
+manifest written by piccu build. --key checks that the manifest is signed
+by that key. Without it the signature can't be trusted, anyone can sign a
+modified manifest with their own key, the fingerprint of the signing key is
+shown instead.`)
+	flagSet.Parse(args)
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 1
+	}
+	image := flagSet.Arg(0)
+	if *manifestFile == "" {
+		*manifestFile = image + piccu.ManifestSuffix
+	}
+
+	reporter, err := progressFlags.New(os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	manifest, err := piccu.LoadManifest(*manifestFile)
+	if err != nil {
+		reporter.Error(err)
+		return 1
+	}
+	var trusted ed25519.PublicKey
+	if *keyFile != "" {
+		if trusted, err = piccu.LoadPublicKey(*keyFile); err != nil {
+			reporter.Error(err)
+			return 1
+		}
+	}
+	if manifest.Signature != nil || trusted != nil {
+		if err := manifest.VerifySignature(trusted); err != nil {
+			reporter.Error(fmt.Errorf("%s: %w", *manifestFile, err))
+			return 1
+		}
+		if trusted != nil {
+			reporter.Step("signature of " + *manifestFile + " is valid")
+		} else {
+			fingerprint, err := manifest.Signature.Fingerprint()
+			if err != nil {
+				reporter.Error(fmt.Errorf("%s: %w", *manifestFile, err))
+				return 1
+			}
+			reporter.Warning(fmt.Errorf("%s is signed by the untrusted key %s, check the signer with --key", *manifestFile, fingerprint))
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := piccu.VerifyManifest(ctx, image, manifest, reporter); err != nil {
+		reporter.Error(err)
+		if ctx.Err() != nil {
+			return 130
+		}
+		return 5
+	}
+	reporter.Step(image + " matches " + *manifestFile)
+	return 0
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+
+	"github.com/rtreffer/piccu/pkg/piccu"
+)
+
+// version implements `piccu version`
+func version(args []string) int {
+	flagSet := flag.NewFlagSet("version", flag.ExitOnError)
+	flagSet.Usage = usage(flagSet, "Usage: piccu version\nPrint the piccu version and the go version it was built with.")
+	flagSet.Parse(args)
+	fmt.Printf("piccu %s (%s, %s/%s)\n", piccu.GetVersion(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
@@ -9,20 +9,15 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/rtreffer/piccu/pkg/progress"
 	"github.com/rtreffer/piccu/pkg/secretary"
 )
 
 func main() {
-	flags, plainVar, passVar, setVar, unsetVar := secretary.NewMultiFlagset()
-	flag.Var(plainVar, "plain", "plain file secret to load")
-	flag.Var(passVar, "pass", "pass secret name to load")
-	flag.Var(setVar, "set", "set environment variables")
-	flag.Var(unsetVar, "unset", "unset environmenr variables")
-	passConfig := flag.String("pass.config", "", "pass config file to load")
-	passStoreDir := flag.String("pass.store.dir", "", "pass store directory to use")
-
+	secretFlags := secretary.RegisterFlags(flag.CommandLine)
 	showHelp := flag.Bool("help", false, "displays a help text")
 	flag.BoolVar(showHelp, "h", false, "displays a help text")
+	progressFlags := progress.RegisterFlags(flag.CommandLine, "stderr")
 
 	flag.Parse()
 
@@ -31,64 +26,37 @@ func main() {
 		os.Exit(0)
 	}
 
-	if len(*flags) == 0 {
-		fmt.Fprintln(os.Stderr, "no secrets backend specified - exiting")
+	// stdout belongs to the command
+	reporter, err := progressFlags.New(os.Stderr, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fail := func(err error) {
+		reporter.Error(err)
 		os.Exit(1)
 	}
 
-	keys := make([]string, 0, 32)
-
-	if *passConfig != "" {
-		secretary.PassSetConfig(*passConfig)
+	if len(secretFlags.Loads) == 0 {
+		fail(fmt.Errorf("no secrets backend specified - exiting"))
 	}
-	if *passStoreDir != "" {
-		secretary.PassSetStoreDir(*passStoreDir)
+	remains := flag.Args()
+	if len(remains) == 0 {
+		fail(fmt.Errorf("no command given - exiting"))
 	}
 
-	for _, flagValue := range *flags {
-		if flagValue.Type == secretary.LoadPlainFile {
-			env, err := secretary.PlainLoadSecret(flagValue.Name)
-			if err != nil {
-				panic(err)
-			}
-			for k, v := range env {
-				if err := os.Setenv(k, v); err != nil {
-					panic(err)
-				}
-				keys = append(keys, k)
-			}
-			continue
-		}
-
-		if flagValue.Type == secretary.LoadPass {
-			env, err := secretary.PassLoadSecret(flagValue.Name)
-			if err != nil {
-				panic(err)
-			}
-			if len(env) == 0 {
-				fmt.Fprintln(os.Stderr, "no secrets loaded from", flagValue.Name)
-				os.Exit(1)
-			}
-			for k, v := range env {
-				if err := os.Setenv(k, v); err != nil {
-					panic(err)
-				}
-				keys = append(keys, k)
-			}
-		}
-
-		if flagValue.Type == secretary.Unset {
-			os.Unsetenv(flagValue.Name)
-		}
-
-		if flagValue.Type == secretary.Set {
-			parts := strings.SplitN(flagValue.Name, "=", 2)
-			if len(parts) == 1 {
-				os.Setenv(parts[0], "")
-				continue
-			}
-			keys = append(keys, parts[0])
-			os.Setenv(parts[0], parts[1])
+	env, err := secretary.ParseEnvironment(os.Environ())
+	if err != nil {
+		fail(err)
+	}
+	keys, err := secretFlags.Load(env)
+	if err != nil {
+		fail(err)
+	}
+	os.Clearenv()
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			fail(err)
 		}
 	}
 
@@ -110,15 +78,23 @@ func main() {
 
 	sort.Strings(keys)
 	if err := os.Setenv("SECRETARY_KEYS", strings.Join(keys, " ")); err != nil {
-		panic(err)
+		fail(err)
 	}
 
-	remains := flag.Args()
 	argv0, err := exec.LookPath(remains[0])
 	if err != nil {
 		argv0 = remains[0]
 	}
 
-	// if Exec succeeds then the new program takes over and panic is never called
-	panic(syscall.Exec(argv0, remains, os.Environ()))
+	// the summary lists key names only, never values
+	reporter.Summary(execSummary{Keys: keys, Command: remains[0]})
+
+	// if Exec succeeds then the new program takes over and fail is never called
+	fail(fmt.Errorf("can't run %s: %s", remains[0], syscall.Exec(argv0, remains, os.Environ())))
+}
+
+// execSummary is the --log-format=json summary printed before the exec
+type execSummary struct {
+	Keys    []string `json:"keys"`
+	Command string   `json:"command"`
 }
@@ -12,6 +12,7 @@ require (
 	github.com/schollz/progressbar/v3 v3.12.1
 	github.com/ulikunitz/xz v0.5.10
 	go.fuchsia.dev/fuchsia/src v0.0.0-20210227002123-220857068aaf
+	golang.org/x/crypto v0.2.0
 	gopkg.in/yaml.v3 v3.0.1
 	mvdan.cc/sh/v3 v3.5.1
 )
@@ -64,7 +65,6 @@ require (
 	github.com/zalando/go-keyring v0.2.1 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	golang.org/x/crypto v0.2.0 // indirect
 	golang.org/x/exp v0.0.0-20221111204811-129d8d6c17ab // indirect
 	golang.org/x/sys v0.2.0 // indirect
 	golang.org/x/term v0.2.0 // indirect
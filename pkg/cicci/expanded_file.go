@@ -10,6 +10,10 @@ type ExpandedFile struct {
 	Content          string
 	IsScript         bool
 	IsTemplate       bool
+	// ContentType and MergeType override the archive headers, they are set
+	// when rebuilding an extracted archive
+	ContentType string
+	MergeType   string
 }
 
 func (e *ExpandedFile) Validate() error {
@@ -33,3 +37,12 @@ func (s ExpandedFiles) Validate() (result []error) {
 	}
 	return
 }
+
+// Filenames returns the original names of the files
+func (s ExpandedFiles) Filenames() []string {
+	result := make([]string, 0, len(s))
+	for _, e := range s {
+		result = append(result, e.OriginalFilename)
+	}
+	return result
+}
@@ -0,0 +1,163 @@
+package cicci
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ArchiveMetadataFile is written next to extracted parts, it keeps what the
+// file names can't and is one of the IgnoredFiles
+const ArchiveMetadataFile = ".cicci-archive.yaml"
+
+var (
+	numberPrefix  = regexp.MustCompile(`^[0-9]+-`)
+	unsafeChars   = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	partExtension = regexp.MustCompile(`([.]tpl)?[.](yaml|yml|json|sh|bash)$`)
+)
+
+// ArchiveMetadata describes an extracted archive well enough to rebuild its
+// parts. Archives written by cicci are rebuilt byte for byte, other headers
+// and transfer encodings are not kept.
+type ArchiveMetadata struct {
+	// Boundary is empty for single part user-data
+	Boundary string                `yaml:"boundary,omitempty"`
+	Parts    []ArchivePartMetadata `yaml:"parts"`
+}
+
+// ArchivePartMetadata maps an extracted file to the headers of its part
+type ArchivePartMetadata struct {
+	File        string `yaml:"file"`
+	Filename    string `yaml:"filename,omitempty"`
+	ContentType string `yaml:"content_type"`
+	MergeType   string `yaml:"merge_type,omitempty"`
+}
+
+// ExtractArchive writes each part of user-data to dir as NN-<filename>.yaml
+// or .sh and records the headers in ArchiveMetadataFile
+func ExtractArchive(archive string, dir string) (*ArchiveMetadata, error) {
+	parts, err := ParseMultipartArchive(archive)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	metadata := &ArchiveMetadata{Boundary: ArchiveBoundary(archive)}
+	for i, part := range parts {
+		file := extractedName(i+1, part)
+		mode := os.FileMode(0644)
+		if part.ContentType == "text/x-shellscript" {
+			mode = 0755
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(part.Content), mode); err != nil {
+			return nil, err
+		}
+		metadata.Parts = append(metadata.Parts, ArchivePartMetadata{
+			File:        file,
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			MergeType:   part.MergeType,
+		})
+	}
+	content, err := yaml.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, os.WriteFile(filepath.Join(dir, ArchiveMetadataFile), content, 0644)
+}
+
+// extractedName numbers parts in archive order, the extension follows the
+// content type so that CollectFiles picks the file up as the same kind
+func extractedName(index int, part ArchivePart) string {
+	name := path.Base(filepath.ToSlash(part.Filename))
+	name = partExtension.ReplaceAllString(name, "")
+	name = numberPrefix.ReplaceAllString(name, "")
+	name = strings.Trim(unsafeChars.ReplaceAllString(name, "_"), "._")
+	if name == "" {
+		name = "part"
+	}
+	extension := ".yaml"
+	if part.ContentType == "text/x-shellscript" {
+		extension = ".sh"
+	}
+	return fmt.Sprintf("%02d-%s%s", index, name, extension)
+}
+
+// LoadArchiveMetadata reads the metadata of an extracted archive from the
+// first input directory that has one, it returns nil without metadata
+func LoadArchiveMetadata(inputs []string) (*ArchiveMetadata, error) {
+	for _, input := range inputs {
+		if stat, err := os.Stat(input); err != nil || !stat.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(input, ArchiveMetadataFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		metadata := &ArchiveMetadata{}
+		if err := yaml.Unmarshal(content, metadata); err != nil {
+			return nil, fmt.Errorf("%s: %s", filepath.Join(input, ArchiveMetadataFile), err)
+		}
+		return metadata, nil
+	}
+	return nil, nil
+}
+
+// CreateArchive rebuilds the extracted archive, files are matched to parts by
+// their base name and keep the part order, headers and boundary. Files that
+// were added after extraction follow with the default headers.
+func (m *ArchiveMetadata) CreateArchive(files ExpandedFiles) (string, error) {
+	byName := make(map[string]int, len(files))
+	for i, file := range files {
+		byName[path.Base(filepath.ToSlash(file.Filename))] = i
+	}
+	used := make([]bool, len(files))
+	ordered := make(ExpandedFiles, 0, len(files))
+	for _, part := range m.Parts {
+		i, ok := byName[part.File]
+		if !ok {
+			continue
+		}
+		file := files[i]
+		file.Filename = part.Filename
+		file.ContentType = part.ContentType
+		file.MergeType = part.MergeType
+		ordered = append(ordered, file)
+		used[i] = true
+	}
+	for i, file := range files {
+		if !used[i] {
+			ordered = append(ordered, file)
+		}
+	}
+	if m.Boundary == "" && len(ordered) == 1 {
+		return ordered[0].Content, nil
+	}
+	return CreateMultipartArchiveWithBoundary(ordered, m.Boundary)
+}
+
+// BuildArchive creates the archive for files collected from inputs, an
+// extracted archive among the inputs is rebuilt with its metadata. A
+// reproducible archive uses a boundary derived from the files.
+func BuildArchive(inputs []string, files ExpandedFiles, reproducible bool) (string, error) {
+	metadata, err := LoadArchiveMetadata(inputs)
+	if err != nil {
+		return "", err
+	}
+	if metadata != nil {
+		return metadata.CreateArchive(files)
+	}
+	if reproducible {
+		return CreateMultipartArchiveWithBoundary(files, ContentBoundary(files))
+	}
+	return CreateMultipartArchive(files)
+}
@@ -1,6 +1,7 @@
 package cicci
 
 import (
+	"io/fs"
 	"os"
 	"regexp"
 	"strings"
@@ -34,16 +35,24 @@ func (f *CCFile) Load() (string, error) {
 }
 
 func (f *CCFile) LoadAndExpand(extraKeys map[string]string) (ExpandedFile, error) {
-	var err error
+	content, err := f.Load()
+	return f.expand(content, err, extraKeys)
+}
+
+// LoadAndExpandFS is LoadAndExpand for a file of fsys
+func (f *CCFile) LoadAndExpandFS(fsys fs.FS, extraKeys map[string]string) (ExpandedFile, error) {
+	content, err := fs.ReadFile(fsys, string(*f))
+	return f.expand(string(content), err, extraKeys)
+}
 
+func (f *CCFile) expand(content string, err error, extraKeys map[string]string) (ExpandedFile, error) {
 	result := ExpandedFile{
 		OriginalFilename: string(*f),
 		Filename:         f.NonTemplateName(),
 		IsScript:         f.IsScript(),
 		IsTemplate:       f.IsTemplate(),
+		Content:          content,
 	}
-
-	result.Content, err = f.Load()
 	if err != nil {
 		return result, err
 	}
@@ -1,10 +1,26 @@
 package cicci
 
 import (
+	"io/fs"
 	"os"
 	"path/filepath"
 )
 
+// IgnoredFiles are base name patterns CollectFiles and CollectFilesFS skip:
+// the metadata of extracted archives and the files piccu keeps next to its
+// inputs and outputs
+var IgnoredFiles = []string{ArchiveMetadataFile, "piccu.yaml", "piccu.lock", "*.manifest.json", "*.buildkey"}
+
+// ignored checks a base name against IgnoredFiles
+func ignored(name string) bool {
+	for _, pattern := range IgnoredFiles {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
 type CCFiles []CCFile
 
 func (files CCFiles) LoadAndExpand(extraKeys map[string]string) (result ExpandedFiles, err error) {
@@ -18,6 +34,42 @@ func (files CCFiles) LoadAndExpand(extraKeys map[string]string) (result Expanded
 	return
 }
 
+// LoadAndExpandFS is LoadAndExpand for files collected with CollectFilesFS
+func (files CCFiles) LoadAndExpandFS(fsys fs.FS, extraKeys map[string]string) (result ExpandedFiles, err error) {
+	result = make(ExpandedFiles, len(files))
+	for i, file := range files {
+		result[i], err = file.LoadAndExpandFS(fsys, extraKeys)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Without returns all files that are not part of other, e.g. to keep vendor
+// files out of user-data when both are collected from the same tree
+func (files CCFiles) Without(other CCFiles) CCFiles {
+	exclude := make(map[string]bool, len(other))
+	for _, file := range other {
+		exclude[absPath(string(file))] = true
+	}
+	result := make(CCFiles, 0, len(files))
+	for _, file := range files {
+		if !exclude[absPath(string(file))] {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
 func CollectFiles(inputs []string) (CCFiles, error) {
 	output := make([]CCFile, 0, len(inputs))
 	for _, input := range inputs {
@@ -65,9 +117,25 @@ func CollectFiles(inputs []string) (CCFiles, error) {
 			continue
 		}
 
-		if filenamePattern.MatchString(input) {
+		if filenamePattern.MatchString(input) && !ignored(filepath.Base(input)) {
 			output = append(output, CCFile(input))
 		}
 	}
 	return output, nil
 }
+
+// CollectFilesFS collects all files of fsys in lexical order, like
+// CollectFiles does for a directory
+func CollectFilesFS(fsys fs.FS) (CCFiles, error) {
+	output := make([]CCFile, 0)
+	err := fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && filenamePattern.MatchString(name) && !ignored(entry.Name()) {
+			output = append(output, CCFile(name))
+		}
+		return nil
+	})
+	return output, err
+}
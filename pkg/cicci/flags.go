@@ -0,0 +1,23 @@
+package cicci
+
+import (
+	"flag"
+
+	"github.com/rtreffer/piccu/pkg/flags"
+)
+
+// Flags are the archive flags shared by cicci and piccu
+type Flags struct {
+	// Vendor are the inputs merged into vendor-data instead of user-data
+	Vendor flags.StringArray
+	// Reproducible derives the multipart boundary from the content
+	Reproducible bool
+}
+
+// RegisterFlags adds --vendor and --reproducible to flagSet
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	f := &Flags{Vendor: make(flags.StringArray, 0)}
+	flagSet.Var(&f.Vendor, "vendor", "file, directory or glob to merge into vendor-data instead of user-data")
+	flagSet.BoolVar(&f.Reproducible, "reproducible", false, "derive the multipart boundary from the content instead of picking a random one")
+	return f
+}
@@ -0,0 +1,81 @@
+package cicci
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MetaData is the NoCloud meta-data, cloud-init re-runs when instance-id changes
+type MetaData map[string]interface{}
+
+// Hostname returns the hostname (or fqdn) of the merged cloud-config,
+// later files win like they do when cloud-init merges the archive
+func Hostname(files ExpandedFiles) string {
+	hostname := ""
+	for _, file := range files {
+		if file.IsScript {
+			continue
+		}
+		var config struct {
+			Hostname string `yaml:"hostname"`
+			FQDN     string `yaml:"fqdn"`
+		}
+		if err := yaml.Unmarshal([]byte(file.Content), &config); err != nil {
+			continue
+		}
+		if config.Hostname != "" {
+			hostname = config.Hostname
+		} else if config.FQDN != "" {
+			hostname = config.FQDN
+		}
+	}
+	return hostname
+}
+
+// NewMetaData generates meta-data with local-hostname and an instance-id
+// derived from the rendered user-data parts, the network-config and all
+// other meta-data keys. Extra keys override the generated ones.
+func NewMetaData(files ExpandedFiles, networkConfig, hostname string, extra map[string]interface{}) (MetaData, error) {
+	meta := make(MetaData)
+	if hostname != "" {
+		meta["local-hostname"] = hostname
+	}
+	for k, v := range extra {
+		meta[k] = v
+	}
+	if _, found := meta["instance-id"]; found {
+		return meta, nil
+	}
+
+	hash := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(hash, "%s\x00%d\x00%s\x00", file.Filename, len(file.Content), file.Content)
+	}
+	fmt.Fprintf(hash, "network-config\x00%d\x00%s\x00", len(networkConfig), networkConfig)
+	// yaml.v3 sorts map keys, the serialization is stable
+	rest, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(rest)
+
+	meta["instance-id"] = "iid-" + hex.EncodeToString(hash.Sum(nil))[:16]
+	return meta, nil
+}
+
+// ParseMetaData parses an (expanded) meta-data file
+func ParseMetaData(payload string) (map[string]interface{}, error) {
+	meta := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(payload), &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (m MetaData) Render() (string, error) {
+	out, err := yaml.Marshal(map[string]interface{}(m))
+	return string(out), err
+}
@@ -1,15 +1,35 @@
 package cicci
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"mime"
 	"mime/multipart"
+	"net/mail"
 	"net/textproto"
 	"strings"
 )
 
+// defaultMergeType appends lists and merges dicts instead of replacing them
+const defaultMergeType = "list(append)+dict(recurse_array)+str()"
+
 func CreateMultipartArchive(files []ExpandedFile) (string, error) {
+	return CreateMultipartArchiveWithBoundary(files, "")
+}
+
+// CreateMultipartArchiveWithBoundary uses the given MIME boundary instead of
+// a random one, an empty boundary picks a random one
+func CreateMultipartArchiveWithBoundary(files []ExpandedFile, boundary string) (string, error) {
 	buffer := &strings.Builder{}
 	multipartWriter := multipart.NewWriter(buffer)
+	if boundary != "" {
+		if err := multipartWriter.SetBoundary(boundary); err != nil {
+			return "", err
+		}
+	}
 	fileHeader := fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%v\"\nMIME-Version: 1.0\n\n", multipartWriter.Boundary())
 	if _, err := buffer.Write([]byte(fileHeader)); err != nil {
 		return "", err
@@ -19,10 +39,17 @@ func CreateMultipartArchive(files []ExpandedFile) (string, error) {
 		if file.IsScript {
 			filetype = "text/x-shellscript"
 		}
+		if file.ContentType != "" {
+			filetype = file.ContentType
+		}
+		mergeType := defaultMergeType
+		if file.MergeType != "" {
+			mergeType = file.MergeType
+		}
 		headers := make(textproto.MIMEHeader)
 		// TODO: should Content-Transfer-Ecoding be 8bit or binary? shoud Content-Type be ...; charset=UTF-8 ?
 		headers.Add("MIME-Version", "1.0")
-		headers.Add("Merge-Type", "list(append)+dict(recurse_array)+str()")
+		headers.Add("Merge-Type", mergeType)
 		headers.Add("Content-Type", filetype+"; charset=\"utf-8\"")
 		headers.Add("Content-Diposition", "attachment; filename=\""+file.Filename+"\"")
 		headers.Add("Content-Transfer-Encoding", "7bit")
@@ -39,3 +66,113 @@ func CreateMultipartArchive(files []ExpandedFile) (string, error) {
 	err := multipartWriter.Close()
 	return buffer.String(), err
 }
+
+// ContentBoundary derives a MIME boundary from the files, identical files
+// give identical archives
+func ContentBoundary(files []ExpandedFile) string {
+	hash := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(hash, "%q %q %q %t %d\n", file.Filename, file.ContentType, file.MergeType, file.IsScript, len(file.Content))
+		io.WriteString(hash, file.Content)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ArchivePart is a part of a multipart cloud-config archive
+type ArchivePart struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	MergeType   string `json:"merge_type,omitempty"`
+	Content     string `json:"content"`
+}
+
+// userDataTypes maps the first line of single part user-data to the
+// content type cloud-init assumes
+var userDataTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#!", "text/x-shellscript"},
+	{"#include", "text/x-include-url"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"## template: jinja", "text/jinja2"},
+	{"#part-handler", "text/part-handler"},
+}
+
+// ParseMultipartArchive splits user-data into its parts, user-data that
+// isn't a multipart archive is returned as a single part
+func ParseMultipartArchive(archive string) ([]ArchivePart, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(archive))
+	if err != nil || !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/") {
+		contentType := "text/plain"
+		for _, t := range userDataTypes {
+			if strings.HasPrefix(archive, t.prefix) {
+				contentType = t.contentType
+				break
+			}
+		}
+		return []ArchivePart{{ContentType: contentType, Content: archive}}, nil
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive Content-Type: %s", err)
+	}
+	if params["boundary"] == "" {
+		return nil, fmt.Errorf("archive has no multipart boundary")
+	}
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []ArchivePart
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read part %d: %s", len(parts)+1, err)
+		}
+		var body io.Reader = part
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+		content, err := io.ReadAll(body)
+		if err != nil {
+			return nil, fmt.Errorf("can't read part %d: %s", len(parts)+1, err)
+		}
+		contentType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			contentType = part.Header.Get("Content-Type")
+		}
+		parts = append(parts, ArchivePart{
+			Filename:    partFilename(part.Header),
+			ContentType: contentType,
+			MergeType:   part.Header.Get("Merge-Type"),
+			Content:     string(content),
+		})
+	}
+}
+
+// ArchiveBoundary returns the MIME boundary of a multipart archive or an
+// empty string for single part user-data
+func ArchiveBoundary(archive string) string {
+	msg, err := mail.ReadMessage(strings.NewReader(archive))
+	if err != nil {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// partFilename reads the filename of a part, CreateMultipartArchive writes
+// it to a misspelled Content-Diposition header
+func partFilename(header textproto.MIMEHeader) string {
+	for _, key := range []string{"Content-Disposition", "Content-Diposition"} {
+		if _, params, err := mime.ParseMediaType(header.Get(key)); err == nil && params["filename"] != "" {
+			return params["filename"]
+		}
+	}
+	return ""
+}
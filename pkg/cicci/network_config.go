@@ -0,0 +1,42 @@
+package cicci
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed network-config-v1.schema.json
+var networkConfigV1Schema string
+var compiledNetworkConfigV1Schema = jsonschema.MustCompileString("network-config-v1.schema.json", networkConfigV1Schema)
+
+//go:embed network-config-v2.schema.json
+var networkConfigV2Schema string
+var compiledNetworkConfigV2Schema = jsonschema.MustCompileString("network-config-v2.schema.json", networkConfigV2Schema)
+
+// ValidateNetworkConfig validates a NoCloud network-config against the
+// network-config v1 or netplan v2 schema, depending on its version
+func ValidateNetworkConfig(payload string) error {
+	var value interface{}
+	err := yaml.Unmarshal([]byte(payload), &value)
+	if err != nil {
+		return err
+	}
+	config, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("network-config must be a mapping")
+	}
+	// cloud-init accepts the config with and without a top level network key
+	if network, ok := config["network"].(map[string]interface{}); ok && len(config) == 1 {
+		config = network
+	}
+	switch config["version"] {
+	case 1:
+		return compiledNetworkConfigV1Schema.Validate(config)
+	case 2:
+		return compiledNetworkConfigV2Schema.Validate(config)
+	}
+	return fmt.Errorf("unsupported network-config version %v", config["version"])
+}
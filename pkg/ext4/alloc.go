@@ -0,0 +1,285 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrNoSpace is returned when no free blocks or inodes are left
+var ErrNoSpace = errors.New("no space left on file system")
+
+func bitSet(bitmap []byte, i uint32) bool {
+	return bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+func setBit(bitmap []byte, i uint32) {
+	bitmap[i/8] |= 1 << (i % 8)
+}
+
+func clearBit(bitmap []byte, i uint32) {
+	bitmap[i/8] &^= 1 << (i % 8)
+}
+
+// blockBitmap loads the block bitmap of a group, uninitialized bitmaps are
+// computed from the metadata layout like the kernel does
+func (f *FileSystem) blockBitmap(group uint32) ([]byte, error) {
+	if bitmap, ok := f.blockBitmaps[group]; ok {
+		return bitmap, nil
+	}
+	gd := &f.groups[group]
+	var bitmap []byte
+	if gd.Flags&bgBlockUninit != 0 && f.hasGroupChecksum() {
+		bitmap = f.initBlockBitmap(group)
+		gd.Flags &^= bgBlockUninit
+		f.dirty[group] = true
+	} else {
+		var err error
+		if bitmap, err = f.readBlock(gd.BlockBitmap); err != nil {
+			return nil, err
+		}
+	}
+	f.blockBitmaps[group] = bitmap
+	return bitmap, nil
+}
+
+func (f *FileSystem) initBlockBitmap(group uint32) []byte {
+	bitmap := make([]byte, f.blockSize)
+	start := f.groupStart(group)
+	blocks := f.groupBlocks(group)
+	mark := func(block uint64, count uint64) {
+		for b := block; b < block+count; b++ {
+			if b >= start && b < start+uint64(blocks) {
+				setBit(bitmap, uint32(b-start))
+			}
+		}
+	}
+	if f.sb.hasSuper(group) {
+		mark(start, 1+f.gdtBlocks()+uint64(f.sb.ReservedGdtBlocks))
+	}
+	tableBlocks := (uint64(f.sb.InodesPerGroup)*uint64(f.sb.InodeSize) + uint64(f.blockSize) - 1) / uint64(f.blockSize)
+	// with flex_bg the metadata of other groups can live in this group
+	for i := range f.groups {
+		mark(f.groups[i].BlockBitmap, 1)
+		mark(f.groups[i].InodeBitmap, 1)
+		mark(f.groups[i].InodeTable, tableBlocks)
+	}
+	for i := blocks; i < uint32(f.blockSize)*8; i++ {
+		setBit(bitmap, i)
+	}
+	return bitmap
+}
+
+func (f *FileSystem) inodeBitmap(group uint32) ([]byte, error) {
+	if bitmap, ok := f.inodeBitmaps[group]; ok {
+		return bitmap, nil
+	}
+	gd := &f.groups[group]
+	var bitmap []byte
+	if gd.Flags&bgInodeUninit != 0 && f.hasGroupChecksum() {
+		bitmap = make([]byte, f.blockSize)
+		for i := f.sb.InodesPerGroup; i < uint32(f.blockSize)*8; i++ {
+			setBit(bitmap, i)
+		}
+		gd.Flags &^= bgInodeUninit
+		f.dirty[group] = true
+	} else {
+		var err error
+		if bitmap, err = f.readBlock(gd.InodeBitmap); err != nil {
+			return nil, err
+		}
+	}
+	f.inodeBitmaps[group] = bitmap
+	return bitmap, nil
+}
+
+// allocBlocks allocates count blocks starting the search at the group of
+// goal, the result has as few extents as the free space allows
+func (f *FileSystem) allocBlocks(goal uint64, count uint64) ([]extent, error) {
+	if count > f.sb.FreeBlocksCount {
+		return nil, ErrNoSpace
+	}
+	var result []extent
+	groups := f.sb.GroupCount()
+	first := uint32(0)
+	if goal > uint64(f.sb.FirstDataBlock) {
+		first = uint32((goal - uint64(f.sb.FirstDataBlock)) / uint64(f.sb.BlocksPerGroup))
+	}
+	for n := uint32(0); n < groups && count > 0; n++ {
+		group := (first + n) % groups
+		if f.groups[group].FreeBlocksCount == 0 {
+			continue
+		}
+		bitmap, err := f.blockBitmap(group)
+		if err != nil {
+			return nil, err
+		}
+		start := f.groupStart(group)
+		blocks := f.groupBlocks(group)
+		for i := uint32(0); i < blocks && count > 0; i++ {
+			if bitSet(bitmap, i) {
+				continue
+			}
+			run := extent{Start: start + uint64(i)}
+			for i < blocks && !bitSet(bitmap, i) && count > 0 && run.Length < maxInitExtentLen {
+				setBit(bitmap, i)
+				run.Length++
+				count--
+				i++
+			}
+			i--
+			f.groups[group].FreeBlocksCount -= run.Length
+			f.sb.FreeBlocksCount -= uint64(run.Length)
+			f.dirty[group] = true
+			result = append(result, run)
+		}
+	}
+	if count > 0 {
+		// the group counts didn't match the bitmaps
+		f.freeExtents(result)
+		return nil, ErrNoSpace
+	}
+	return result, nil
+}
+
+func (f *FileSystem) freeBlocks(block uint64, count uint64) error {
+	for b := block; b < block+count; b++ {
+		if b < uint64(f.sb.FirstDataBlock) || b >= f.sb.BlocksCount {
+			return fmt.Errorf("can't free block %d: out of range", b)
+		}
+		group := uint32((b - uint64(f.sb.FirstDataBlock)) / uint64(f.sb.BlocksPerGroup))
+		bitmap, err := f.blockBitmap(group)
+		if err != nil {
+			return err
+		}
+		i := uint32(b - f.groupStart(group))
+		if !bitSet(bitmap, i) {
+			continue
+		}
+		clearBit(bitmap, i)
+		f.groups[group].FreeBlocksCount++
+		f.sb.FreeBlocksCount++
+		f.dirty[group] = true
+	}
+	return nil
+}
+
+func (f *FileSystem) freeExtents(extents []extent) error {
+	for _, e := range extents {
+		if e.Start == 0 {
+			continue
+		}
+		if err := f.freeBlocks(e.Start, uint64(e.Length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allocInode allocates an inode, preferring the given group
+func (f *FileSystem) allocInode(first uint32, dir bool) (uint32, error) {
+	groups := f.sb.GroupCount()
+	for n := uint32(0); n < groups; n++ {
+		group := (first + n) % groups
+		gd := &f.groups[group]
+		if gd.FreeInodesCount == 0 {
+			continue
+		}
+		bitmap, err := f.inodeBitmap(group)
+		if err != nil {
+			return 0, err
+		}
+		for i := uint32(0); i < f.sb.InodesPerGroup; i++ {
+			number := group*f.sb.InodesPerGroup + i + 1
+			if number < f.sb.FirstInode || bitSet(bitmap, i) {
+				continue
+			}
+			setBit(bitmap, i)
+			gd.FreeInodesCount--
+			if dir {
+				gd.UsedDirsCount++
+			}
+			// inodes past itable_unused were never used and may be garbage
+			if f.hasGroupChecksum() && i >= f.sb.InodesPerGroup-gd.ItableUnused {
+				gd.ItableUnused = f.sb.InodesPerGroup - i - 1
+			}
+			f.sb.FreeInodesCount--
+			f.dirty[group] = true
+			return number, nil
+		}
+	}
+	return 0, ErrNoSpace
+}
+
+func (f *FileSystem) freeInode(number uint32, dir bool) error {
+	group := (number - 1) / f.sb.InodesPerGroup
+	bitmap, err := f.inodeBitmap(group)
+	if err != nil {
+		return err
+	}
+	i := (number - 1) % f.sb.InodesPerGroup
+	if !bitSet(bitmap, i) {
+		return nil
+	}
+	clearBit(bitmap, i)
+	gd := &f.groups[group]
+	gd.FreeInodesCount++
+	if dir && gd.UsedDirsCount > 0 {
+		gd.UsedDirsCount--
+	}
+	f.sb.FreeInodesCount++
+	f.dirty[group] = true
+	return nil
+}
+
+// inodeGroup returns the group of an inode, new files are placed there
+func (f *FileSystem) inodeGroup(number uint32) uint32 {
+	return (number - 1) / f.sb.InodesPerGroup
+}
+
+// flush writes the modified bitmaps, group descriptors and the superblock
+func (f *FileSystem) flush() error {
+	le := binary.LittleEndian
+	size := int64(f.sb.DescSize)
+	gdtOffset := int64(f.gdtBlock()) * f.blockSize
+	for group := range f.dirty {
+		gd := &f.groups[group]
+		b := f.gdt[int64(group)*size : int64(group+1)*size]
+		gd.marshal(b, f.is64())
+		if bitmap, ok := f.blockBitmaps[group]; ok {
+			if _, err := f.rw.WriteAt(bitmap, int64(gd.BlockBitmap)*f.blockSize); err != nil {
+				return fmt.Errorf("can't write block bitmap of group %d: %s", group, err)
+			}
+			if f.sb.hasMetadataCsum() {
+				csum := crc32c(f.sb.ChecksumSeed, bitmap[:f.sb.BlocksPerGroup/8])
+				le.PutUint16(b[0x18:], uint16(csum))
+				if size >= 0x3C {
+					le.PutUint16(b[0x38:], uint16(csum>>16))
+				}
+			}
+		}
+		if bitmap, ok := f.inodeBitmaps[group]; ok {
+			if _, err := f.rw.WriteAt(bitmap, int64(gd.InodeBitmap)*f.blockSize); err != nil {
+				return fmt.Errorf("can't write inode bitmap of group %d: %s", group, err)
+			}
+			if f.sb.hasMetadataCsum() {
+				csum := crc32c(f.sb.ChecksumSeed, bitmap[:f.sb.InodesPerGroup/8])
+				le.PutUint16(b[0x1A:], uint16(csum))
+				if size >= 0x3C {
+					le.PutUint16(b[0x3A:], uint16(csum>>16))
+				}
+			}
+		}
+		if f.hasGroupChecksum() {
+			le.PutUint16(b[0x1E:], f.groupChecksum(group, b))
+		}
+		if _, err := f.rw.WriteAt(b, gdtOffset+int64(group)*size); err != nil {
+			return fmt.Errorf("can't write group descriptor %d: %s", group, err)
+		}
+	}
+	f.dirty = make(map[uint32]bool)
+	if _, err := f.rw.WriteAt(f.sb.marshal(), superblockOffset); err != nil {
+		return fmt.Errorf("can't write superblock: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package ext4
+
+import "hash/crc32"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32c continues a raw crc32c without the final inversion, the way the
+// kernel computes ext4 metadata checksums
+func crc32c(crc uint32, data []byte) uint32 {
+	return ^crc32.Update(^crc, castagnoli, data)
+}
+
+// crc16 is the ANSI crc16 used for group descriptors without metadata_csum
+func crc16(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,113 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+)
+
+const (
+	fileTypeUnknown = 0
+	fileTypeRegular = 1
+	fileTypeDir     = 2
+	fileTypeChar    = 3
+	fileTypeBlock   = 4
+	fileTypeFifo    = 5
+	fileTypeSocket  = 6
+	fileTypeSymlink = 7
+)
+
+// direntHeaderSize is the size of ext4_dir_entry_2 without the name
+const direntHeaderSize = 8
+
+type dirent struct {
+	Inode uint32
+	Type  uint8
+	Name  string
+}
+
+// parseDirents reads linear directory entries, hashed (htree) directories
+// keep their index in entries with inode 0 so they can be read the same way
+func parseDirents(data []byte, blockSize int) ([]dirent, error) {
+	le := binary.LittleEndian
+	var result []dirent
+	for block := 0; block < len(data); block += blockSize {
+		end := block + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		for pos := block; pos+direntHeaderSize <= end; {
+			inode := le.Uint32(data[pos:])
+			recLen := int(le.Uint16(data[pos+4:]))
+			nameLen := int(data[pos+6])
+			if recLen < direntHeaderSize || pos+recLen > end {
+				return nil, fmt.Errorf("invalid directory entry at %d", pos)
+			}
+			if inode != 0 && direntHeaderSize+nameLen <= recLen {
+				name := string(data[pos+direntHeaderSize : pos+direntHeaderSize+nameLen])
+				if name != "." && name != ".." {
+					result = append(result, dirent{
+						Inode: inode,
+						Type:  data[pos+7],
+						Name:  name,
+					})
+				}
+			}
+			pos += recLen
+		}
+	}
+	return result, nil
+}
+
+func (f *FileSystem) readDirents(inode *Inode) ([]dirent, error) {
+	if !inode.IsDir() {
+		return nil, errNotDir
+	}
+	if inode.Flags&inodeFlagInlineData != 0 {
+		// inline directories start with the parent inode number
+		size := int(inode.Size)
+		if size > len(inode.block) {
+			size = len(inode.block)
+		}
+		if size <= 4 {
+			return nil, nil
+		}
+		return parseDirents(inode.block[4:size], size-4)
+	}
+	data, err := f.readAll(inode)
+	if err != nil {
+		return nil, err
+	}
+	return parseDirents(data, int(f.blockSize))
+}
+
+func (f *FileSystem) lookup(dir *Inode, name string) (*Inode, error) {
+	entries, err := f.readDirents(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name == name {
+			return f.readInode(e.Inode)
+		}
+	}
+	return nil, fs.ErrNotExist
+}
+
+func fileTypeMode(t uint8) fs.FileMode {
+	switch t {
+	case fileTypeDir:
+		return fs.ModeDir
+	case fileTypeSymlink:
+		return fs.ModeSymlink
+	case fileTypeChar:
+		return fs.ModeDevice | fs.ModeCharDevice
+	case fileTypeBlock:
+		return fs.ModeDevice
+	case fileTypeFifo:
+		return fs.ModeNamedPipe
+	case fileTypeSocket:
+		return fs.ModeSocket
+	}
+	return 0
+}
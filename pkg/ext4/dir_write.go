@@ -0,0 +1,543 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// dirTailSize is the size of the checksum entry at the end of directory
+// blocks with metadata_csum
+const dirTailSize = 12
+
+const dirTailFileType = 0xDE
+
+func direntSize(nameLen int) int {
+	return (direntHeaderSize + nameLen + 3) &^ 3
+}
+
+func (f *FileSystem) dirTail() int {
+	if f.sb.hasMetadataCsum() {
+		return dirTailSize
+	}
+	return 0
+}
+
+func (f *FileSystem) fileType(mode uint16) uint8 {
+	if f.sb.FeatureIncompat&incompatFiletype == 0 {
+		return fileTypeUnknown
+	}
+	switch mode & modeTypeMask {
+	case modeDir:
+		return fileTypeDir
+	case modeSymlink:
+		return fileTypeSymlink
+	case modeFile:
+		return fileTypeRegular
+	}
+	return fileTypeUnknown
+}
+
+func putDirent(b []byte, inode uint32, recLen int, name string, fileType uint8) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], inode)
+	le.PutUint16(b[4:], uint16(recLen))
+	b[6] = uint8(len(name))
+	b[7] = fileType
+	n := copy(b[direntHeaderSize:recLen], name)
+	for i := direntHeaderSize + n; i < direntSize(len(name)) && i < recLen; i++ {
+		b[i] = 0
+	}
+}
+
+// newDirBlock returns an empty directory block with the checksum tail
+func (f *FileSystem) newDirBlock() []byte {
+	b := make([]byte, f.blockSize)
+	usable := int(f.blockSize) - f.dirTail()
+	binary.LittleEndian.PutUint16(b[4:], uint16(usable))
+	if f.dirTail() > 0 {
+		binary.LittleEndian.PutUint16(b[usable+4:], dirTailSize)
+		b[usable+7] = dirTailFileType
+	}
+	return b
+}
+
+// writeDirBlock sets the checksum of a directory leaf block and writes it
+func (f *FileSystem) writeDirBlock(dir *Inode, block uint64, b []byte) error {
+	if f.dirTail() > 0 {
+		usable := len(b) - dirTailSize
+		binary.LittleEndian.PutUint32(b[usable+8:], crc32c(f.inodeSeed(dir), b[:usable]))
+	}
+	return f.writeBlock(block, b)
+}
+
+// insertDirent adds an entry to a directory block if it has room
+func insertDirent(b []byte, usable int, name string, inode uint32, fileType uint8) (bool, error) {
+	le := binary.LittleEndian
+	need := direntSize(len(name))
+	for pos := 0; pos+direntHeaderSize <= usable; {
+		current := le.Uint32(b[pos:])
+		recLen := int(le.Uint16(b[pos+4:]))
+		if recLen < direntHeaderSize || pos+recLen > usable {
+			return false, fmt.Errorf("invalid directory entry at %d", pos)
+		}
+		used := 0
+		if current != 0 {
+			used = direntSize(int(b[pos+6]))
+		}
+		if recLen-used >= need {
+			if used > 0 {
+				le.PutUint16(b[pos+4:], uint16(used))
+				pos += used
+				recLen -= used
+			}
+			putDirent(b[pos:], inode, recLen, name, fileType)
+			return true, nil
+		}
+		pos += recLen
+	}
+	return false, nil
+}
+
+// removeDirent removes an entry from a directory block, the space is merged
+// into the previous entry
+func removeDirent(b []byte, name string) bool {
+	le := binary.LittleEndian
+	prev := -1
+	for pos := 0; pos+direntHeaderSize <= len(b); {
+		recLen := int(le.Uint16(b[pos+4:]))
+		if recLen < direntHeaderSize || pos+recLen > len(b) {
+			return false
+		}
+		nameLen := int(b[pos+6])
+		if le.Uint32(b[pos:]) != 0 && direntHeaderSize+nameLen <= recLen &&
+			string(b[pos+direntHeaderSize:pos+direntHeaderSize+nameLen]) == name {
+			if prev < 0 {
+				le.PutUint32(b[pos:], 0)
+			} else {
+				le.PutUint16(b[prev+4:], uint16(int(le.Uint16(b[prev+4:]))+recLen))
+			}
+			return true
+		}
+		prev = pos
+		pos += recLen
+	}
+	return false
+}
+
+// physicalBlock maps a logical block of a file
+func physicalBlock(extents []extent, logical uint32) (uint64, error) {
+	for _, e := range extents {
+		if logical >= e.Logical && logical < e.Logical+e.Length && e.Start != 0 && !e.Unwritten {
+			return e.Start + uint64(logical-e.Logical), nil
+		}
+	}
+	return 0, fmt.Errorf("logical block %d is not mapped", logical)
+}
+
+// appendDirBlock grows a directory by one block and returns its logical and
+// physical block number
+func (f *FileSystem) appendDirBlock(dir *Inode, extents []extent) (uint32, uint64, []extent, error) {
+	if dir.Flags&inodeFlagExtents == 0 {
+		return 0, 0, nil, fmt.Errorf("can't grow directory %d without extents", dir.Number)
+	}
+	goal := f.groupStart(f.inodeGroup(dir.Number))
+	if n := len(extents); n > 0 {
+		goal = extents[n-1].Start + uint64(extents[n-1].Length)
+	}
+	runs, err := f.allocBlocks(goal, 1)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	logical := uint32(dir.Size / uint64(f.blockSize))
+	extents = appendExtents(extents, logical, runs)
+	if err := f.setExtents(dir, extents); err != nil {
+		f.freeExtents(runs)
+		return 0, 0, nil, err
+	}
+	dir.Size += uint64(f.blockSize)
+	dir.Blocks += uint64(f.blockSize / 512)
+	return logical, runs[0].Start, extents, nil
+}
+
+// addDirent links an inode into a directory, the directory inode is written
+func (f *FileSystem) addDirent(dir *Inode, name string, inode uint32, fileType uint8) error {
+	if len(name) > 255 {
+		return fmt.Errorf("name too long")
+	}
+	if dir.Flags&inodeFlagInlineData != 0 {
+		return fmt.Errorf("can't write inline directory %d", dir.Number)
+	}
+	extents, err := f.extents(dir)
+	if err != nil {
+		return err
+	}
+	if dir.Flags&inodeFlagIndex != 0 {
+		return f.addIndexed(dir, extents, name, inode, fileType)
+	}
+	usable := int(f.blockSize) - f.dirTail()
+	blocks := uint32(dir.Size / uint64(f.blockSize))
+	for logical := uint32(0); logical < blocks; logical++ {
+		block, err := physicalBlock(extents, logical)
+		if err != nil {
+			return err
+		}
+		data, err := f.readBlock(block)
+		if err != nil {
+			return err
+		}
+		ok, err := insertDirent(data, usable, name, inode, fileType)
+		if err != nil {
+			return fmt.Errorf("directory %d: %s", dir.Number, err)
+		}
+		if ok {
+			return f.writeDirBlock(dir, block, data)
+		}
+	}
+	_, block, _, err := f.appendDirBlock(dir, extents)
+	if err != nil {
+		return err
+	}
+	data := f.newDirBlock()
+	if _, err := insertDirent(data, usable, name, inode, fileType); err != nil {
+		return err
+	}
+	if err := f.writeDirBlock(dir, block, data); err != nil {
+		return err
+	}
+	return f.writeInode(dir)
+}
+
+// removeEntry unlinks a name from a directory
+func (f *FileSystem) removeEntry(dir *Inode, name string) error {
+	extents, err := f.extents(dir)
+	if err != nil {
+		return err
+	}
+	blocks := uint32(dir.Size / uint64(f.blockSize))
+	for logical := uint32(0); logical < blocks; logical++ {
+		block, err := physicalBlock(extents, logical)
+		if err != nil {
+			continue
+		}
+		data, err := f.readBlock(block)
+		if err != nil {
+			return err
+		}
+		if removeDirent(data, name) {
+			return f.writeDirBlock(dir, block, data)
+		}
+	}
+	return fs.ErrNotExist
+}
+
+// dxFrame is one level of the htree index on the path to a leaf
+type dxFrame struct {
+	block uint64
+	data  []byte
+	// offset of the count/limit header
+	offset int
+	// index of the entry that was followed
+	index int
+}
+
+func (fr *dxFrame) count() int {
+	return int(binary.LittleEndian.Uint16(fr.data[fr.offset+2:]))
+}
+
+func (fr *dxFrame) limit() int {
+	return int(binary.LittleEndian.Uint16(fr.data[fr.offset:]))
+}
+
+func (fr *dxFrame) entry(i int) (hash uint32, logical uint32) {
+	e := fr.data[fr.offset+i*8:]
+	if i > 0 {
+		hash = binary.LittleEndian.Uint32(e)
+	}
+	return hash, binary.LittleEndian.Uint32(e[4:])
+}
+
+// writeDxBlock sets the dx_tail checksum of an index block and writes it
+func (f *FileSystem) writeDxBlock(dir *Inode, fr *dxFrame) error {
+	if f.sb.hasMetadataCsum() {
+		tail := fr.offset + fr.limit()*8
+		if tail+8 > len(fr.data) {
+			return fmt.Errorf("directory %d: no room for the index checksum", dir.Number)
+		}
+		crc := crc32c(f.inodeSeed(dir), fr.data[:fr.offset+fr.count()*8])
+		crc = crc32c(crc, fr.data[tail:tail+4])
+		crc = crc32c(crc, []byte{0, 0, 0, 0})
+		binary.LittleEndian.PutUint32(fr.data[tail+4:], crc)
+	}
+	return f.writeBlock(fr.block, fr.data)
+}
+
+// dxPath is the htree path to a leaf while index nodes are split
+type dxPath struct {
+	frames  []*dxFrame
+	extents []extent
+	// index blocks to write
+	dirty []*dxFrame
+}
+
+func (p *dxPath) changed(fr *dxFrame) {
+	for _, d := range p.dirty {
+		if d == fr {
+			return
+		}
+	}
+	p.dirty = append(p.dirty, fr)
+}
+
+func (p *dxPath) level(fr *dxFrame) int {
+	for i, f := range p.frames {
+		if f == fr {
+			return i
+		}
+	}
+	return -1
+}
+
+// newDxNode allocates an empty interior index block, its fake dirent covers
+// the whole block so that it reads as an empty directory block
+func (f *FileSystem) newDxNode(dir *Inode, p *dxPath) (*dxFrame, uint32, error) {
+	logical, block, extents, err := f.appendDirBlock(dir, p.extents)
+	if err != nil {
+		return nil, 0, err
+	}
+	p.extents = extents
+	data := make([]byte, f.blockSize)
+	binary.LittleEndian.PutUint16(data[4:], uint16(f.blockSize))
+	limit := (int(f.blockSize) - 8) / 8
+	if f.sb.hasMetadataCsum() {
+		limit--
+	}
+	binary.LittleEndian.PutUint16(data[8:], uint16(limit))
+	node := &dxFrame{block: block, data: data, offset: 8}
+	p.changed(node)
+	return node, logical, nil
+}
+
+// moveDxEntries moves the entries from of fr to the end of node
+func moveDxEntries(fr, node *dxFrame, from int) {
+	le := binary.LittleEndian
+	count, limit := fr.count(), node.limit()
+	copy(node.data[node.offset:], fr.data[fr.offset+from*8:fr.offset+count*8])
+	le.PutUint16(node.data[node.offset:], uint16(limit))
+	le.PutUint16(node.data[node.offset+2:], uint16(count-from))
+	le.PutUint16(fr.data[fr.offset+2:], uint16(from))
+}
+
+// dxRoom makes room for one more entry in fr: a full node is split in two,
+// which needs room in its parent, and a full root moves its entries into a
+// new node below it, adding a level up to the ext4 limit
+func (f *FileSystem) dxRoom(dir *Inode, p *dxPath, fr *dxFrame) error {
+	le := binary.LittleEndian
+	if fr.count() < fr.limit() {
+		return nil
+	}
+	level := p.level(fr)
+	if level == 0 {
+		maxLevels := 1
+		if f.sb.FeatureIncompat&incompatLargeDir != 0 {
+			maxLevels = 2
+		}
+		if int(fr.data[30]) >= maxLevels {
+			return fmt.Errorf("directory %d: htree index is full at %d levels", dir.Number, maxLevels+1)
+		}
+		node, logical, err := f.newDxNode(dir, p)
+		if err != nil {
+			return err
+		}
+		moveDxEntries(fr, node, 0)
+		node.index = fr.index
+		le.PutUint16(fr.data[fr.offset+2:], 1)
+		le.PutUint32(fr.data[fr.offset+4:], logical)
+		fr.data[30]++
+		fr.index = 0
+		p.frames = append([]*dxFrame{fr, node}, p.frames[1:]...)
+		p.changed(fr)
+		return nil
+	}
+
+	if err := f.dxRoom(dir, p, p.frames[level-1]); err != nil {
+		return err
+	}
+	level = p.level(fr)
+	parent := p.frames[level-1]
+	node, logical, err := f.newDxNode(dir, p)
+	if err != nil {
+		return err
+	}
+	split := fr.count() / 2
+	hash, _ := fr.entry(split)
+	moveDxEntries(fr, node, split)
+
+	at := parent.offset + (parent.index+1)*8
+	end := parent.offset + parent.count()*8
+	copy(parent.data[at+8:end+8], parent.data[at:end])
+	le.PutUint32(parent.data[at:], hash)
+	le.PutUint32(parent.data[at+4:], logical)
+	le.PutUint16(parent.data[parent.offset+2:], uint16(parent.count()+1))
+	if fr.index >= split {
+		node.index = fr.index - split
+		parent.index++
+		p.frames[level] = node
+	}
+	p.changed(fr)
+	p.changed(parent)
+	return nil
+}
+
+type hashedDirent struct {
+	dirent
+	hash uint32
+}
+
+// addIndexed inserts into a hashed (htree) directory, a full leaf is split
+// in two and full index nodes above it are split in turn
+func (f *FileSystem) addIndexed(dir *Inode, extents []extent, name string, inode uint32, fileType uint8) error {
+	le := binary.LittleEndian
+	rootBlock, err := physicalBlock(extents, 0)
+	if err != nil {
+		return err
+	}
+	root, err := f.readBlock(rootBlock)
+	if err != nil {
+		return err
+	}
+	hashVersion := root[28]
+	infoLength := int(root[29])
+	levels := int(root[30])
+	hash, err := f.dxHash(name, hashVersion)
+	if err != nil {
+		return err
+	}
+	frame := &dxFrame{block: rootBlock, data: root, offset: 24 + infoLength}
+	var frames []*dxFrame
+	var leafLogical uint32
+	for level := 0; ; level++ {
+		count := frame.count()
+		if count == 0 || count > frame.limit() {
+			return fmt.Errorf("directory %d: invalid htree index", dir.Number)
+		}
+		frame.index = 0
+		for i := 1; i < count; i++ {
+			if h, _ := frame.entry(i); h > hash {
+				break
+			}
+			frame.index = i
+		}
+		frames = append(frames, frame)
+		_, leafLogical = frame.entry(frame.index)
+		if level >= levels {
+			break
+		}
+		block, err := physicalBlock(extents, leafLogical)
+		if err != nil {
+			return err
+		}
+		data, err := f.readBlock(block)
+		if err != nil {
+			return err
+		}
+		frame = &dxFrame{block: block, data: data, offset: 8}
+	}
+
+	usable := int(f.blockSize) - f.dirTail()
+	leafBlock, err := physicalBlock(extents, leafLogical)
+	if err != nil {
+		return err
+	}
+	leaf, err := f.readBlock(leafBlock)
+	if err != nil {
+		return err
+	}
+	ok, err := insertDirent(leaf, usable, name, inode, fileType)
+	if err != nil {
+		return fmt.Errorf("directory %d: %s", dir.Number, err)
+	}
+	if ok {
+		return f.writeDirBlock(dir, leafBlock, leaf)
+	}
+
+	// split the leaf by hash, the upper half moves to a new block
+	path := &dxPath{frames: frames, extents: extents}
+	if err := f.dxRoom(dir, path, frames[len(frames)-1]); err != nil {
+		return err
+	}
+	frames, extents = path.frames, path.extents
+	parent := frames[len(frames)-1]
+	entries, err := parseDirents(leaf[:usable], usable)
+	if err != nil {
+		return err
+	}
+	hashed := make([]hashedDirent, len(entries))
+	for i, e := range entries {
+		h, err := f.dxHash(e.Name, hashVersion)
+		if err != nil {
+			return err
+		}
+		hashed[i] = hashedDirent{dirent: e, hash: h}
+	}
+	sort.SliceStable(hashed, func(i, j int) bool { return hashed[i].hash < hashed[j].hash })
+	split := len(hashed) / 2
+	if split == 0 {
+		return fmt.Errorf("directory %d: can't split htree leaf", dir.Number)
+	}
+	splitHash := hashed[split].hash
+	continued := uint32(0)
+	if hashed[split-1].hash == splitHash {
+		continued = 1
+	}
+
+	newLogical, newBlock, _, err := f.appendDirBlock(dir, extents)
+	if err != nil {
+		return err
+	}
+	lower, upper := f.newDirBlock(), f.newDirBlock()
+	for _, e := range hashed[:split] {
+		if _, err := insertDirent(lower, usable, e.Name, e.Inode, e.Type); err != nil {
+			return err
+		}
+	}
+	for _, e := range hashed[split:] {
+		if _, err := insertDirent(upper, usable, e.Name, e.Inode, e.Type); err != nil {
+			return err
+		}
+	}
+	target := lower
+	if hash >= splitHash {
+		target = upper
+	}
+	ok, err = insertDirent(target, usable, name, inode, fileType)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("directory %d: no room after splitting htree leaf", dir.Number)
+	}
+
+	// insert the index entry for the new leaf after the followed entry
+	at := parent.offset + (parent.index+1)*8
+	end := parent.offset + parent.count()*8
+	copy(parent.data[at+8:end+8], parent.data[at:end])
+	le.PutUint32(parent.data[at:], splitHash+continued)
+	le.PutUint32(parent.data[at+4:], newLogical)
+	le.PutUint16(parent.data[parent.offset+2:], uint16(parent.count()+1))
+
+	if err := f.writeDirBlock(dir, leafBlock, lower); err != nil {
+		return err
+	}
+	if err := f.writeDirBlock(dir, newBlock, upper); err != nil {
+		return err
+	}
+	path.changed(parent)
+	for _, fr := range path.dirty {
+		if err := f.writeDxBlock(dir, fr); err != nil {
+			return err
+		}
+	}
+	return f.writeInode(dir)
+}
@@ -0,0 +1,137 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const extentMagic = 0xF30A
+const extentHeaderSize = 12
+const extentEntrySize = 12
+
+// maxInitExtentLen is the longest initialized extent, larger ee_len values
+// mark unwritten extents
+const maxInitExtentLen = 32768
+
+// extent maps a run of logical file blocks to physical blocks, unwritten
+// extents are allocated but read as zeros
+type extent struct {
+	Logical   uint32
+	Length    uint32
+	Start     uint64
+	Unwritten bool
+}
+
+// extents returns the block mapping of an inode sorted by logical block
+func (f *FileSystem) extents(inode *Inode) ([]extent, error) {
+	if inode.Flags&inodeFlagExtents != 0 {
+		return f.extentTree(inode.block[:], 0)
+	}
+	return f.blockMap(inode, nil)
+}
+
+func (f *FileSystem) extentTree(node []byte, level int) ([]extent, error) {
+	if level > 5 {
+		return nil, fmt.Errorf("extent tree too deep")
+	}
+	le := binary.LittleEndian
+	if len(node) < extentHeaderSize || le.Uint16(node[0:]) != extentMagic {
+		return nil, fmt.Errorf("invalid extent header")
+	}
+	entries := int(le.Uint16(node[2:]))
+	depth := le.Uint16(node[6:])
+	if extentHeaderSize+entries*extentEntrySize > len(node) {
+		return nil, fmt.Errorf("invalid extent entry count %d", entries)
+	}
+	var result []extent
+	for i := 0; i < entries; i++ {
+		e := node[extentHeaderSize+i*extentEntrySize:]
+		if depth == 0 {
+			length := uint32(le.Uint16(e[4:]))
+			unwritten := length > maxInitExtentLen
+			if unwritten {
+				length -= maxInitExtentLen
+			}
+			result = append(result, extent{
+				Logical:   le.Uint32(e[0:]),
+				Length:    length,
+				Start:     uint64(le.Uint16(e[6:]))<<32 | uint64(le.Uint32(e[8:])),
+				Unwritten: unwritten,
+			})
+			continue
+		}
+		leaf := uint64(le.Uint16(e[8:]))<<32 | uint64(le.Uint32(e[4:]))
+		child, err := f.readBlock(leaf)
+		if err != nil {
+			return nil, err
+		}
+		childExtents, err := f.extentTree(child, level+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, childExtents...)
+	}
+	return result, nil
+}
+
+// blockMap reads the ext2/ext3 direct and indirect block pointers, meta is
+// called for each indirect block if set
+func (f *FileSystem) blockMap(inode *Inode, meta func(block uint64)) ([]extent, error) {
+	le := binary.LittleEndian
+	blocks := uint32((inode.Size + uint64(f.blockSize) - 1) / uint64(f.blockSize))
+	var result []extent
+	add := func(logical uint32, physical uint64) {
+		if physical == 0 {
+			return
+		}
+		if n := len(result); n > 0 {
+			last := &result[n-1]
+			if last.Logical+last.Length == logical && last.Start+uint64(last.Length) == physical {
+				last.Length++
+				return
+			}
+		}
+		result = append(result, extent{Logical: logical, Length: 1, Start: physical})
+	}
+	perBlock := uint32(f.blockSize / 4)
+	logical := uint32(0)
+	var walk func(block uint64, level int) error
+	walk = func(block uint64, level int) error {
+		if block == 0 {
+			span := uint32(1)
+			for i := 0; i < level; i++ {
+				span *= perBlock
+			}
+			logical += span
+			return nil
+		}
+		if level == 0 {
+			add(logical, block)
+			logical++
+			return nil
+		}
+		if meta != nil {
+			meta(block)
+		}
+		data, err := f.readBlock(block)
+		if err != nil {
+			return err
+		}
+		for i := uint32(0); i < perBlock && logical < blocks; i++ {
+			if err := walk(uint64(le.Uint32(data[i*4:])), level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 15 && logical < blocks; i++ {
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		if err := walk(uint64(le.Uint32(inode.block[i*4:])), level); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
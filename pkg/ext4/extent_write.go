@@ -0,0 +1,153 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// inodeExtents is the number of extents that fit into i_block
+const inodeExtents = 4
+
+// treeBlocks returns the index and leaf blocks of an extent tree, without
+// the root in the inode
+func (f *FileSystem) treeBlocks(node []byte, level int) ([]uint64, error) {
+	if level > 5 {
+		return nil, fmt.Errorf("extent tree too deep")
+	}
+	le := binary.LittleEndian
+	if len(node) < extentHeaderSize || le.Uint16(node[0:]) != extentMagic {
+		return nil, fmt.Errorf("invalid extent header")
+	}
+	entries := int(le.Uint16(node[2:]))
+	if le.Uint16(node[6:]) == 0 {
+		return nil, nil
+	}
+	var result []uint64
+	for i := 0; i < entries; i++ {
+		e := node[extentHeaderSize+i*extentEntrySize:]
+		block := uint64(le.Uint16(e[8:]))<<32 | uint64(le.Uint32(e[4:]))
+		child, err := f.readBlock(block)
+		if err != nil {
+			return nil, err
+		}
+		blocks, err := f.treeBlocks(child, level+1)
+		if err != nil {
+			return nil, err
+		}
+		result = append(append(result, block), blocks...)
+	}
+	return result, nil
+}
+
+func putExtentHeader(b []byte, entries, max, depth int) {
+	le := binary.LittleEndian
+	le.PutUint16(b[0:], extentMagic)
+	le.PutUint16(b[2:], uint16(entries))
+	le.PutUint16(b[4:], uint16(max))
+	le.PutUint16(b[6:], uint16(depth))
+	le.PutUint32(b[8:], 0)
+}
+
+func putExtent(b []byte, e extent) {
+	le := binary.LittleEndian
+	length := e.Length
+	if e.Unwritten {
+		length += maxInitExtentLen
+	}
+	le.PutUint32(b[0:], e.Logical)
+	le.PutUint16(b[4:], uint16(length))
+	le.PutUint16(b[6:], uint16(e.Start>>32))
+	le.PutUint32(b[8:], uint32(e.Start))
+}
+
+// setExtents replaces the extent tree of an inode, the extents have to be
+// sorted. Up to four extents are stored in the inode, more need one level of
+// leaf blocks. Blocks of the old tree are freed, the inode is not written.
+func (f *FileSystem) setExtents(inode *Inode, extents []extent) error {
+	sectors := uint64(f.blockSize / 512)
+	if inode.Flags&inodeFlagExtents != 0 {
+		old, err := f.treeBlocks(inode.block[:], 0)
+		if err != nil {
+			return err
+		}
+		for _, block := range old {
+			if err := f.freeBlocks(block, 1); err != nil {
+				return err
+			}
+			inode.Blocks -= sectors
+		}
+	}
+	inode.Flags |= inodeFlagExtents
+	for i := range inode.block {
+		inode.block[i] = 0
+	}
+	if len(extents) <= inodeExtents {
+		putExtentHeader(inode.block[:], len(extents), inodeExtents, 0)
+		for i, e := range extents {
+			putExtent(inode.block[extentHeaderSize+i*extentEntrySize:], e)
+		}
+		return nil
+	}
+
+	perLeaf := int((f.blockSize - extentHeaderSize) / extentEntrySize)
+	leaves := (len(extents) + perLeaf - 1) / perLeaf
+	if leaves > inodeExtents {
+		return fmt.Errorf("too many extents (%d)", len(extents))
+	}
+	goal := extents[0].Start
+	allocated, err := f.allocBlocks(goal, uint64(leaves))
+	if err != nil {
+		return err
+	}
+	var blocks []uint64
+	for _, run := range allocated {
+		for i := uint32(0); i < run.Length; i++ {
+			blocks = append(blocks, run.Start+uint64(i))
+		}
+	}
+	le := binary.LittleEndian
+	putExtentHeader(inode.block[:], leaves, inodeExtents, 1)
+	for i, block := range blocks {
+		chunk := extents[i*perLeaf:]
+		if len(chunk) > perLeaf {
+			chunk = chunk[:perLeaf]
+		}
+		leaf := make([]byte, f.blockSize)
+		putExtentHeader(leaf, len(chunk), perLeaf, 0)
+		for j, e := range chunk {
+			putExtent(leaf[extentHeaderSize+j*extentEntrySize:], e)
+		}
+		if f.sb.hasMetadataCsum() {
+			end := extentHeaderSize + perLeaf*extentEntrySize
+			le.PutUint32(leaf[end:], crc32c(f.inodeSeed(inode), leaf[:end]))
+		}
+		if err := f.writeBlock(block, leaf); err != nil {
+			return err
+		}
+		index := inode.block[extentHeaderSize+i*extentEntrySize:]
+		le.PutUint32(index[0:], chunk[0].Logical)
+		le.PutUint32(index[4:], uint32(block))
+		le.PutUint16(index[8:], uint16(block>>32))
+		inode.Blocks += sectors
+	}
+	return nil
+}
+
+// appendExtents adds runs of blocks at the logical end of a mapping, merging
+// adjacent runs
+func appendExtents(extents []extent, logical uint32, runs []extent) []extent {
+	for _, run := range runs {
+		run.Logical = logical
+		logical += run.Length
+		if n := len(extents); n > 0 {
+			last := &extents[n-1]
+			if !last.Unwritten && last.Logical+last.Length == run.Logical &&
+				last.Start+uint64(last.Length) == run.Start && last.Length+run.Length <= maxInitExtentLen {
+				last.Length += run.Length
+				continue
+			}
+		}
+		extents = append(extents, run)
+	}
+	return extents
+}
@@ -0,0 +1,148 @@
+package ext4
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+type file struct {
+	fs      *FileSystem
+	inode   *Inode
+	name    string
+	extents []extent
+	offset  int64
+	dir     []fs.DirEntry
+	dirRead bool
+}
+
+var _ fs.ReadDirFile = (*file)(nil)
+var _ io.ReaderAt = (*file)(nil)
+var _ io.Seeker = (*file)(nil)
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: f.name, inode: f.inode}, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	if f.inode.IsDir() {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	n, err := f.fs.readAt(f.inode, f.extents, p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.inode.Size)
+	}
+	if offset < 0 {
+		return f.offset, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.dirRead {
+		entries, err := f.fs.dirEntries(f.inode)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		f.dir = entries
+		f.dirRead = true
+	}
+	if n <= 0 {
+		entries := f.dir
+		f.dir = nil
+		return entries, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.dir) {
+		n = len(f.dir)
+	}
+	entries := f.dir[:n]
+	f.dir = f.dir[n:]
+	return entries, nil
+}
+
+func (f *file) Close() error {
+	return nil
+}
+
+type fileInfo struct {
+	name  string
+	inode *Inode
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return int64(i.inode.Size) }
+func (i *fileInfo) Mode() fs.FileMode  { return i.inode.FileMode() }
+func (i *fileInfo) ModTime() time.Time { return i.inode.Mtime }
+func (i *fileInfo) IsDir() bool        { return i.inode.IsDir() }
+
+// Sys returns the *Inode with ownership and flags
+func (i *fileInfo) Sys() interface{} { return i.inode }
+
+type dirEntry struct {
+	fs    *FileSystem
+	entry dirent
+}
+
+func (e *dirEntry) Name() string { return e.entry.Name }
+
+func (e *dirEntry) IsDir() bool { return e.Type().IsDir() }
+
+func (e *dirEntry) Type() fs.FileMode {
+	if e.entry.Type != fileTypeUnknown {
+		return fileTypeMode(e.entry.Type)
+	}
+	// file systems without the filetype feature need the inode
+	info, err := e.Info()
+	if err != nil {
+		return 0
+	}
+	return info.Mode().Type()
+}
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	inode, err := e.fs.readInode(e.entry.Inode)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: e.entry.Name, inode: inode}, nil
+}
+
+// dirEntries returns the directory entries sorted by name, as io/fs expects
+func (f *FileSystem) dirEntries(inode *Inode) ([]fs.DirEntry, error) {
+	entries, err := f.readDirents(inode)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		result[i] = &dirEntry{fs: f, entry: e}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result, nil
+}
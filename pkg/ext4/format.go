@@ -0,0 +1,188 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// the geometry of new file systems, like mke2fs for a default sized file
+// system without journal
+const (
+	formatBlockSize  = 4096
+	formatInodeSize  = 256
+	formatInodeRatio = 16384
+	formatExtraIsize = 32
+	lostAndFound     = "lost+found"
+)
+
+const (
+	formatCompat   = compatDirIndex
+	formatIncompat = incompatFiletype | incompatExtents | incompat64Bit
+	formatRoCompat = roCompatSparseSuper | roCompatLargeFile | roCompatHugeFile | roCompatDirNlink |
+		roCompatExtraIsize | roCompatMetadataCsum
+)
+
+// Format creates an empty ext4 file system without journal on the first
+// size bytes of dev and returns it writable, sources provide its UUIDs and
+// timestamps
+func Format(dev Device, size int64, label string, sources Sources) (*FileSystem, error) {
+	if len(label) > 16 {
+		return nil, fmt.Errorf("label %s is longer than 16 bytes", label)
+	}
+	blocks := uint64(size / formatBlockSize)
+	perGroup := uint64(formatBlockSize * 8)
+	groups := (blocks + perGroup - 1) / perGroup
+	if groups == 0 {
+		return nil, fmt.Errorf("%d bytes are too small for an ext4 file system", size)
+	}
+	perBlock := uint64(formatBlockSize / formatInodeSize)
+	inodes := (blocks*formatBlockSize/formatInodeRatio + groups - 1) / groups
+	inodes = (inodes + perBlock - 1) / perBlock * perBlock
+	if inodes < perBlock {
+		inodes = perBlock
+	}
+	if inodes > perGroup {
+		inodes = perGroup
+	}
+
+	raw := make([]byte, superblockSize)
+	le := binary.LittleEndian
+	le.PutUint32(raw[4:], uint32(blocks))
+	le.PutUint32(raw[336:], uint32(blocks>>32))
+	le.PutUint32(raw[24:], 2)
+	le.PutUint32(raw[28:], 2)
+	le.PutUint32(raw[32:], uint32(perGroup))
+	le.PutUint32(raw[36:], uint32(perGroup))
+	le.PutUint32(raw[40:], uint32(inodes))
+	now := uint32(sources.now().Unix())
+	le.PutUint32(raw[48:], now)
+	le.PutUint16(raw[54:], 0xFFFF)
+	le.PutUint16(raw[56:], superblockMagic)
+	le.PutUint16(raw[58:], 1)
+	le.PutUint16(raw[60:], 1)
+	le.PutUint32(raw[64:], now)
+	le.PutUint32(raw[76:], 1)
+	le.PutUint32(raw[84:], 11)
+	le.PutUint16(raw[88:], formatInodeSize)
+	le.PutUint32(raw[92:], formatCompat)
+	le.PutUint32(raw[96:], formatIncompat)
+	le.PutUint32(raw[100:], formatRoCompat)
+	if _, err := io.ReadFull(sources.rand(), raw[104:120]); err != nil {
+		return nil, err
+	}
+	copy(raw[120:136], label)
+	if _, err := io.ReadFull(sources.rand(), raw[236:252]); err != nil {
+		return nil, err
+	}
+	raw[252] = hashHalfMD4
+	le.PutUint16(raw[254:], 64)
+	le.PutUint32(raw[264:], now)
+	le.PutUint16(raw[348:], formatExtraIsize)
+	le.PutUint16(raw[350:], formatExtraIsize)
+	le.PutUint32(raw[352:], flagSignedHash)
+	raw[373] = 1
+	// random UUIDs are version 4
+	raw[110] = raw[110]&0x0f | 0x40
+	raw[112] = raw[112]&0x3f | 0x80
+
+	sb, err := parseSuperblock(raw)
+	if err != nil {
+		return nil, err
+	}
+	raw = sb.raw
+	f := &FileSystem{
+		dev:          dev,
+		sb:           sb,
+		blockSize:    formatBlockSize,
+		rw:           dev,
+		blockBitmaps: make(map[uint32][]byte),
+		inodeBitmaps: make(map[uint32][]byte),
+		dirty:        make(map[uint32]bool),
+		sources:      sources,
+	}
+	// a last group too small for data is left out like mke2fs does
+	if last := sb.GroupCount() - 1; last > 0 && blocks-f.groupStart(last) < f.groupOverhead(last)+minGroupData {
+		sb.BlocksCount = f.groupStart(last)
+	}
+	if sb.BlocksCount < f.groupOverhead(0)+minGroupData {
+		return nil, fmt.Errorf("%d bytes are too small for an ext4 file system", size)
+	}
+	buf := make([]byte, formatBlockSize)
+	if _, err := dev.ReadAt(buf, int64(sb.BlocksCount-1)*formatBlockSize); err != nil {
+		return nil, fmt.Errorf("device too small for %d blocks: %s", sb.BlocksCount, err)
+	}
+	// clear old boot sectors and signatures
+	if _, err := dev.WriteAt(make([]byte, superblockOffset), 0); err != nil {
+		return nil, err
+	}
+	for group := uint32(0); group < sb.GroupCount(); group++ {
+		if err := f.addGroup(group); err != nil {
+			return nil, err
+		}
+	}
+	le.PutUint32(raw[0:], sb.InodesCount)
+	le.PutUint32(raw[4:], uint32(sb.BlocksCount))
+	le.PutUint32(raw[336:], uint32(sb.BlocksCount>>32))
+
+	if err := f.reserveInodes(); err != nil {
+		return nil, err
+	}
+	if err := f.mkroot(); err != nil {
+		return nil, err
+	}
+	if err := f.Mkdir(lostAndFound, Attr{Mode: 0700}); err != nil {
+		return nil, err
+	}
+	if err := f.writeBackups(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reserveInodes marks the inodes below the first regular inode as used,
+// they stay zeroed
+func (f *FileSystem) reserveInodes() error {
+	gd := &f.groups[0]
+	bitmap := f.inodeBitmaps[0]
+	reserved := f.sb.FirstInode - 1
+	for i := uint32(0); i < reserved; i++ {
+		setBit(bitmap, i)
+	}
+	gd.Flags &^= bgInodeUninit
+	gd.FreeInodesCount -= reserved
+	gd.ItableUnused = f.sb.InodesPerGroup - reserved
+	f.sb.FreeInodesCount -= reserved
+	tableBlocks := (uint64(f.sb.FirstInode)*uint64(f.sb.InodeSize) + uint64(f.blockSize) - 1) / uint64(f.blockSize)
+	zero := make([]byte, f.blockSize)
+	for i := uint64(0); i < tableBlocks; i++ {
+		if err := f.writeBlock(gd.InodeTable+i, zero); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkroot creates the root directory, its parent is itself
+func (f *FileSystem) mkroot() error {
+	runs, err := f.allocBlocks(f.groupStart(0), 1)
+	if err != nil {
+		return err
+	}
+	inode := f.newInode(rootInode, modeDir|0755, Attr{})
+	inode.Links = 2
+	inode.Size = uint64(f.blockSize)
+	inode.Blocks = uint64(f.blockSize / 512)
+	if err := f.setExtents(inode, runs); err != nil {
+		return err
+	}
+	data := f.newDirBlock()
+	usable := int(f.blockSize) - f.dirTail()
+	putDirent(data, rootInode, 12, ".", f.fileType(modeDir))
+	putDirent(data[12:], rootInode, usable-12, "..", f.fileType(modeDir))
+	if err := f.writeDirBlock(inode, runs[0].Start, data); err != nil {
+		return err
+	}
+	f.groups[0].UsedDirsCount++
+	return f.writeInode(inode)
+}
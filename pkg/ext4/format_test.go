@@ -0,0 +1,45 @@
+package ext4
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	for _, size := range []int64{1 << 20, 64 << 20, 300 << 20} {
+		image, err := os.Create(filepath.Join(t.TempDir(), "format.img"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer image.Close()
+		if err := image.Truncate(size); err != nil {
+			t.Fatal(err)
+		}
+		f, err := Format(image, size, "data", Sources{})
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if err := f.MkdirAll("srv/www", testAttr()); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteFile("srv/www/index.html", []byte("<html></html>"), testAttr()); err != nil {
+			t.Fatal(err)
+		}
+		fsck(t, image)
+
+		reopened, err := New(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if label := reopened.Label(); label != "data" {
+			t.Errorf("label = %q", label)
+		}
+		if _, err := reopened.Stat(lostAndFound); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := Format(nil, 64<<20, "a label that is too long", Sources{}); err == nil {
+		t.Error("long label accepted")
+	}
+}
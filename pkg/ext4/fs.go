@@ -0,0 +1,311 @@
+package ext4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ErrNotExt4 is returned when the device does not contain an ext2/3/4 file system
+var ErrNotExt4 = errors.New("not an ext4 file system")
+
+var errNotDir = errors.New("not a directory")
+
+// maxSymlinks limits symlink resolution like the kernel does
+const maxSymlinks = 40
+
+// FileSystem is an ext4 file system, it implements io/fs.FS with symlinks
+// resolved relative to the file system root
+type FileSystem struct {
+	dev       io.ReaderAt
+	sb        *Superblock
+	blockSize int64
+	groups    []groupDescriptor
+	// gdt is the raw group descriptor table
+	gdt []byte
+
+	// rw is set for writable file systems, bitmaps are cached and written
+	// together with the dirty group descriptors
+	rw           io.WriterAt
+	blockBitmaps map[uint32][]byte
+	inodeBitmaps map[uint32][]byte
+	dirty        map[uint32]bool
+	sources      Sources
+}
+
+var _ fs.FS = (*FileSystem)(nil)
+var _ fs.ReadFileFS = (*FileSystem)(nil)
+var _ fs.ReadDirFS = (*FileSystem)(nil)
+var _ fs.StatFS = (*FileSystem)(nil)
+
+// New opens the ext4 file system on dev read-only
+func New(dev io.ReaderAt) (*FileSystem, error) {
+	buf := make([]byte, superblockSize)
+	if _, err := dev.ReadAt(buf, superblockOffset); err != nil {
+		return nil, fmt.Errorf("can't read superblock: %s", err)
+	}
+	sb, err := parseSuperblock(buf)
+	if err != nil {
+		return nil, err
+	}
+	f := &FileSystem{
+		dev:       dev,
+		sb:        sb,
+		blockSize: int64(sb.BlockSize),
+	}
+	if err := f.readGroupDescriptors(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Probe checks if dev contains an ext2/3/4 superblock
+func Probe(dev io.ReaderAt) bool {
+	buf := make([]byte, 2)
+	if _, err := dev.ReadAt(buf, superblockOffset+56); err != nil {
+		return false
+	}
+	return uint16(buf[0])|uint16(buf[1])<<8 == superblockMagic
+}
+
+func (f *FileSystem) Superblock() *Superblock {
+	return f.sb
+}
+
+// Label returns the volume name, e.g. "writable"
+func (f *FileSystem) Label() string {
+	return f.sb.VolumeName
+}
+
+func (f *FileSystem) readBlock(block uint64) ([]byte, error) {
+	if block >= f.sb.BlocksCount {
+		return nil, fmt.Errorf("block %d out of range", block)
+	}
+	buf := make([]byte, f.blockSize)
+	if _, err := f.dev.ReadAt(buf, int64(block)*f.blockSize); err != nil {
+		return nil, fmt.Errorf("can't read block %d: %s", block, err)
+	}
+	return buf, nil
+}
+
+// readAt reads file content at off using the block mapping of the inode
+func (f *FileSystem) readAt(inode *Inode, extents []extent, p []byte, off int64) (int, error) {
+	size := int64(inode.Size)
+	if off >= size {
+		return 0, io.EOF
+	}
+	if inode.Flags&inodeFlagInlineData != 0 {
+		data := inode.inlineData()
+		if off >= int64(len(data)) {
+			return 0, io.EOF
+		}
+		return copy(p, data[off:]), nil
+	}
+	if remaining := size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	end := off + int64(len(p))
+	for _, e := range extents {
+		start := int64(e.Logical) * f.blockSize
+		stop := start + int64(e.Length)*f.blockSize
+		if stop <= off || start >= end || e.Start == 0 || e.Unwritten {
+			continue
+		}
+		from := maxInt64(start, off)
+		to := minInt64(stop, end)
+		physical := int64(e.Start)*f.blockSize + (from - start)
+		if _, err := f.dev.ReadAt(p[from-off:to-off], physical); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (f *FileSystem) readAll(inode *Inode) ([]byte, error) {
+	extents, err := f.extents(inode)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, inode.Size)
+	if len(buf) == 0 {
+		return buf, nil
+	}
+	_, err = f.readAt(inode, extents, buf, 0)
+	return buf, err
+}
+
+func (f *FileSystem) readlink(inode *Inode) (string, error) {
+	if !inode.IsSymlink() {
+		return "", fs.ErrInvalid
+	}
+	// fast symlinks store the target in the block pointers
+	if inode.Size < uint64(len(inode.block)) && inode.Flags&(inodeFlagExtents|inodeFlagInlineData) == 0 {
+		return string(inode.block[:inode.Size]), nil
+	}
+	data, err := f.readAll(inode)
+	return string(data), err
+}
+
+// resolve walks the path from the root, symlinks in the last element are
+// only followed if follow is set
+func (f *FileSystem) resolve(name string, follow bool) (*Inode, error) {
+	root, err := f.readInode(rootInode)
+	if err != nil {
+		return nil, err
+	}
+	stack := []*Inode{root}
+	parts := splitPath(name)
+	links := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		current := stack[len(stack)-1]
+		if !current.IsDir() {
+			return nil, errNotDir
+		}
+		child, err := f.lookup(current, part)
+		if err != nil {
+			return nil, err
+		}
+		if child.IsSymlink() && (len(parts) > 0 || follow) {
+			links++
+			if links > maxSymlinks {
+				return nil, fmt.Errorf("too many levels of symbolic links")
+			}
+			target, err := f.readlink(child)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(target, "/") {
+				stack = stack[:1]
+			}
+			parts = append(splitPath(target), parts...)
+			continue
+		}
+		stack = append(stack, child)
+	}
+	return stack[len(stack)-1], nil
+}
+
+func splitPath(name string) []string {
+	name = strings.Trim(name, "/")
+	if name == "" || name == "." {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func (f *FileSystem) open(op, name string, follow bool) (*Inode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	inode, err := f.resolve(name, follow)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return inode, nil
+}
+
+// Open opens a file or directory, symlinks are followed
+func (f *FileSystem) Open(name string) (fs.File, error) {
+	inode, err := f.open("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	extents, err := f.extents(inode)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{
+		fs:      f,
+		inode:   inode,
+		name:    path.Base(name),
+		extents: extents,
+	}, nil
+}
+
+func (f *FileSystem) ReadFile(name string) ([]byte, error) {
+	inode, err := f.open("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if inode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrInvalid}
+	}
+	data, err := f.readAll(inode)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+func (f *FileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	inode, err := f.open("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := f.dirEntries(inode)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+func (f *FileSystem) Stat(name string) (fs.FileInfo, error) {
+	inode, err := f.open("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), inode: inode}, nil
+}
+
+// Lstat returns the file info without following a symlink in the last element
+func (f *FileSystem) Lstat(name string) (fs.FileInfo, error) {
+	inode, err := f.open("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &fileInfo{name: path.Base(name), inode: inode}, nil
+}
+
+// Readlink returns the target of a symlink
+func (f *FileSystem) Readlink(name string) (string, error) {
+	inode, err := f.open("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := f.readlink(inode)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
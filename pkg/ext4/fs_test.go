@@ -0,0 +1,65 @@
+package ext4
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// mkfs creates an ext4 image of size bytes with e2fsprogs, populated from
+// root if set
+func mkfs(t *testing.T, size string, root string, args ...string) *os.File {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not installed")
+	}
+	image := filepath.Join(t.TempDir(), "ext4.img")
+	args = append([]string{"-q", "-F"}, args...)
+	if root != "" {
+		args = append(args, "-d", root)
+	}
+	args = append(args, image, size)
+	if out, err := exec.Command("mkfs.ext4", args...).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4 %v: %s\n%s", args, err, out)
+	}
+	file, err := os.OpenFile(image, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+func TestInlineData(t *testing.T) {
+	root := t.TempDir()
+	short := []byte("short")
+	long := bytes.Repeat([]byte("0123456789"), 10)
+	for name, content := range map[string][]byte{"short.txt": short, "long.txt": long} {
+		if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := mkfs(t, "8M", root, "-O", "inline_data", "-I", "256")
+	f, err := New(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inode, err := f.resolve("long.txt", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inode.Flags&inodeFlagInlineData == 0 {
+		t.Skip("mkfs.ext4 didn't inline long.txt")
+	}
+	for name, want := range map[string][]byte{"short.txt": short, "long.txt": long} {
+		got, err := f.ReadFile(name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	bgInodeUninit = 0x1
+	bgBlockUninit = 0x2
+	bgInodeZeroed = 0x4
+)
+
+type groupDescriptor struct {
+	BlockBitmap     uint64
+	InodeBitmap     uint64
+	InodeTable      uint64
+	FreeBlocksCount uint32
+	FreeInodesCount uint32
+	UsedDirsCount   uint32
+	Flags           uint16
+	ItableUnused    uint32
+}
+
+func parseGroupDescriptor(b []byte, is64 bool) groupDescriptor {
+	le := binary.LittleEndian
+	gd := groupDescriptor{
+		BlockBitmap:     uint64(le.Uint32(b[0:])),
+		InodeBitmap:     uint64(le.Uint32(b[4:])),
+		InodeTable:      uint64(le.Uint32(b[8:])),
+		FreeBlocksCount: uint32(le.Uint16(b[12:])),
+		FreeInodesCount: uint32(le.Uint16(b[14:])),
+		UsedDirsCount:   uint32(le.Uint16(b[16:])),
+		Flags:           le.Uint16(b[18:]),
+		ItableUnused:    uint32(le.Uint16(b[28:])),
+	}
+	if is64 {
+		gd.BlockBitmap |= uint64(le.Uint32(b[32:])) << 32
+		gd.InodeBitmap |= uint64(le.Uint32(b[36:])) << 32
+		gd.InodeTable |= uint64(le.Uint32(b[40:])) << 32
+		gd.FreeBlocksCount |= uint32(le.Uint16(b[44:])) << 16
+		gd.FreeInodesCount |= uint32(le.Uint16(b[46:])) << 16
+		gd.UsedDirsCount |= uint32(le.Uint16(b[48:])) << 16
+		gd.ItableUnused |= uint32(le.Uint16(b[50:])) << 16
+	}
+	return gd
+}
+
+func (gd *groupDescriptor) marshal(b []byte, is64 bool) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], uint32(gd.BlockBitmap))
+	le.PutUint32(b[4:], uint32(gd.InodeBitmap))
+	le.PutUint32(b[8:], uint32(gd.InodeTable))
+	le.PutUint16(b[12:], uint16(gd.FreeBlocksCount))
+	le.PutUint16(b[14:], uint16(gd.FreeInodesCount))
+	le.PutUint16(b[16:], uint16(gd.UsedDirsCount))
+	le.PutUint16(b[18:], gd.Flags)
+	le.PutUint16(b[28:], uint16(gd.ItableUnused))
+	if is64 {
+		le.PutUint32(b[32:], uint32(gd.BlockBitmap>>32))
+		le.PutUint32(b[36:], uint32(gd.InodeBitmap>>32))
+		le.PutUint32(b[40:], uint32(gd.InodeTable>>32))
+		le.PutUint16(b[44:], uint16(gd.FreeBlocksCount>>16))
+		le.PutUint16(b[46:], uint16(gd.FreeInodesCount>>16))
+		le.PutUint16(b[48:], uint16(gd.UsedDirsCount>>16))
+		le.PutUint16(b[50:], uint16(gd.ItableUnused>>16))
+	}
+}
+
+// groupChecksum is crc32c with metadata_csum and crc16 with uninit_bg
+func (f *FileSystem) groupChecksum(group uint32, b []byte) uint16 {
+	var num [4]byte
+	binary.LittleEndian.PutUint32(num[:], group)
+	if f.sb.hasMetadataCsum() {
+		crc := crc32c(f.sb.ChecksumSeed, num[:])
+		crc = crc32c(crc, b[:30])
+		crc = crc32c(crc, []byte{0, 0})
+		crc = crc32c(crc, b[32:])
+		return uint16(crc)
+	}
+	crc := crc16(0xFFFF, f.sb.UUID[:])
+	crc = crc16(crc, num[:])
+	crc = crc16(crc, b[:30])
+	if f.is64() {
+		crc = crc16(crc, b[32:])
+	}
+	return crc
+}
+
+func (f *FileSystem) hasGroupChecksum() bool {
+	return f.sb.FeatureRoCompat&(roCompatGdtCsum|roCompatMetadataCsum) != 0
+}
+
+func (f *FileSystem) is64() bool {
+	return f.sb.FeatureIncompat&incompat64Bit != 0 && f.sb.DescSize >= 64
+}
+
+// groupStart returns the first block of a group
+func (f *FileSystem) groupStart(group uint32) uint64 {
+	return uint64(f.sb.FirstDataBlock) + uint64(group)*uint64(f.sb.BlocksPerGroup)
+}
+
+// groupBlocks returns the number of blocks of a group, the last group can
+// be smaller
+func (f *FileSystem) groupBlocks(group uint32) uint32 {
+	start := f.groupStart(group)
+	if remaining := f.sb.BlocksCount - start; remaining < uint64(f.sb.BlocksPerGroup) {
+		return uint32(remaining)
+	}
+	return f.sb.BlocksPerGroup
+}
+
+// gdtBlocks is the number of blocks of one group descriptor table copy
+func (f *FileSystem) gdtBlocks() uint64 {
+	size := uint64(f.sb.GroupCount()) * uint64(f.sb.DescSize)
+	return (size + uint64(f.blockSize) - 1) / uint64(f.blockSize)
+}
+
+// gdtBlock returns the first block of the group descriptor table
+func (f *FileSystem) gdtBlock() uint64 {
+	return uint64(f.sb.FirstDataBlock) + 1
+}
+
+func (f *FileSystem) readGroupDescriptors() error {
+	if f.sb.FeatureIncompat&incompatMetaBG != 0 {
+		return fmt.Errorf("unsupported ext4 feature meta_bg")
+	}
+	count := f.sb.GroupCount()
+	size := int64(f.sb.DescSize)
+	buf := make([]byte, int64(count)*size)
+	if _, err := f.dev.ReadAt(buf, int64(f.gdtBlock())*f.blockSize); err != nil {
+		return fmt.Errorf("can't read group descriptors: %s", err)
+	}
+	f.gdt = buf
+	f.groups = make([]groupDescriptor, count)
+	for i := range f.groups {
+		f.groups[i] = parseGroupDescriptor(buf[int64(i)*size:int64(i+1)*size], f.is64())
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package ext4
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// directory index hash versions, the unsigned variants are used when the
+// superblock has the unsigned hash flag
+const (
+	hashLegacy          = 0
+	hashHalfMD4         = 1
+	hashTea             = 2
+	hashLegacyUnsigned  = 3
+	hashHalfMD4Unsigned = 4
+	hashTeaUnsigned     = 5
+	htreeEOF32          = 0x7fffffff
+	teaDelta            = 0x9E3779B9
+	halfMD4K2           = 013240474631
+	halfMD4K3           = 015666365641
+)
+
+// dxHash computes the htree hash of a name like fs/ext4/hash.c
+func (f *FileSystem) dxHash(name string, version uint8) (uint32, error) {
+	if version <= hashTea && f.sb.Flags&flagUnsignedHash != 0 {
+		version += 3
+	}
+	unsigned := version >= hashLegacyUnsigned
+	buf := [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+	if f.sb.HashSeed != [4]uint32{} {
+		buf = f.sb.HashSeed
+	}
+	var hash uint32
+	switch version {
+	case hashLegacy, hashLegacyUnsigned:
+		hash = legacyHash(name, unsigned)
+	case hashHalfMD4, hashHalfMD4Unsigned:
+		var in [8]uint32
+		for p := name; ; p = p[32:] {
+			str2hashbuf(p, in[:], unsigned)
+			halfMD4Transform(&buf, &in)
+			if len(p) <= 32 {
+				break
+			}
+		}
+		hash = buf[1]
+	case hashTea, hashTeaUnsigned:
+		var in [4]uint32
+		for p := name; ; p = p[16:] {
+			str2hashbuf(p, in[:], unsigned)
+			teaTransform(&buf, &in)
+			if len(p) <= 16 {
+				break
+			}
+		}
+		hash = buf[0]
+	default:
+		return 0, fmt.Errorf("unsupported directory hash version %d", version)
+	}
+	hash &^= 1
+	if hash == htreeEOF32<<1 {
+		hash = (htreeEOF32 - 1) << 1
+	}
+	return hash, nil
+}
+
+func char(c byte, unsigned bool) uint32 {
+	if unsigned {
+		return uint32(c)
+	}
+	return uint32(int32(int8(c)))
+}
+
+func legacyHash(name string, unsigned bool) uint32 {
+	hash0, hash1 := uint32(0x12a3fe2d), uint32(0x37abe8f9)
+	for i := 0; i < len(name); i++ {
+		hash := hash1 + (hash0 ^ char(name[i], unsigned)*7152373)
+		if hash&0x80000000 != 0 {
+			hash -= 0x7fffffff
+		}
+		hash1, hash0 = hash0, hash
+	}
+	return hash0 << 1
+}
+
+// str2hashbuf packs up to 4*len(buf) characters, padded with the length
+func str2hashbuf(msg string, buf []uint32, unsigned bool) {
+	length := uint32(len(msg))
+	pad := length | length<<8
+	pad |= pad << 16
+	val := pad
+	if len(msg) > len(buf)*4 {
+		msg = msg[:len(buf)*4]
+	}
+	n := 0
+	for i := 0; i < len(msg); i++ {
+		val = char(msg[i], unsigned) + val<<8
+		if i%4 == 3 {
+			buf[n] = val
+			n++
+			val = pad
+		}
+	}
+	if n < len(buf) {
+		buf[n] = val
+		n++
+	}
+	for ; n < len(buf); n++ {
+		buf[n] = pad
+	}
+}
+
+func halfMD4Transform(buf *[4]uint32, in *[8]uint32) {
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+	round := func(fn func(x, y, z uint32) uint32, a *uint32, b, c, d, x uint32, s int) {
+		*a = bits.RotateLeft32(*a+fn(b, c, d)+x, s)
+	}
+
+	round(f, &a, b, c, d, in[0], 3)
+	round(f, &d, a, b, c, in[1], 7)
+	round(f, &c, d, a, b, in[2], 11)
+	round(f, &b, c, d, a, in[3], 19)
+	round(f, &a, b, c, d, in[4], 3)
+	round(f, &d, a, b, c, in[5], 7)
+	round(f, &c, d, a, b, in[6], 11)
+	round(f, &b, c, d, a, in[7], 19)
+
+	round(g, &a, b, c, d, in[1]+halfMD4K2, 3)
+	round(g, &d, a, b, c, in[3]+halfMD4K2, 5)
+	round(g, &c, d, a, b, in[5]+halfMD4K2, 9)
+	round(g, &b, c, d, a, in[7]+halfMD4K2, 13)
+	round(g, &a, b, c, d, in[0]+halfMD4K2, 3)
+	round(g, &d, a, b, c, in[2]+halfMD4K2, 5)
+	round(g, &c, d, a, b, in[4]+halfMD4K2, 9)
+	round(g, &b, c, d, a, in[6]+halfMD4K2, 13)
+
+	round(h, &a, b, c, d, in[3]+halfMD4K3, 3)
+	round(h, &d, a, b, c, in[7]+halfMD4K3, 9)
+	round(h, &c, d, a, b, in[2]+halfMD4K3, 11)
+	round(h, &b, c, d, a, in[6]+halfMD4K3, 15)
+	round(h, &a, b, c, d, in[1]+halfMD4K3, 3)
+	round(h, &d, a, b, c, in[5]+halfMD4K3, 9)
+	round(h, &c, d, a, b, in[0]+halfMD4K3, 11)
+	round(h, &b, c, d, a, in[4]+halfMD4K3, 15)
+
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
+
+func teaTransform(buf *[4]uint32, in *[4]uint32) {
+	sum := uint32(0)
+	b0, b1 := buf[0], buf[1]
+	a, b, c, d := in[0], in[1], in[2], in[3]
+	for n := 0; n < 16; n++ {
+		sum += teaDelta
+		b0 += ((b1 << 4) + a) ^ (b1 + sum) ^ ((b1 >> 5) + b)
+		b1 += ((b0 << 4) + c) ^ (b0 + sum) ^ ((b0 >> 5) + d)
+	}
+	buf[0] += b0
+	buf[1] += b1
+}
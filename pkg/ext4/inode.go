@@ -0,0 +1,343 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+const rootInode = 2
+
+const goodOldInodeSize = 128
+
+// blockPointersSize is the size of i_block, which holds the block map,
+// extent tree root or a fast symlink
+const blockPointersSize = 60
+
+// linkMax is the largest directory link count, larger directories use 1
+// with the dir_nlink feature
+const linkMax = 65000
+
+const (
+	inodeFlagIndex      = 0x1000
+	inodeFlagHugeFile   = 0x40000
+	inodeFlagExtents    = 0x80000
+	inodeFlagInlineData = 0x10000000
+)
+
+// xattrIndexSystem is the name index of system.* extended attributes
+const xattrIndexSystem = 7
+
+const (
+	modeTypeMask = 0xF000
+	modeFifo     = 0x1000
+	modeChar     = 0x2000
+	modeDir      = 0x4000
+	modeBlock    = 0x6000
+	modeFile     = 0x8000
+	modeSymlink  = 0xA000
+	modeSocket   = 0xC000
+)
+
+// Inode is a parsed ext4 inode
+type Inode struct {
+	Number uint32
+	Mode   uint16
+	UID    uint32
+	GID    uint32
+	Size   uint64
+	Links  uint16
+	Flags  uint32
+	Atime  time.Time
+	Ctime  time.Time
+	Mtime  time.Time
+	// Blocks is the number of 512 byte sectors in use, including metadata
+	Blocks     uint64
+	FileACL    uint64
+	Generation uint32
+
+	block [blockPointersSize]byte
+	// raw is the on-disk inode, fields this package doesn't know about are
+	// written back unchanged
+	raw []byte
+}
+
+func parseInode(number uint32, b []byte) *Inode {
+	le := binary.LittleEndian
+	inode := &Inode{
+		Number:     number,
+		Mode:       le.Uint16(b[0:]),
+		UID:        uint32(le.Uint16(b[2:])) | uint32(le.Uint16(b[120:]))<<16,
+		GID:        uint32(le.Uint16(b[24:])) | uint32(le.Uint16(b[122:]))<<16,
+		Size:       uint64(le.Uint32(b[4:])) | uint64(le.Uint32(b[108:]))<<32,
+		Links:      le.Uint16(b[26:]),
+		Flags:      le.Uint32(b[32:]),
+		Atime:      decodeTime(b, 8, 140),
+		Ctime:      decodeTime(b, 12, 132),
+		Mtime:      decodeTime(b, 16, 136),
+		Blocks:     uint64(le.Uint32(b[28:])) | uint64(le.Uint16(b[116:]))<<32,
+		FileACL:    uint64(le.Uint32(b[104:])) | uint64(le.Uint16(b[118:]))<<32,
+		Generation: le.Uint32(b[100:]),
+		raw:        append([]byte(nil), b...),
+	}
+	copy(inode.block[:], b[40:100])
+	return inode
+}
+
+// fitsInInode checks if a field of the large inode is covered by i_extra_isize
+func fitsInInode(b []byte, offset, size int) bool {
+	if len(b) <= goodOldInodeSize {
+		return false
+	}
+	extra := int(binary.LittleEndian.Uint16(b[goodOldInodeSize:]))
+	return offset+size <= goodOldInodeSize+extra && offset+size <= len(b)
+}
+
+// decodeTime reads seconds and, for large inodes, the nanoseconds and epoch
+// bits of the matching _extra field
+func decodeTime(b []byte, offset, extraOffset int) time.Time {
+	le := binary.LittleEndian
+	sec := int64(int32(le.Uint32(b[offset:])))
+	if !fitsInInode(b, extraOffset, 4) {
+		return time.Unix(sec, 0)
+	}
+	extra := le.Uint32(b[extraOffset:])
+	sec += int64(extra&3) << 32
+	return time.Unix(sec, int64(extra>>2))
+}
+
+func encodeTime(b []byte, offset, extraOffset int, t time.Time) {
+	le := binary.LittleEndian
+	sec := t.Unix()
+	le.PutUint32(b[offset:], uint32(sec))
+	if fitsInInode(b, extraOffset, 4) {
+		epoch := uint32((sec-int64(int32(sec)))>>32) & 3
+		le.PutUint32(b[extraOffset:], uint32(t.Nanosecond())<<2|epoch)
+	}
+}
+
+// inlineData returns the content of an inline data inode: i_block followed
+// by the value of the system.data extended attribute in the inode
+func (i *Inode) inlineData() []byte {
+	size := int(minInt64(int64(i.Size), blockPointersSize))
+	data := append([]byte(nil), i.block[:size]...)
+	if int64(len(data)) < int64(i.Size) {
+		data = append(data, i.inlineXattr()...)
+	}
+	if int64(len(data)) > int64(i.Size) {
+		data = data[:i.Size]
+	}
+	return data
+}
+
+// inlineXattr finds the system.data extended attribute in the space after
+// i_extra_isize
+func (i *Inode) inlineXattr() []byte {
+	le := binary.LittleEndian
+	b := i.raw
+	if len(b) <= goodOldInodeSize+2 {
+		return nil
+	}
+	start := goodOldInodeSize + int(le.Uint16(b[goodOldInodeSize:]))
+	if start+4 > len(b) || le.Uint32(b[start:]) != xattrMagic {
+		return nil
+	}
+	entries := b[start+4:]
+	for pos := 0; pos+16 <= len(entries) && le.Uint32(entries[pos:]) != 0; {
+		nameLen := int(entries[pos])
+		index := entries[pos+1]
+		valueOffset := int(le.Uint16(entries[pos+2:]))
+		valueSize := int(le.Uint32(entries[pos+8:]))
+		if pos+16+nameLen > len(entries) {
+			return nil
+		}
+		if index == xattrIndexSystem && string(entries[pos+16:pos+16+nameLen]) == "data" {
+			if valueOffset+valueSize > len(entries) {
+				return nil
+			}
+			return entries[valueOffset : valueOffset+valueSize]
+		}
+		pos += (16 + nameLen + 3) &^ 3
+	}
+	return nil
+}
+
+func (i *Inode) IsDir() bool {
+	return i.Mode&modeTypeMask == modeDir
+}
+
+func (i *Inode) IsRegular() bool {
+	return i.Mode&modeTypeMask == modeFile
+}
+
+func (i *Inode) IsSymlink() bool {
+	return i.Mode&modeTypeMask == modeSymlink
+}
+
+// FileMode converts the ext4 mode to an io/fs mode
+func (i *Inode) FileMode() fs.FileMode {
+	mode := fs.FileMode(i.Mode & 0777)
+	switch i.Mode & modeTypeMask {
+	case modeDir:
+		mode |= fs.ModeDir
+	case modeSymlink:
+		mode |= fs.ModeSymlink
+	case modeChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case modeBlock:
+		mode |= fs.ModeDevice
+	case modeFifo:
+		mode |= fs.ModeNamedPipe
+	case modeSocket:
+		mode |= fs.ModeSocket
+	}
+	if i.Mode&0x800 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if i.Mode&0x400 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if i.Mode&0x200 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// inodeOffset returns the byte offset of an inode on the device
+func (f *FileSystem) inodeOffset(number uint32) (int64, error) {
+	if number == 0 || number > f.sb.InodesCount {
+		return 0, fmt.Errorf("invalid inode %d", number)
+	}
+	group := (number - 1) / f.sb.InodesPerGroup
+	index := (number - 1) % f.sb.InodesPerGroup
+	table := f.groups[group].InodeTable
+	return int64(table)*f.blockSize + int64(index)*int64(f.sb.InodeSize), nil
+}
+
+func (f *FileSystem) readInode(number uint32) (*Inode, error) {
+	offset, err := f.inodeOffset(number)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, f.sb.InodeSize)
+	if _, err := f.dev.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("can't read inode %d: %s", number, err)
+	}
+	return parseInode(number, buf), nil
+}
+
+// inodeSeed is the checksum seed of inode metadata, directory blocks and
+// extent blocks
+func (f *FileSystem) inodeSeed(inode *Inode) uint32 {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], inode.Number)
+	crc := crc32c(f.sb.ChecksumSeed, buf[:])
+	binary.LittleEndian.PutUint32(buf[:], inode.Generation)
+	return crc32c(crc, buf[:])
+}
+
+// marshal updates the raw inode from the parsed fields
+func (i *Inode) marshal() {
+	le := binary.LittleEndian
+	b := i.raw
+	le.PutUint16(b[0:], i.Mode)
+	le.PutUint16(b[2:], uint16(i.UID))
+	le.PutUint16(b[120:], uint16(i.UID>>16))
+	le.PutUint16(b[24:], uint16(i.GID))
+	le.PutUint16(b[122:], uint16(i.GID>>16))
+	le.PutUint32(b[4:], uint32(i.Size))
+	le.PutUint32(b[108:], uint32(i.Size>>32))
+	le.PutUint16(b[26:], i.Links)
+	le.PutUint32(b[32:], i.Flags)
+	encodeTime(b, 8, 140, i.Atime)
+	encodeTime(b, 12, 132, i.Ctime)
+	encodeTime(b, 16, 136, i.Mtime)
+	le.PutUint32(b[28:], uint32(i.Blocks))
+	le.PutUint16(b[116:], uint16(i.Blocks>>32))
+	le.PutUint32(b[104:], uint32(i.FileACL))
+	le.PutUint16(b[118:], uint16(i.FileACL>>32))
+	le.PutUint32(b[100:], i.Generation)
+	copy(b[40:100], i.block[:])
+}
+
+func (f *FileSystem) inodeChecksum(inode *Inode) uint32 {
+	b := append([]byte(nil), inode.raw...)
+	b[124], b[125] = 0, 0
+	if fitsInInode(b, 130, 2) {
+		b[130], b[131] = 0, 0
+	}
+	return crc32c(f.inodeSeed(inode), b)
+}
+
+func (f *FileSystem) writeInode(inode *Inode) error {
+	if f.rw == nil {
+		return errReadOnly
+	}
+	offset, err := f.inodeOffset(inode.Number)
+	if err != nil {
+		return err
+	}
+	inode.marshal()
+	if f.sb.hasMetadataCsum() {
+		le := binary.LittleEndian
+		csum := f.inodeChecksum(inode)
+		le.PutUint16(inode.raw[124:], uint16(csum))
+		if fitsInInode(inode.raw, 130, 2) {
+			le.PutUint16(inode.raw[130:], uint16(csum>>16))
+		}
+	}
+	if _, err := f.rw.WriteAt(inode.raw, offset); err != nil {
+		return fmt.Errorf("can't write inode %d: %s", inode.Number, err)
+	}
+	return nil
+}
+
+// newInode returns an empty in-memory inode, the caller sets the mapping
+func (f *FileSystem) newInode(number uint32, mode uint16, attr Attr) *Inode {
+	raw := make([]byte, f.sb.InodeSize)
+	if len(raw) > goodOldInodeSize {
+		// i_extra_isize covers the extra timestamps, crtime and checksum
+		extra := f.sb.WantExtraIsize
+		if extra == 0 || int(extra)+goodOldInodeSize > len(raw) {
+			extra = uint16(len(raw) - goodOldInodeSize)
+			if extra > 32 {
+				extra = 32
+			}
+		}
+		binary.LittleEndian.PutUint16(raw[goodOldInodeSize:], extra)
+	}
+	t := attr.ModTime
+	if t.IsZero() {
+		t = f.sources.now()
+	}
+	inode := &Inode{
+		Number: number,
+		Mode:   mode,
+		UID:    attr.UID,
+		GID:    attr.GID,
+		Atime:  t,
+		Ctime:  t,
+		Mtime:  t,
+		raw:    raw,
+	}
+	if fitsInInode(raw, 144, 4) {
+		encodeTime(raw, 144, 148, t)
+	}
+	return inode
+}
+
+// modeBits converts the permission bits of an io/fs mode
+func modeBits(mode fs.FileMode) uint16 {
+	bits := uint16(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 0x800
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 0x400
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 0x200
+	}
+	return bits
+}
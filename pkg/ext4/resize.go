@@ -0,0 +1,238 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// resizeInode maps the reserved group descriptor blocks
+const resizeInode = 7
+
+// minGroupData is the number of free blocks a new last group needs after
+// its metadata, smaller groups are left out like resize2fs does
+const minGroupData = 50
+
+// inodeTableBlocks is the size of the inode table of one group
+func (f *FileSystem) inodeTableBlocks() uint64 {
+	return (uint64(f.sb.InodesPerGroup)*uint64(f.sb.InodeSize) + uint64(f.blockSize) - 1) / uint64(f.blockSize)
+}
+
+// GrowLimit returns the largest size in blocks the file system can grow to
+// without adding group descriptor blocks
+func (f *FileSystem) GrowLimit() uint64 {
+	groups := f.gdtBlocks() * (uint64(f.blockSize) / uint64(f.sb.DescSize))
+	limit := uint64(f.sb.FirstDataBlock) + groups*uint64(f.sb.BlocksPerGroup)
+	if f.sb.FeatureIncompat&incompat64Bit == 0 && limit > math.MaxUint32 {
+		limit = math.MaxUint32
+	}
+	return limit
+}
+
+// Grow extends the file system to the given number of blocks, the device
+// has to be large enough already. New groups keep their metadata at the
+// start of the group. Growing past GrowLimit is left to resize2fs.
+func (f *FileSystem) Grow(blocks uint64) error {
+	if f.rw == nil {
+		return errReadOnly
+	}
+	if blocks < f.sb.BlocksCount {
+		return fmt.Errorf("can't shrink the file system from %d to %d blocks", f.sb.BlocksCount, blocks)
+	}
+	if limit := f.GrowLimit(); blocks > limit {
+		return fmt.Errorf("can't grow the file system to %d blocks, the group descriptor table has room for %d blocks", blocks, limit)
+	}
+	last := uint32((blocks - uint64(f.sb.FirstDataBlock) - 1) / uint64(f.sb.BlocksPerGroup))
+	if last >= f.sb.GroupCount() && blocks-f.groupStart(last) < f.groupOverhead(last)+minGroupData {
+		blocks = f.groupStart(last)
+	}
+	if blocks <= f.sb.BlocksCount {
+		return nil
+	}
+	buf := make([]byte, f.blockSize)
+	if _, err := f.dev.ReadAt(buf, int64(blocks-1)*f.blockSize); err != nil {
+		return fmt.Errorf("device too small for %d blocks: %s", blocks, err)
+	}
+
+	// the tail of the last group becomes free, its bitmap is loaded with
+	// the old size
+	oldBlocks := f.sb.BlocksCount
+	oldGroups := f.sb.GroupCount()
+	tail := oldGroups - 1
+	bitmap, err := f.blockBitmap(tail)
+	if err != nil {
+		return err
+	}
+	oldTail := f.groupBlocks(tail)
+	f.sb.BlocksCount = blocks
+	newTail := f.groupBlocks(tail)
+	for i := oldTail; i < newTail; i++ {
+		clearBit(bitmap, i)
+	}
+	f.groups[tail].FreeBlocksCount += newTail - oldTail
+	f.sb.FreeBlocksCount += uint64(newTail - oldTail)
+	f.dirty[tail] = true
+
+	for group := oldGroups; group < f.sb.GroupCount(); group++ {
+		if err := f.addGroup(group); err != nil {
+			return err
+		}
+	}
+	if err := f.growResizeInode(oldGroups); err != nil {
+		return err
+	}
+
+	le := binary.LittleEndian
+	b := f.sb.raw
+	// keep the share of reserved blocks
+	reserved := uint64(le.Uint32(b[8:]))
+	if f.sb.FeatureIncompat&incompat64Bit != 0 {
+		reserved |= uint64(le.Uint32(b[340:])) << 32
+	}
+	hi, lo := bits.Mul64(reserved, blocks)
+	reserved, _ = bits.Div64(hi, lo, oldBlocks)
+	le.PutUint32(b[8:], uint32(reserved))
+	le.PutUint32(b[4:], uint32(blocks))
+	if f.sb.FeatureIncompat&incompat64Bit != 0 {
+		le.PutUint32(b[340:], uint32(reserved>>32))
+		le.PutUint32(b[336:], uint32(blocks>>32))
+	}
+	le.PutUint32(b[0:], f.sb.InodesCount)
+	if overhead := le.Uint32(b[584:]); overhead != 0 {
+		for group := oldGroups; group < f.sb.GroupCount(); group++ {
+			overhead += uint32(f.groupOverhead(group))
+		}
+		le.PutUint32(b[584:], overhead)
+	}
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.writeBackups()
+}
+
+// groupOverhead is the number of metadata blocks of a group with its
+// metadata in the group
+func (f *FileSystem) groupOverhead(group uint32) uint64 {
+	overhead := 2 + f.inodeTableBlocks()
+	if f.sb.hasSuper(group) {
+		overhead += 1 + f.gdtBlocks() + uint64(f.sb.ReservedGdtBlocks)
+	}
+	return overhead
+}
+
+// addGroup initializes a new group after the block count was raised
+func (f *FileSystem) addGroup(group uint32) error {
+	start := f.groupStart(group)
+	blocks := f.groupBlocks(group)
+	overhead := f.groupOverhead(group)
+	metadata := start + overhead - 2 - f.inodeTableBlocks()
+	gd := groupDescriptor{
+		BlockBitmap:     metadata,
+		InodeBitmap:     metadata + 1,
+		InodeTable:      metadata + 2,
+		FreeBlocksCount: blocks - uint32(overhead),
+		FreeInodesCount: f.sb.InodesPerGroup,
+	}
+	if f.hasGroupChecksum() {
+		// the kernel zeroes the inode table lazily
+		gd.Flags = bgInodeUninit
+		gd.ItableUnused = f.sb.InodesPerGroup
+	} else {
+		zero := make([]byte, f.blockSize)
+		for i := uint64(0); i < f.inodeTableBlocks(); i++ {
+			if err := f.writeBlock(gd.InodeTable+i, zero); err != nil {
+				return err
+			}
+		}
+	}
+
+	blockBitmap := make([]byte, f.blockSize)
+	for i := uint32(0); i < uint32(overhead); i++ {
+		setBit(blockBitmap, i)
+	}
+	for i := blocks; i < uint32(f.blockSize)*8; i++ {
+		setBit(blockBitmap, i)
+	}
+	inodeBitmap := make([]byte, f.blockSize)
+	for i := f.sb.InodesPerGroup; i < uint32(f.blockSize)*8; i++ {
+		setBit(inodeBitmap, i)
+	}
+
+	f.groups = append(f.groups, gd)
+	f.gdt = append(f.gdt, make([]byte, f.sb.DescSize)...)
+	f.blockBitmaps[group] = blockBitmap
+	f.inodeBitmaps[group] = inodeBitmap
+	f.dirty[group] = true
+	f.sb.FreeBlocksCount += uint64(gd.FreeBlocksCount)
+	f.sb.FreeInodesCount += f.sb.InodesPerGroup
+	f.sb.InodesCount += f.sb.InodesPerGroup
+	return nil
+}
+
+// growResizeInode adds the reserved group descriptor blocks of new backup
+// groups to the resize inode. Each primary reserved block lists its copies
+// in the backup groups.
+func (f *FileSystem) growResizeInode(oldGroups uint32) error {
+	if f.sb.FeatureCompat&compatResizeInode == 0 || f.sb.ReservedGdtBlocks == 0 {
+		return nil
+	}
+	inode, err := f.readInode(resizeInode)
+	if err != nil {
+		return err
+	}
+	index, added := 0, 0
+	for group := uint32(1); group < f.sb.GroupCount(); group++ {
+		if !f.sb.hasSuper(group) {
+			continue
+		}
+		if group < oldGroups {
+			index++
+			continue
+		}
+		if uint64(index) >= uint64(f.blockSize)/4 {
+			return fmt.Errorf("too many backup groups for the resize inode")
+		}
+		for i := uint64(0); i < uint64(f.sb.ReservedGdtBlocks); i++ {
+			primary := f.gdtBlock() + f.gdtBlocks() + i
+			list, err := f.readBlock(primary)
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint32(list[index*4:], uint32(primary+uint64(group)*uint64(f.sb.BlocksPerGroup)))
+			if err := f.writeBlock(primary, list); err != nil {
+				return err
+			}
+		}
+		index++
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+	inode.Blocks += uint64(added) * uint64(f.sb.ReservedGdtBlocks) * uint64(f.blockSize/512)
+	return f.writeInode(inode)
+}
+
+// writeBackups copies the superblock and the group descriptor table to
+// all backup groups
+func (f *FileSystem) writeBackups() error {
+	for group := uint32(1); group < f.sb.GroupCount(); group++ {
+		if !f.sb.hasSuper(group) {
+			continue
+		}
+		start := f.groupStart(group)
+		sb := append([]byte(nil), f.sb.raw...)
+		binary.LittleEndian.PutUint16(sb[90:], uint16(group))
+		if f.sb.hasMetadataCsum() {
+			binary.LittleEndian.PutUint32(sb[1020:], crc32c(^uint32(0), sb[:1020]))
+		}
+		if _, err := f.rw.WriteAt(sb, int64(start)*f.blockSize); err != nil {
+			return fmt.Errorf("can't write superblock backup of group %d: %s", group, err)
+		}
+		if _, err := f.rw.WriteAt(f.gdt, int64(start+1)*f.blockSize); err != nil {
+			return fmt.Errorf("can't write group descriptor backup of group %d: %s", group, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package ext4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGrow(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		grow int64
+	}{
+		{"1k blocks", []string{"-b", "1024"}, 96 << 20},
+		{"4k blocks", []string{"-b", "4096"}, 512 << 20},
+		// the new last group is too small and left out
+		{"small tail", []string{"-b", "4096"}, 128<<20 + 100<<10},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			image := mkfs(t, "16M", "", test.args...)
+			f, err := NewWritable(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := bytes.Repeat([]byte("grow"), 100000)
+			if err := f.WriteFile("before", content, testAttr()); err != nil {
+				t.Fatal(err)
+			}
+			if err := image.Truncate(test.grow); err != nil {
+				t.Fatal(err)
+			}
+			blocks := uint64(test.grow / f.blockSize)
+			if blocks > f.GrowLimit() {
+				t.Fatalf("can't grow to %d blocks, the limit is %d", blocks, f.GrowLimit())
+			}
+			if err := f.Grow(blocks); err != nil {
+				t.Fatal(err)
+			}
+			if f.sb.BlocksCount > blocks || f.sb.BlocksCount+minGroupData+f.groupOverhead(f.sb.GroupCount()) < blocks {
+				t.Errorf("grew to %d blocks, want about %d", f.sb.BlocksCount, blocks)
+			}
+			// fill the new groups
+			large := bytes.Repeat([]byte("after"), int(test.grow/2/5))
+			if err := f.WriteFile("after", large, testAttr()); err != nil {
+				t.Fatal(err)
+			}
+			fsck(t, image)
+
+			reopened, err := New(image)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range map[string][]byte{"before": content, "after": large} {
+				got, err := reopened.ReadFile(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s changed", name)
+				}
+			}
+			if err := f.Grow(f.sb.BlocksCount - 1); err == nil {
+				t.Error("shrinking succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const superblockOffset = 1024
+const superblockSize = 1024
+const superblockMagic = 0xEF53
+
+const (
+	compatHasJournal   = 0x4
+	compatExtAttr      = 0x8
+	compatResizeInode  = 0x10
+	compatDirIndex     = 0x20
+	compatSparseSuper2 = 0x200
+)
+
+const (
+	incompatFiletype   = 0x2
+	incompatRecover    = 0x4
+	incompatJournalDev = 0x8
+	incompatMetaBG     = 0x10
+	incompatExtents    = 0x40
+	incompat64Bit      = 0x80
+	incompatMMP        = 0x100
+	incompatFlexBG     = 0x200
+	incompatCsumSeed   = 0x2000
+	incompatLargeDir   = 0x4000
+	incompatInlineData = 0x8000
+	incompatEncrypt    = 0x10000
+)
+
+const (
+	roCompatSparseSuper  = 0x1
+	roCompatLargeFile    = 0x2
+	roCompatHugeFile     = 0x8
+	roCompatGdtCsum      = 0x10
+	roCompatDirNlink     = 0x20
+	roCompatExtraIsize   = 0x40
+	roCompatBigalloc     = 0x200
+	roCompatMetadataCsum = 0x400
+)
+
+// roCompatWritable are the read-only compatible features this package keeps
+// consistent when writing, e.g. quota or orphan files are not
+const roCompatWritable = roCompatSparseSuper | roCompatLargeFile | roCompatHugeFile | roCompatGdtCsum |
+	roCompatDirNlink | roCompatExtraIsize | roCompatMetadataCsum
+
+const (
+	flagSignedHash   = 0x1
+	flagUnsignedHash = 0x2
+)
+
+// incompatSupported are the incompatible features this package can read
+const incompatSupported = incompatFiletype | incompatRecover | incompatExtents | incompat64Bit |
+	incompatFlexBG | incompatCsumSeed | incompatLargeDir | incompatInlineData | incompatMMP
+
+// Superblock holds the parts of the ext4 superblock this package uses
+type Superblock struct {
+	InodesCount     uint32
+	BlocksCount     uint64
+	FreeBlocksCount uint64
+	FreeInodesCount uint32
+	FirstDataBlock  uint32
+	BlockSize       uint32
+	BlocksPerGroup  uint32
+	InodesPerGroup  uint32
+	FirstInode      uint32
+	InodeSize       uint16
+	DescSize        uint16
+	FeatureCompat   uint32
+	FeatureIncompat uint32
+	FeatureRoCompat uint32
+	UUID            [16]byte
+	VolumeName      string
+	ChecksumSeed    uint32
+	// ReservedGdtBlocks are reserved for online resizing after each
+	// group descriptor table copy
+	ReservedGdtBlocks uint16
+	WantExtraIsize    uint16
+	HashSeed          [4]uint32
+	Flags             uint32
+	BackupGroups      [2]uint32
+
+	raw []byte
+}
+
+func parseSuperblock(b []byte) (*Superblock, error) {
+	if len(b) < superblockSize {
+		return nil, fmt.Errorf("superblock too short")
+	}
+	le := binary.LittleEndian
+	if le.Uint16(b[56:]) != superblockMagic {
+		return nil, ErrNotExt4
+	}
+	sb := &Superblock{
+		InodesCount:     le.Uint32(b[0:]),
+		BlocksCount:     uint64(le.Uint32(b[4:])),
+		FreeBlocksCount: uint64(le.Uint32(b[12:])),
+		FreeInodesCount: le.Uint32(b[16:]),
+		FirstDataBlock:  le.Uint32(b[20:]),
+		BlockSize:       1024 << le.Uint32(b[24:]),
+		BlocksPerGroup:  le.Uint32(b[32:]),
+		InodesPerGroup:  le.Uint32(b[40:]),
+		FirstInode:      11,
+		InodeSize:       128,
+		DescSize:        32,
+		FeatureCompat:   le.Uint32(b[92:]),
+		FeatureIncompat: le.Uint32(b[96:]),
+		FeatureRoCompat: le.Uint32(b[100:]),
+		VolumeName:      strings.TrimRight(string(b[120:136]), "\x00"),
+		raw:             append([]byte(nil), b[:superblockSize]...),
+	}
+	copy(sb.UUID[:], b[104:120])
+	sb.ReservedGdtBlocks = le.Uint16(b[206:])
+	sb.WantExtraIsize = le.Uint16(b[350:])
+	for i := range sb.HashSeed {
+		sb.HashSeed[i] = le.Uint32(b[236+i*4:])
+	}
+	sb.Flags = le.Uint32(b[352:])
+	sb.BackupGroups[0] = le.Uint32(b[588:])
+	sb.BackupGroups[1] = le.Uint32(b[592:])
+	// revision 0 file systems have fixed inode sizes
+	if le.Uint32(b[76:]) >= 1 {
+		sb.FirstInode = le.Uint32(b[84:])
+		sb.InodeSize = le.Uint16(b[88:])
+	}
+	if sb.FeatureIncompat&incompat64Bit != 0 {
+		sb.BlocksCount |= uint64(le.Uint32(b[336:])) << 32
+		sb.FreeBlocksCount |= uint64(le.Uint32(b[344:])) << 32
+		if size := le.Uint16(b[254:]); size >= 64 {
+			sb.DescSize = size
+		}
+	}
+	if sb.FeatureIncompat&incompatCsumSeed != 0 {
+		sb.ChecksumSeed = le.Uint32(b[624:])
+	} else {
+		sb.ChecksumSeed = crc32c(^uint32(0), sb.UUID[:])
+	}
+	if sb.BlocksPerGroup == 0 || sb.InodesPerGroup == 0 {
+		return nil, fmt.Errorf("invalid superblock geometry")
+	}
+	if unsupported := sb.FeatureIncompat &^ incompatSupported; unsupported != 0 {
+		return nil, fmt.Errorf("unsupported ext4 features 0x%x", unsupported)
+	}
+	if sb.FeatureRoCompat&roCompatBigalloc != 0 {
+		return nil, fmt.Errorf("unsupported ext4 feature bigalloc")
+	}
+	return sb, nil
+}
+
+// GroupCount is the number of block groups
+func (sb *Superblock) GroupCount() uint32 {
+	blocks := sb.BlocksCount - uint64(sb.FirstDataBlock)
+	return uint32((blocks + uint64(sb.BlocksPerGroup) - 1) / uint64(sb.BlocksPerGroup))
+}
+
+func (sb *Superblock) hasMetadataCsum() bool {
+	return sb.FeatureRoCompat&roCompatMetadataCsum != 0
+}
+
+// checkWritable returns an error for features this package can't keep
+// consistent
+func (sb *Superblock) checkWritable() error {
+	if sb.FeatureIncompat&incompatRecover != 0 {
+		return fmt.Errorf("file system needs journal recovery")
+	}
+	if sb.FeatureIncompat&incompatMMP != 0 {
+		return fmt.Errorf("unsupported ext4 feature mmp for writing")
+	}
+	if unsupported := sb.FeatureRoCompat &^ roCompatWritable; unsupported != 0 {
+		return fmt.Errorf("unsupported ext4 features 0x%x for writing", unsupported)
+	}
+	return nil
+}
+
+// hasSuper checks if a group holds a superblock and group descriptor backup
+func (sb *Superblock) hasSuper(group uint32) bool {
+	if group == 0 {
+		return true
+	}
+	if sb.FeatureCompat&compatSparseSuper2 != 0 {
+		return group == sb.BackupGroups[0] || group == sb.BackupGroups[1]
+	}
+	if group == 1 || sb.FeatureRoCompat&roCompatSparseSuper == 0 {
+		return true
+	}
+	if group&1 == 0 {
+		return false
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < group {
+			n *= base
+		}
+		if n == group {
+			return true
+		}
+	}
+	return false
+}
+
+// marshal updates the free counts and the checksum of the raw superblock
+func (sb *Superblock) marshal() []byte {
+	le := binary.LittleEndian
+	b := sb.raw
+	le.PutUint32(b[12:], uint32(sb.FreeBlocksCount))
+	le.PutUint32(b[16:], sb.FreeInodesCount)
+	if sb.FeatureIncompat&incompat64Bit != 0 {
+		le.PutUint32(b[344:], uint32(sb.FreeBlocksCount>>32))
+	}
+	if sb.hasMetadataCsum() {
+		le.PutUint32(b[1020:], crc32c(^uint32(0), b[:1020]))
+	}
+	return b
+}
@@ -0,0 +1,442 @@
+package ext4
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+var errReadOnly = errors.New("read-only file system")
+
+// Sources are the clock and random source of a writable file system, they
+// can be replaced for reproducible images. The zero value uses time.Now and
+// crypto/rand.
+type Sources struct {
+	// Now returns the timestamp of new inodes without an explicit ModTime
+	Now func() time.Time
+	// Rand is the source of UUIDs and hash seeds of new file systems
+	Rand io.Reader
+}
+
+func (s Sources) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+func (s Sources) rand() io.Reader {
+	if s.Rand == nil {
+		return rand.Reader
+	}
+	return s.Rand
+}
+
+// Device is a writable block device, e.g. a partition of a disk image
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// Attr are the ownership, permissions and modification time of new files,
+// directories and symlinks
+type Attr struct {
+	Mode    fs.FileMode
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+}
+
+const xattrMagic = 0xEA020000
+
+// NewWritable opens the ext4 file system on dev for reading and writing.
+// Changes bypass the journal, so the journal has to be clean.
+func NewWritable(dev Device) (*FileSystem, error) {
+	f, err := New(dev)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.sb.checkWritable(); err != nil {
+		return nil, err
+	}
+	f.rw = dev
+	f.blockBitmaps = make(map[uint32][]byte)
+	f.inodeBitmaps = make(map[uint32][]byte)
+	f.dirty = make(map[uint32]bool)
+	return f, nil
+}
+
+// SetSources replaces the clock of new and removed inodes
+func (f *FileSystem) SetSources(sources Sources) {
+	f.sources = sources
+}
+
+func (f *FileSystem) writeBlock(block uint64, data []byte) error {
+	if f.rw == nil {
+		return errReadOnly
+	}
+	if block >= f.sb.BlocksCount {
+		return fmt.Errorf("block %d out of range", block)
+	}
+	if _, err := f.rw.WriteAt(data, int64(block)*f.blockSize); err != nil {
+		return fmt.Errorf("can't write block %d: %s", block, err)
+	}
+	return nil
+}
+
+// parent resolves the directory of name and returns it with the base name
+func (f *FileSystem) parent(op, name string) (*Inode, string, error) {
+	if f.rw == nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errReadOnly}
+	}
+	if !fs.ValidPath(name) || name == "." {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if f.sb.FeatureIncompat&incompatExtents == 0 {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("writing needs the extents feature")}
+	}
+	dir, err := f.resolve(path.Dir(name), true)
+	if err != nil {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !dir.IsDir() {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: errNotDir}
+	}
+	return dir, path.Base(name), nil
+}
+
+// notExist returns fs.ErrExist if the directory has an entry name
+func (f *FileSystem) notExist(dir *Inode, name string) error {
+	_, err := f.lookup(dir, name)
+	if err == nil {
+		return fs.ErrExist
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// link adds a new inode to its parent directory and writes everything
+func (f *FileSystem) link(dir *Inode, name string, inode *Inode) error {
+	if err := f.writeInode(inode); err != nil {
+		return err
+	}
+	if err := f.addDirent(dir, name, inode.Number, f.fileType(inode.Mode)); err != nil {
+		return err
+	}
+	return f.flush()
+}
+
+// WriteFile creates or replaces a regular file
+func (f *FileSystem) WriteFile(name string, data []byte, attr Attr) error {
+	return f.CreateFile(name, bytes.NewReader(data), int64(len(data)), attr)
+}
+
+// CreateFile creates or replaces a regular file with size bytes from r
+func (f *FileSystem) CreateFile(name string, r io.Reader, size int64, attr Attr) error {
+	dir, base, err := f.parent("create", name)
+	if err != nil {
+		return err
+	}
+	existing, err := f.lookup(dir, base)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	if err == nil {
+		if existing.IsDir() {
+			return &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+		}
+		if err := f.unlink(dir, base, existing); err != nil {
+			return &fs.PathError{Op: "create", Path: name, Err: err}
+		}
+	}
+	inode, err := f.writeData(dir, r, size, modeFile|modeBits(attr.Mode), attr)
+	if err != nil {
+		return &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	if err := f.link(dir, base, inode); err != nil {
+		return &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+	return nil
+}
+
+// writeData allocates an inode and blocks near dir and writes the content
+func (f *FileSystem) writeData(dir *Inode, r io.Reader, size int64, mode uint16, attr Attr) (*Inode, error) {
+	number, err := f.allocInode(f.inodeGroup(dir.Number), false)
+	if err != nil {
+		return nil, err
+	}
+	inode := f.newInode(number, mode, attr)
+	inode.Links = 1
+	inode.Size = uint64(size)
+	blocks := (uint64(size) + uint64(f.blockSize) - 1) / uint64(f.blockSize)
+	var runs []extent
+	fail := func(err error) (*Inode, error) {
+		f.freeExtents(runs)
+		f.freeInode(number, false)
+		return nil, err
+	}
+	if blocks > 0 {
+		if runs, err = f.allocBlocks(f.groupStart(f.inodeGroup(number)), blocks); err != nil {
+			return fail(err)
+		}
+	}
+	buf := make([]byte, 1024*1024)
+	remaining := size
+	for _, run := range runs {
+		offset := int64(run.Start) * f.blockSize
+		end := offset + int64(run.Length)*f.blockSize
+		for offset < end {
+			chunk := buf[:minInt64(int64(len(buf)), end-offset)]
+			n, err := io.ReadFull(r, chunk[:minInt64(int64(len(chunk)), remaining)])
+			if err != nil {
+				return fail(fmt.Errorf("short read after %d bytes: %s", size-remaining+int64(n), err))
+			}
+			remaining -= int64(n)
+			for i := n; i < len(chunk); i++ {
+				chunk[i] = 0
+			}
+			if _, err := f.rw.WriteAt(chunk, offset); err != nil {
+				return fail(err)
+			}
+			offset += int64(len(chunk))
+		}
+	}
+	inode.Blocks = blocks * uint64(f.blockSize/512)
+	if err := f.setExtents(inode, appendExtents(nil, 0, runs)); err != nil {
+		return fail(err)
+	}
+	return inode, nil
+}
+
+// Mkdir creates a directory, the parent has to exist
+func (f *FileSystem) Mkdir(name string, attr Attr) error {
+	dir, base, err := f.parent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := f.notExist(dir, base); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if err := f.mkdir(dir, base, attr); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (f *FileSystem) mkdir(dir *Inode, name string, attr Attr) error {
+	number, err := f.allocInode(f.inodeGroup(dir.Number), true)
+	if err != nil {
+		return err
+	}
+	runs, err := f.allocBlocks(f.groupStart(f.inodeGroup(number)), 1)
+	if err != nil {
+		f.freeInode(number, true)
+		return err
+	}
+	inode := f.newInode(number, modeDir|modeBits(attr.Mode), attr)
+	inode.Links = 2
+	inode.Size = uint64(f.blockSize)
+	inode.Blocks = uint64(f.blockSize / 512)
+	if err := f.setExtents(inode, appendExtents(nil, 0, runs)); err != nil {
+		return err
+	}
+
+	data := f.newDirBlock()
+	usable := int(f.blockSize) - f.dirTail()
+	putDirent(data, number, 12, ".", f.fileType(modeDir))
+	putDirent(data[12:], dir.Number, usable-12, "..", f.fileType(modeDir))
+	if err := f.writeDirBlock(inode, runs[0].Start, data); err != nil {
+		return err
+	}
+
+	// ".." links the parent, dir_nlink uses 1 for directories with too many
+	// subdirectories
+	if dir.Links > 1 && dir.Links < linkMax-1 {
+		dir.Links++
+	} else if f.sb.FeatureRoCompat&roCompatDirNlink != 0 {
+		dir.Links = 1
+	}
+	if err := f.writeInode(dir); err != nil {
+		return err
+	}
+	return f.link(dir, name, inode)
+}
+
+// MkdirAll creates a directory and all missing parents with the same attr
+func (f *FileSystem) MkdirAll(name string, attr Attr) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	current := "."
+	for _, part := range splitPath(name) {
+		current = path.Join(current, part)
+		info, err := f.Stat(current)
+		if err == nil {
+			if !info.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: current, Err: errNotDir}
+			}
+			continue
+		}
+		if err := f.Mkdir(current, attr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Symlink creates a symbolic link, the mode of attr is ignored
+func (f *FileSystem) Symlink(target, name string, attr Attr) error {
+	dir, base, err := f.parent("symlink", name)
+	if err != nil {
+		return err
+	}
+	if err := f.notExist(dir, base); err != nil {
+		return &fs.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	var inode *Inode
+	if len(target) < blockPointersSize {
+		// fast symlinks keep the target in i_block
+		number, err := f.allocInode(f.inodeGroup(dir.Number), false)
+		if err != nil {
+			return &fs.PathError{Op: "symlink", Path: name, Err: err}
+		}
+		inode = f.newInode(number, modeSymlink|0777, attr)
+		inode.Links = 1
+		inode.Size = uint64(len(target))
+		copy(inode.block[:], target)
+	} else {
+		inode, err = f.writeData(dir, bytes.NewReader([]byte(target)), int64(len(target)), modeSymlink|0777, attr)
+		if err != nil {
+			return &fs.PathError{Op: "symlink", Path: name, Err: err}
+		}
+	}
+	if err := f.link(dir, base, inode); err != nil {
+		return &fs.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Remove removes a file or symlink, directories are not supported
+func (f *FileSystem) Remove(name string) error {
+	dir, base, err := f.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	inode, err := f.lookup(dir, base)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if inode.IsDir() {
+		return &fs.PathError{Op: "remove", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+	if err := f.unlink(dir, base, inode); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return f.flush()
+}
+
+// unlink removes a directory entry and frees the inode with the last link
+func (f *FileSystem) unlink(dir *Inode, name string, inode *Inode) error {
+	if err := f.removeEntry(dir, name); err != nil {
+		return err
+	}
+	if inode.Links > 1 {
+		inode.Links--
+		return f.writeInode(inode)
+	}
+	if err := f.freeInodeBlocks(inode); err != nil {
+		return err
+	}
+	inode.Links = 0
+	inode.Size = 0
+	inode.Blocks = 0
+	inode.FileACL = 0
+	inode.Flags &^= inodeFlagExtents | inodeFlagInlineData
+	for i := range inode.block {
+		inode.block[i] = 0
+	}
+	t := f.sources.now()
+	inode.Ctime = t
+	binary.LittleEndian.PutUint32(inode.raw[20:], uint32(t.Unix()))
+	if err := f.writeInode(inode); err != nil {
+		return err
+	}
+	return f.freeInode(inode.Number, false)
+}
+
+// freeInodeBlocks frees the data, mapping and extended attribute blocks
+func (f *FileSystem) freeInodeBlocks(inode *Inode) error {
+	switch {
+	case inode.Flags&inodeFlagInlineData != 0:
+	case inode.IsSymlink() && inode.Flags&inodeFlagExtents == 0 && inode.Size < uint64(len(inode.block)):
+		// fast symlink
+	case inode.Flags&inodeFlagExtents != 0:
+		extents, err := f.extents(inode)
+		if err != nil {
+			return err
+		}
+		tree, err := f.treeBlocks(inode.block[:], 0)
+		if err != nil {
+			return err
+		}
+		for _, block := range tree {
+			if err := f.freeBlocks(block, 1); err != nil {
+				return err
+			}
+		}
+		if err := f.freeExtents(extents); err != nil {
+			return err
+		}
+	default:
+		var meta []uint64
+		extents, err := f.blockMap(inode, func(block uint64) { meta = append(meta, block) })
+		if err != nil {
+			return err
+		}
+		for _, block := range meta {
+			if err := f.freeBlocks(block, 1); err != nil {
+				return err
+			}
+		}
+		if err := f.freeExtents(extents); err != nil {
+			return err
+		}
+	}
+	if inode.FileACL != 0 {
+		return f.releaseXattrBlock(inode.FileACL)
+	}
+	return nil
+}
+
+// releaseXattrBlock drops a reference to a shared extended attribute block
+func (f *FileSystem) releaseXattrBlock(block uint64) error {
+	le := binary.LittleEndian
+	data, err := f.readBlock(block)
+	if err != nil {
+		return err
+	}
+	if le.Uint32(data[0:]) != xattrMagic {
+		return fmt.Errorf("invalid extended attribute block %d", block)
+	}
+	refs := le.Uint32(data[4:])
+	if refs <= 1 {
+		return f.freeBlocks(block, 1)
+	}
+	le.PutUint32(data[4:], refs-1)
+	if f.sb.hasMetadataCsum() {
+		var num [8]byte
+		le.PutUint64(num[:], block)
+		le.PutUint32(data[16:], 0)
+		crc := crc32c(f.sb.ChecksumSeed, num[:])
+		le.PutUint32(data[16:], crc32c(crc, data))
+	}
+	return f.writeBlock(block, data)
+}
@@ -0,0 +1,213 @@
+package ext4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+// fsck checks the image with e2fsck without changing it
+func fsck(t *testing.T, image *os.File) {
+	t.Helper()
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	if out, err := exec.Command("e2fsck", "-fn", image.Name()).CombinedOutput(); err != nil {
+		t.Fatalf("e2fsck: %s\n%s", err, out)
+	}
+}
+
+func testAttr() Attr {
+	return Attr{Mode: 0644, UID: 1000, GID: 1000, ModTime: time.Unix(1600000000, 0)}
+}
+
+func TestWriteRemove(t *testing.T) {
+	for _, blockSize := range []string{"1024", "4096"} {
+		t.Run(blockSize, func(t *testing.T) {
+			testWriteRemove(t, mkfs(t, "32M", "", "-b", blockSize))
+		})
+	}
+}
+
+func testWriteRemove(t *testing.T, image *os.File) {
+	f, err := NewWritable(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"etc/hostname":          []byte("pi\n"),
+		"etc/empty":             nil,
+		"var/lib/piccu/large":   bytes.Repeat([]byte("piccu"), 300000),
+		"var/lib/piccu/replace": []byte("old"),
+	}
+	for name, content := range files {
+		if err := f.MkdirAll(path.Dir(name), Attr{Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteFile(name, content, testAttr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files["var/lib/piccu/replace"] = []byte("new")
+	if err := f.WriteFile("var/lib/piccu/replace", files["var/lib/piccu/replace"], testAttr()); err != nil {
+		t.Fatal(err)
+	}
+	// enough entries to need more than one directory block
+	for i := 0; i < 200; i++ {
+		name := fmt.Sprintf("etc/many/file-with-a-long-name-%03d", i)
+		if i == 0 {
+			if err := f.Mkdir("etc/many", Attr{Mode: 0755}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files[name] = []byte(name)
+		if err := f.WriteFile(name, files[name], testAttr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"etc/fast": "hostname",
+		"etc/slow": "/" + string(bytes.Repeat([]byte("long/"), 20)) + "target",
+	}
+	for name, target := range links {
+		if err := f.Symlink(target, name, testAttr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsck(t, image)
+
+	reopened, err := New(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		got, err := reopened.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s has %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+	for name, want := range links {
+		if got, err := reopened.Readlink(name); err != nil || got != want {
+			t.Errorf("%s -> %q (%v), want %q", name, got, err, want)
+		}
+	}
+	info, err := reopened.Stat("etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode() != 0644 || !info.ModTime().Equal(testAttr().ModTime) {
+		t.Errorf("etc/hostname: mode %s, mtime %s", info.Mode(), info.ModTime())
+	}
+
+	for _, name := range []string{"var/lib/piccu/large", "etc/slow", "etc/many/file-with-a-long-name-100"} {
+		if err := f.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Lstat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s still exists: %v", name, err)
+		}
+	}
+	if err := f.Remove("etc/many"); err == nil {
+		t.Error("removed a directory")
+	}
+	fsck(t, image)
+}
+
+func TestWriteIndexed(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(path.Join(root, "many"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	name := func(i int) string {
+		return fmt.Sprintf("many/a-file-name-long-enough-to-fill-directory-blocks-quickly-%05d", i)
+	}
+	for i := 0; i < 300; i++ {
+		if err := os.WriteFile(path.Join(root, name(i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	image := mkfs(t, "32M", root, "-b", "1024", "-N", "8192")
+	// e2fsck -D indexes the directory, it exits 1 as it changed the image
+	if _, err := exec.LookPath("e2fsck"); err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	if out, err := exec.Command("e2fsck", "-fyD", image.Name()).CombinedOutput(); err != nil {
+		if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() > 1 {
+			t.Fatalf("e2fsck -D: %s\n%s", err, out)
+		}
+	}
+
+	f, err := NewWritable(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := f.resolve("many", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.Flags&inodeFlagIndex == 0 {
+		t.Skip("e2fsck didn't index the directory")
+	}
+	// enough entries to fill the root index of a 1k block directory, add a
+	// level below it and split the index nodes of that level
+	const count = 3000
+	for i := 300; i < count; i++ {
+		if err := f.WriteFile(name(i), []byte(name(i)), testAttr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsck(t, image)
+
+	reopened, err := New(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = reopened.resolve("many", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents, err := reopened.extents(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := physicalBlock(extents, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dxRoot, err := reopened.readBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels := dxRoot[30]; levels != 1 {
+		t.Errorf("htree has %d indirect levels, want 1", levels)
+	}
+	if nodes := binary.LittleEndian.Uint16(dxRoot[34:]); nodes < 2 {
+		t.Errorf("htree root points to %d index nodes, want them split", nodes)
+	}
+	entries, err := reopened.ReadDir("many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != count {
+		t.Errorf("many has %d entries, want %d", len(entries), count)
+	}
+	for _, i := range []int{0, 299, 300, 1500, count - 1} {
+		got, err := reopened.ReadFile(name(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= 300 && string(got) != name(i) {
+			t.Errorf("%s = %q", name(i), got)
+		}
+	}
+}
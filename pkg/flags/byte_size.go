@@ -0,0 +1,42 @@
+package flags
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a size with an optional binary unit, e.g. 8G or 512M
+type ByteSize int64
+
+var byteUnits = []string{"K", "M", "G", "T"}
+
+func (f *ByteSize) Set(value string) error {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value), "B"), "I")
+	shift := 0
+	for i, unit := range byteUnits {
+		if strings.HasSuffix(number, unit) {
+			number = strings.TrimSuffix(number, unit)
+			shift = 10 * (i + 1)
+		}
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > (1<<62)>>shift {
+		return fmt.Errorf("invalid size %s, expected e.g. 8G", value)
+	}
+	*f = ByteSize(size << shift)
+	return nil
+}
+
+func (f *ByteSize) String() string {
+	size := int64(*f)
+	unit := ""
+	for _, u := range byteUnits {
+		if size == 0 || size%1024 != 0 {
+			break
+		}
+		size /= 1024
+		unit = u
+	}
+	return strconv.FormatInt(size, 10) + unit
+}
@@ -1,24 +1,28 @@
 package ioutils
 
 import (
+	"context"
 	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/klauspost/readahead"
-	"github.com/schollz/progressbar/v3"
+
+	"github.com/rtreffer/piccu/pkg/progress"
 )
 
-func Copy(src, dst string) error {
+// Copy copies src to dst, a partial regular dst is removed if the copy fails
+// or ctx is cancelled. Regular files are cloned if the file system supports
+// it.
+func Copy(ctx context.Context, src, dst string, reporter progress.Reporter) (err error) {
+	reporter = progress.OrSilent(reporter)
 	srcStat, err := os.Stat(src)
 	if err != nil {
 		return err
 	}
-
-	bar := progressbar.DefaultBytes(
-		srcStat.Size(),
-		"copy "+filepath.Base(dst),
-	)
+	// devices have a fixed size, the file system holding them doesn't matter
+	dstStat, err := os.Stat(dst)
+	regular := err != nil || dstStat.Mode().IsRegular()
 
 	in, err := os.OpenFile(src, os.O_RDONLY, os.FileMode(0644))
 	if err != nil {
@@ -26,6 +30,21 @@ func Copy(src, dst string) error {
 	}
 	defer in.Close()
 
+	if regular {
+		if cloned, err := cloneFile(in, dst); err != nil || cloned {
+			if cloned {
+				reporter.Step("cloned " + filepath.Base(src))
+			}
+			return err
+		}
+		if err := CheckFreeSpace(dst, srcStat.Size()); err != nil {
+			return err
+		}
+	}
+
+	transfer := reporter.Transfer("copy "+filepath.Base(src), srcStat.Size())
+	defer transfer.Done()
+
 	ra := readahead.NewReader(in)
 	defer ra.Close()
 
@@ -33,8 +52,32 @@ func Copy(src, dst string) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if dstStat, statErr := os.Stat(dst); err != nil && statErr == nil && dstStat.Mode().IsRegular() {
+			os.Remove(dst)
+		}
+	}()
 
-	_, err = io.Copy(io.MultiWriter(out, bar), ra)
-	out.Close()
+	_, err = io.Copy(io.MultiWriter(out, transfer), ContextReader(ctx, ra))
 	return err
 }
+
+// cloneFile tries to clone in into the regular file dst, it returns false
+// if the file system can't clone
+func cloneFile(in *os.File, dst string) (bool, error) {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return false, err
+	}
+	if err := Clone(out, in); err != nil {
+		return false, out.Close()
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,34 @@
+package ioutils
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to unprivileged users on the file
+// system holding dir
+func FreeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// CheckFreeSpace fails if the file system of file can't hold size more
+// bytes, a negative size is unknown and always fits
+func CheckFreeSpace(file string, size int64) error {
+	if size < 0 {
+		return nil
+	}
+	dir := filepath.Dir(file)
+	free, err := FreeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if uint64(size) > free {
+		return fmt.Errorf("not enough space in %s for %s: %d bytes needed, %d bytes free", dir, filepath.Base(file), size, free)
+	}
+	return nil
+}
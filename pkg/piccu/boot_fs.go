@@ -0,0 +1,174 @@
+package piccu
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	blockfile "go.fuchsia.dev/fuchsia/src/lib/thinfs/block/file"
+	"go.fuchsia.dev/fuchsia/src/lib/thinfs/fs"
+	"go.fuchsia.dev/fuchsia/src/lib/thinfs/fs/msdosfs"
+	"go.fuchsia.dev/fuchsia/src/lib/thinfs/fs/msdosfs/clock"
+	"go.fuchsia.dev/fuchsia/src/lib/thinfs/fs/msdosfs/direntry"
+)
+
+// bootFS is the FAT file system of the boot partition
+type bootFS interface {
+	ReadFile(path string) ([]byte, error)
+	ReadDir(path string) ([]DirEntry, error)
+	WriteFile(path string, payload []byte) error
+	Close() error
+}
+
+// thinfsClock guards the package wide clock of thinfs, it is set to the
+// clock of the build that writes while thinfs runs
+var thinfsClock sync.Mutex
+
+// thinFS serves FAT16 and FAT32 boot partitions through thinfs
+type thinFS struct {
+	block   *blockfile.File
+	fs      fs.FileSystem
+	sources Sources
+}
+
+func newThinFS(dev *partitionDevice, blockSize int64, readOnly bool, sources Sources) (*thinFS, error) {
+	block, err := blockfile.NewRange(dev.file, blockSize, dev.offset, dev.size)
+	if err != nil {
+		return nil, err
+	}
+	fsFlags := fs.ReadWrite
+	if readOnly {
+		fsFlags = fs.ReadOnly
+	}
+	fsys, err := msdosfs.New("/", block, fsFlags)
+	if err != nil {
+		return nil, err
+	}
+	return &thinFS{block: block, fs: fsys, sources: sources}, nil
+}
+
+// clocked runs fn with the thinfs clock set to the clock of t
+func (t *thinFS) clocked(fn func() error) error {
+	thinfsClock.Lock()
+	defer thinfsClock.Unlock()
+	previous := clock.Now
+	clock.Now = t.sources.fatNow
+	defer func() { clock.Now = previous }()
+	return fn()
+}
+
+// Close unmounts the file system and flushes the block backend, the image
+// closes the underlying file
+func (t *thinFS) Close() error {
+	fsErr := t.clocked(t.fs.Close)
+	if err := t.block.Flush(); err != nil {
+		return err
+	}
+	return fsErr
+}
+
+// storedName returns the name of an existing file in the root directory,
+// FAT names are case insensitive but thinfs looks them up case sensitive
+func (t *thinFS) storedName(path string) string {
+	if strings.Contains(path, "/") {
+		return path
+	}
+	if entries, err := t.ReadDir("."); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir && strings.EqualFold(entry.Name, path) {
+				return entry.Name
+			}
+		}
+	}
+	return path
+}
+
+func (t *thinFS) WriteFile(path string, payload []byte) error {
+	return t.clocked(func() error { return t.writeFile(path, payload) })
+}
+
+func (t *thinFS) writeFile(path string, payload []byte) (err error) {
+	path = t.storedName(path)
+	t.fs.RootDirectory().Unlink(path)
+	file, _, _, err := t.fs.RootDirectory().Open(path, fs.OpenFlagCreate|fs.OpenFlagWrite|fs.OpenFlagFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		syncErr := file.Sync()
+		closeErr := file.Close()
+		if err == nil && syncErr != nil {
+			err = fmt.Errorf("can't sync %s: %s", path, syncErr)
+		}
+		if err == nil && closeErr != nil {
+			err = fmt.Errorf("can't close %s: %s", path, closeErr)
+		}
+	}()
+	n, err := file.Write(payload, 0, fs.WhenceFromStart)
+	if err != nil {
+		return err
+	}
+	if n != len(payload) {
+		return fmt.Errorf("expected to write %d, wrote %d", len(payload), n)
+	}
+	return nil
+}
+
+func (t *thinFS) ReadFile(path string) ([]byte, error) {
+	file, _, _, err := t.fs.RootDirectory().Open(t.storedName(path), fs.OpenFlagRead|fs.OpenFlagFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, _, _, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size)
+	for n := 0; n < len(payload); {
+		read, err := file.Read(payload[n:], int64(n), fs.WhenceFromStart)
+		n += read
+		if err != nil && n < len(payload) {
+			return nil, err
+		}
+		if read == 0 && n < len(payload) {
+			return nil, fmt.Errorf("expected to read %d, read %d", len(payload), n)
+		}
+	}
+	return payload, nil
+}
+
+func (t *thinFS) ReadDir(path string) ([]DirEntry, error) {
+	dir := t.fs.RootDirectory()
+	if path != "" && path != "/" && path != "." {
+		_, opened, _, err := dir.Open(path, fs.OpenFlagRead|fs.OpenFlagDirectory)
+		if err != nil {
+			return nil, err
+		}
+		defer opened.Close()
+		dir = opened
+	}
+	dirents, err := dir.Read()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DirEntry, 0, len(dirents))
+	for _, dirent := range dirents {
+		name := dirent.GetName()
+		if name == "." || name == ".." {
+			continue
+		}
+		entry := DirEntry{
+			Name:  name,
+			IsDir: dirent.GetType() == fs.FileTypeDirectory,
+		}
+		if d, ok := dirent.(*direntry.Dirent); ok {
+			entry.ModTime = d.WriteTime
+			if !entry.IsDir {
+				entry.Size = int64(d.Size)
+			}
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
@@ -0,0 +1,180 @@
+package piccu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+)
+
+// BuildKeySuffix names the file next to an output that holds its build key
+const BuildKeySuffix = ".buildkey"
+
+// buildKey hashes everything that ends up in the output: the base image,
+// the generated files, the boot and root files, the edits and options and
+// the piccu version. Builds with the same key write the same image.
+func (b *build) buildKey() (string, error) {
+	hash := sha256.New()
+	field := func(name, value string) {
+		fmt.Fprintf(hash, "%s %d\n%s\n", name, len(value), value)
+	}
+	field("version", GetVersion())
+	field("base-image", b.baseImageKey)
+	field("user-data", b.userDataKey)
+	field("vendor-data", b.vendorDataKey)
+	field("meta-data", b.metaData)
+	field("network-config", b.networkConfig)
+	for _, bootfile := range b.BootFiles {
+		content, err := os.ReadFile(bootfile)
+		if err != nil {
+			return "", err
+		}
+		field("boot-file "+filepath.Base(bootfile), string(content))
+	}
+	field("boot-partition", fmt.Sprint(b.BootPartition))
+	field("config.txt", b.ConfigTxtEdits.String())
+	field("cmdline.txt", b.CmdlineEdits.String())
+	for _, file := range b.RootFiles {
+		field("root-file", file.String())
+		if err := hashTree(hash, file.Source); err != nil {
+			return "", err
+		}
+	}
+	for _, partition := range b.DataPartitions {
+		field("partition", partition.String())
+		if partition.Source != "" {
+			if err := hashTree(hash, partition.Source); err != nil {
+				return "", err
+			}
+		}
+	}
+	field("size", fmt.Sprintf("%d %t", b.Size, b.GrowRootFS))
+	field("disk-id", string(b.DiskID))
+	if b.Reproducible {
+		epoch, err := SourceDateEpoch()
+		if err != nil {
+			return "", err
+		}
+		field("reproducible", fmt.Sprint(epoch.Unix()))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// archiveKey describes a user-data or vendor-data archive by its parts and
+// the metadata of an extracted archive among the inputs. Unlike the archive
+// it doesn't change with the random MIME boundary.
+func archiveKey(inputs []string, files cicci.ExpandedFiles) (string, error) {
+	var key strings.Builder
+	metadata, err := cicci.LoadArchiveMetadata(inputs)
+	if err != nil {
+		return "", err
+	}
+	if metadata != nil {
+		content, err := yaml.Marshal(metadata)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&key, "metadata %d\n%s\n", len(content), content)
+	}
+	for _, file := range files {
+		fmt.Fprintf(&key, "part %s %s %s %t %d\n%s\n", file.Filename, file.ContentType, file.MergeType, file.IsScript, len(file.Content), file.Content)
+	}
+	return key.String(), nil
+}
+
+// hashTree writes the names, modes and contents of a file or directory to w
+func hashTree(w io.Writer, root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %s\n", filepath.ToSlash(path), info.Mode())
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(w, target)
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			if _, err := io.Copy(w, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkBuildKey computes the build key and skips the rest of the build if
+// it matches the one of the existing outputs, unless Force is set. Devices
+// are always written.
+func (b *build) checkBuildKey() error {
+	if b.output == b.target {
+		return nil
+	}
+	key, err := b.buildKey()
+	if err != nil {
+		return stageError(StageInput, err, "can't compute the build key")
+	}
+	b.summary.BuildKey = key
+	b.keyFile = b.summary.Output + BuildKeySuffix
+	if b.Force {
+		return nil
+	}
+	existing, err := os.ReadFile(b.keyFile)
+	if err != nil || strings.TrimSpace(string(existing)) != key {
+		return nil
+	}
+	for _, path := range b.outputPaths() {
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	b.upToDate = true
+	return nil
+}
+
+// outputPaths returns the files the formats of the build write
+func (b *build) outputPaths() []string {
+	if len(b.Formats) == 0 {
+		return []string{b.summary.Output}
+	}
+	paths := make([]string, 0, len(b.Formats))
+	for _, format := range b.Formats {
+		paths = append(paths, format.Path(b.summary.Output))
+	}
+	return paths
+}
+
+// saveBuildKey writes the build key next to the outputs
+func (b *build) saveBuildKey() error {
+	if b.keyFile == "" {
+		return nil
+	}
+	output, err := newOutputFile(b.keyFile, false)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(output.Path, []byte(b.summary.BuildKey+"\n"), 0644); err != nil {
+		output.Abort()
+		return err
+	}
+	return output.Commit()
+}
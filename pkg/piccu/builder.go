@@ -0,0 +1,884 @@
+package piccu
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/ioutils"
+	"github.com/rtreffer/piccu/pkg/progress"
+)
+
+// DefaultRelease is the image built when Builder.Release is empty
+const DefaultRelease = "jammy:arm64"
+
+// DefaultRefresh is how long cached images without checksum are used
+const DefaultRefresh = 7 * 24 * time.Hour
+
+// Builder builds an image from a cached ubuntu image and cloud-config
+// inputs. The zero value builds DefaultRelease from the current directory
+// into disk.img.
+type Builder struct {
+	// Release is the key of the ubuntu image, e.g. jammy:arm64
+	Release string
+	// BaseImage is a local image file used instead of Release
+	BaseImage string
+	// CacheDir holds downloaded images, default .cache
+	CacheDir string
+	// Refresh is the age after which images without checksum are fetched
+	// again, default DefaultRefresh
+	Refresh time.Duration
+	// LockTimeout is how long to wait for another process fetching the same
+	// image, default DefaultLockTimeout
+	LockTimeout time.Duration
+
+	// Inputs are files, directories or globs merged into user-data
+	Inputs []string
+	// InputFS is merged into user-data instead of Inputs if set
+	InputFS fs.FS
+	// ExcludeInputs are files Inputs may contain that are never merged, e.g.
+	// a project or inventory file with a custom name
+	ExcludeInputs []string
+	// VendorInputs are files, directories or globs merged into vendor-data
+	VendorInputs []string
+	// NetworkConfig is a network-config file or template
+	NetworkConfig string
+	// MetaData is a meta-data file or template with extra keys
+	MetaData string
+	// MetaDataSet sets meta-data keys, they override MetaData
+	MetaDataSet map[string]string
+	// Hostname is the local-hostname, default the cloud-config hostname
+	Hostname string
+	// Secrets are the template keys, they override the facts of the image
+	Secrets map[string]string
+
+	// BootFiles are copied into the boot partition
+	BootFiles []string
+	// BootPartition is the 1 based index of the boot partition, 0 selects it
+	// by label
+	BootPartition  int
+	ConfigTxtEdits ConfigTxtEdits
+	CmdlineEdits   CmdlineEdits
+	RootFiles      RootFiles
+	// Size grows the output image and its last partition
+	Size int64
+	// GrowRootFS grows the root file system together with Size
+	GrowRootFS     bool
+	DataPartitions DataPartitions
+	DiskID         DiskID
+	// Reproducible builds byte-identical images, the clocks and identifier
+	// sources of the build are derived from SOURCE_DATE_EPOCH, see
+	// Reproducible
+	Reproducible bool
+	// SkipVerify skips reading back the injected files and checking the
+	// boot partition after the build
+	SkipVerify bool
+
+	// Output is the image file to write, default disk.img
+	Output string
+	// Formats are the files to write, default the raw image at Output
+	Formats OutputFormats
+	// Force rebuilds outputs whose build key didn't change and overwrites
+	// outputs that are not regular files: symlinks are followed, devices
+	// are written in place
+	Force bool
+	// LockFile records the base image, the input hashes and the secret
+	// names of a successful build, empty disables it
+	LockFile string
+	// Locked refuses to build if anything drifted from LockFile instead of
+	// updating it
+	Locked bool
+	// ManifestKey is an ed25519 private key (OpenSSH or PKCS#8 PEM) that
+	// signs the manifest written next to the outputs
+	ManifestKey string
+	// Progress receives the build steps, transfers, warnings and the
+	// summary, may be nil
+	Progress progress.Reporter
+
+	// host, prefetched and baseImageSHA256 are set by BuildInventory: the
+	// inventory host, the base image fetched for all hosts and the sha256
+	// of BaseImage
+	host            string
+	prefetched      string
+	baseImageSHA256 string
+}
+
+// BuildSummary describes a finished or failed build
+type BuildSummary struct {
+	// Host is the inventory host of the build
+	Host      string `json:"host,omitempty"`
+	Output    string `json:"output"`
+	Release   string `json:"release,omitempty"`
+	BaseImage string `json:"base_image"`
+	// CacheHit is set if the base image was cached and verified
+	CacheHit bool `json:"cache_hit"`
+	// Steps are the timings of the finished build steps
+	Steps   []StepTiming `json:"steps"`
+	Seconds float64      `json:"seconds"`
+	// Files maps the files written to the boot partition to their sha256
+	Files map[string]string `json:"files,omitempty"`
+	// SHA256 and Size describe the output image, unless it is a device
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	// BuildKey identifies the inputs of the output, UpToDate is set if the
+	// existing output had the same key and wasn't rebuilt
+	BuildKey string `json:"build_key,omitempty"`
+	UpToDate bool   `json:"up_to_date,omitempty"`
+	// Manifest is the manifest written next to the outputs
+	Manifest string `json:"manifest,omitempty"`
+	// LockFile is the lock file that was written or checked
+	LockFile string `json:"lock_file,omitempty"`
+	// Exports are the files written in addition to or instead of the image
+	Exports []ExportSummary `json:"exports,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// StepTiming is the duration of a build step
+type StepTiming struct {
+	Step    string  `json:"step"`
+	Seconds float64 `json:"seconds"`
+}
+
+// BuildStage is the part of a build that failed
+type BuildStage int
+
+const (
+	// StageInput covers invalid options and missing inputs
+	StageInput BuildStage = iota + 1
+	// StageFetch covers downloading and extracting the base image
+	StageFetch
+	// StageExpand covers loading inputs and expanding templates
+	StageExpand
+	// StageGenerate covers archives and meta-data
+	StageGenerate
+	// StageImage covers copying and modifying the output image
+	StageImage
+	// StageVerify covers the check of the finished image
+	StageVerify
+)
+
+func (s BuildStage) String() string {
+	switch s {
+	case StageInput:
+		return "input"
+	case StageFetch:
+		return "fetch"
+	case StageExpand:
+		return "expand"
+	case StageGenerate:
+		return "generate"
+	case StageImage:
+		return "image"
+	case StageVerify:
+		return "verify"
+	}
+	return fmt.Sprintf("stage %d", int(s))
+}
+
+// BuildError is returned by Builder.Build
+type BuildError struct {
+	Stage BuildStage
+	Err   error
+}
+
+func (e *BuildError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyError lists the problems VerifyImage found in the output
+type VerifyError struct {
+	Problems []error
+}
+
+func (e *VerifyError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.Error()
+	}
+	return "verification failed: " + strings.Join(problems, ", ")
+}
+
+func stageError(stage BuildStage, err error, format string, args ...interface{}) error {
+	if format != "" {
+		err = fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), err)
+	}
+	return &BuildError{Stage: stage, Err: err}
+}
+
+// build holds the state of a single Build call
+type build struct {
+	*Builder
+	ctx      context.Context
+	progress progress.Reporter
+	summary  *BuildSummary
+	// output is the file being built, target the file it is renamed to
+	output string
+	target string
+
+	cached        string
+	facts         *ImageFacts
+	keys          map[string]string
+	userData      string
+	vendorData    string
+	userDataKey   string
+	vendorDataKey string
+	networkConfig string
+	metaData      string
+	hostname      string
+	injected      map[string]string
+	bootIndex     int
+	exports       []*outputFile
+	// lock is recorded while building, for LockFile and the manifest,
+	// locked is the one of a Locked build
+	lock   *Lock
+	locked *Lock
+	// baseImageKey identifies the base image in the build key, keyFile is
+	// where the key is stored
+	baseImageKey string
+	keyFile      string
+	upToDate     bool
+	// started, parts and signingKey go into the manifest
+	started      time.Time
+	manifestFile string
+	parts        []ManifestPart
+	signingKey   ed25519.PrivateKey
+	// sources are the clock and identifier source of this build
+	sources Sources
+}
+
+// Build fetches the base image and writes the output image. The image is
+// built in a temporary file that replaces Output once it is verified, a
+// failed build keeps the previous Output. Errors are *BuildError, they are
+// reported before the summary, which is returned in both cases.
+// Build is safe for concurrent use, also on the same Builder, as long as
+// the outputs differ: every build has its own clocks and identifier sources
+// and Build doesn't change the Builder.
+func (b *Builder) Build(ctx context.Context) (*BuildSummary, error) {
+	state := &build{Builder: b, ctx: ctx, progress: progress.OrSilent(b.Progress), summary: &BuildSummary{Steps: []StepTiming{}}, started: time.Now()}
+	err := state.run()
+	state.summary.Seconds = time.Since(state.started).Seconds()
+	if err != nil {
+		state.summary.Error = err.Error()
+		state.progress.Error(err)
+	}
+	state.progress.Summary(state.summary)
+	return state.summary, err
+}
+
+func (b *build) run() (err error) {
+	target := b.Output
+	if target == "" {
+		target = "disk.img"
+	}
+	b.summary.Host, b.summary.Output = b.host, target
+	if b.BaseImage == "" {
+		b.summary.Release = b.Release
+	}
+	if b.Reproducible {
+		epoch, err := SourceDateEpoch()
+		if err != nil {
+			return stageError(StageInput, err, "")
+		}
+		b.sources = Reproducible(epoch)
+		if b.DiskID == DiskIDRandom {
+			return stageError(StageInput, fmt.Errorf("random disk identifiers can't be reproducible, derive them from the hostname instead"), "")
+		}
+	}
+	if b.Locked && b.LockFile == "" {
+		return stageError(StageInput, fmt.Errorf("a locked build needs a lock file"), "")
+	}
+	b.lock = &Lock{Version: lockVersion, Inputs: make(map[string]string)}
+	if b.Locked {
+		if b.locked, err = LoadLock(b.LockFile); err != nil {
+			return stageError(StageInput, err, "can't build locked")
+		}
+	}
+	if b.ManifestKey != "" {
+		if b.signingKey, err = LoadSigningKey(b.ManifestKey); err != nil {
+			return stageError(StageInput, err, "can't sign the manifest")
+		}
+	}
+	output, err := newOutputFile(target, b.Force)
+	if err != nil {
+		return stageError(StageInput, err, "can't write %s", target)
+	}
+	b.output, b.target = output.Path, output.Target
+	if output.Path != output.Target {
+		b.manifestFile = target + ManifestSuffix
+	}
+	defer func() {
+		if err != nil {
+			output.Abort()
+			for _, export := range b.exports {
+				export.Abort()
+			}
+		}
+	}()
+
+	steps := []buildStep{
+		{"fetch", StageFetch, b.fetch},
+		{"generate", StageGenerate, b.generate},
+		{"lock", StageInput, b.checkLock},
+		{"key", StageInput, b.checkBuildKey},
+		{"write", StageImage, b.write},
+		{"verify", StageVerify, b.verify},
+	}
+	if output.Path != output.Target {
+		steps = append(steps, buildStep{"hash", StageImage, b.hash})
+	}
+	if len(b.Formats) > 0 {
+		steps = append(steps, buildStep{"export", StageImage, b.export})
+	}
+	for _, step := range steps {
+		if err := b.ctx.Err(); err != nil {
+			return stageError(step.stage, err, "")
+		}
+		start := time.Now()
+		if err := step.run(); err != nil {
+			return err
+		}
+		b.summary.Steps = append(b.summary.Steps, StepTiming{Step: step.name, Seconds: time.Since(start).Seconds()})
+		if b.upToDate {
+			break
+		}
+	}
+	if b.upToDate {
+		b.stepf("%s is up to date", b.summary.Output)
+		output.Abort()
+		b.summary.UpToDate = true
+		return b.saveLock()
+	}
+	for _, export := range b.exports {
+		if err := export.Commit(); err != nil {
+			return stageError(StageImage, err, "can't replace %s", export.Target)
+		}
+	}
+	if !b.Formats.Has(FormatImage) {
+		// only the exports were asked for
+		output.Abort()
+		b.summary.Output = ""
+	} else if err := output.Commit(); err != nil {
+		return stageError(StageImage, err, "can't replace %s", b.target)
+	}
+	if err := b.saveBuildKey(); err != nil {
+		return stageError(StageImage, err, "can't write %s", b.keyFile)
+	}
+	if err := b.saveManifest(); err != nil {
+		return stageError(StageImage, err, "can't write %s", b.manifestFile)
+	}
+	return b.saveLock()
+}
+
+// saveLock writes the lock file of a build that isn't Locked
+func (b *build) saveLock() error {
+	if b.LockFile != "" && !b.Locked {
+		if err := b.lock.Save(b.LockFile); err != nil {
+			return stageError(StageImage, err, "can't write %s", b.LockFile)
+		}
+	}
+	b.summary.LockFile = b.LockFile
+	return nil
+}
+
+// Render generates the user-data archive without writing an image. Facts
+// are read from BaseImage or from the release if it is already cached,
+// nothing is downloaded. Errors are *BuildError.
+func (b *Builder) Render(ctx context.Context) (string, error) {
+	state := &build{Builder: b, ctx: ctx, progress: progress.OrSilent(b.Progress), summary: &BuildSummary{}}
+	if err := ctx.Err(); err != nil {
+		return "", stageError(StageInput, err, "")
+	}
+	if b.BaseImage != "" {
+		state.cached = b.BaseImage
+	} else if image, found := ImagesByKey()[b.release()]; found {
+		if cached, err := ImageFilename(image, b.CacheDir); err == nil {
+			if _, err := os.Stat(cached); err == nil {
+				state.cached = cached
+			}
+		}
+	}
+	state.readFacts()
+	if err := state.generate(); err != nil {
+		return "", err
+	}
+	return state.userData, nil
+}
+
+// release returns Release or DefaultRelease
+func (b *Builder) release() string {
+	if b.Release == "" {
+		return DefaultRelease
+	}
+	return b.Release
+}
+
+// buildStep is a timed step of a build, its errors are reported as stage
+type buildStep struct {
+	name  string
+	stage BuildStage
+	run   func() error
+}
+
+// hash records the sha256 and size of the output image
+func (b *build) hash() error {
+	sum, size, err := hashFile(b.ctx, b.output, b.target, b.progress)
+	if err != nil {
+		return stageError(StageImage, err, "can't hash %s", b.target)
+	}
+	b.summary.SHA256, b.summary.Size = sum, size
+	return nil
+}
+
+// hashFile returns the sha256 and size of file, the transfer is named after
+// name
+func hashFile(ctx context.Context, file, name string, reporter progress.Reporter) (string, int64, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	transfer := reporter.Transfer("hash "+filepath.Base(name), stat.Size())
+	defer transfer.Done()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(hash, transfer), ioutils.ContextReader(ctx, in)); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), stat.Size(), nil
+}
+
+func (b *build) stepf(format string, args ...interface{}) {
+	b.progress.Step(fmt.Sprintf(format, args...))
+}
+
+// begin reports the start of a step, it fails once the build is cancelled
+func (b *build) begin(format string, args ...interface{}) error {
+	b.stepf(format, args...)
+	return b.ctx.Err()
+}
+
+// fetch downloads the base image and reads its facts
+func (b *build) fetch() error {
+	if b.BaseImage != "" {
+		if _, err := os.Stat(b.BaseImage); err != nil {
+			return stageError(StageInput, err, "can't use base image")
+		}
+		b.cached = b.BaseImage
+		b.summary.Release, b.summary.BaseImage = "", b.BaseImage
+		sum := b.baseImageSHA256
+		if sum == "" {
+			var err error
+			if sum, _, err = hashFile(b.ctx, b.BaseImage, b.BaseImage, b.progress); err != nil {
+				return stageError(StageInput, err, "can't hash %s", b.BaseImage)
+			}
+		}
+		b.baseImageKey = "sha256:" + sum
+		if err := b.lockImage(LockedImage{File: b.BaseImage, SHA256: sum}); err != nil {
+			return stageError(StageInput, err, "")
+		}
+	} else if err := b.download(); err != nil {
+		return err
+	}
+	b.readFacts()
+	return nil
+}
+
+// readFacts reads the facts of the base image, e.g. IMAGE_OS_VERSION_ID, and
+// merges them with the secrets into the template keys. Without a base image
+// only the secrets are used.
+func (b *build) readFacts() {
+	if b.cached != "" {
+		cachedImg, err := OpenImageWith(b.cached, OpenOptions{ReadOnly: true, BootPartition: b.BootPartition})
+		if err == nil {
+			b.facts, err = ReadImageFacts(cachedImg)
+			cachedImg.Close()
+		}
+		if err != nil {
+			b.progress.Warning(fmt.Errorf("can't read image facts: %w", err))
+		}
+	}
+	b.keys = make(map[string]string)
+	if b.facts != nil {
+		for k, v := range b.facts.TemplateKeys() {
+			b.keys[k] = v
+		}
+	}
+	for k, v := range b.Secrets {
+		b.keys[k] = v
+	}
+}
+
+// download fetches the release into the cache
+func (b *build) download() error {
+	release := b.release()
+	image, found := ImagesByKey()[release]
+	if !found {
+		return stageError(StageInput, fmt.Errorf("could not find image %s", release), "")
+	}
+	if err := b.lockImage(lockedImageSource(image)); err != nil {
+		return stageError(StageInput, err, "")
+	}
+	b.baseImageKey = image.URL + " " + image.ImageChecksum
+	refresh := b.Refresh
+	if refresh == 0 {
+		refresh = DefaultRefresh
+	}
+	lockTimeout := b.LockTimeout
+	if lockTimeout == 0 {
+		lockTimeout = DefaultLockTimeout
+	}
+	if b.prefetched != "" {
+		b.cached, b.summary.CacheHit = b.prefetched, true
+	} else {
+		var err error
+		b.cached, b.summary.CacheHit, err = Fetch(b.ctx, image, b.CacheDir, refresh, lockTimeout, b.progress)
+		if err != nil {
+			return stageError(StageFetch, err, "could not download %s", release)
+		}
+	}
+	b.summary.Release, b.summary.BaseImage = release, b.cached
+	return nil
+}
+
+// expand loads and validates files, validation problems are warnings
+func (b *build) expand(files cicci.CCFiles, fsys fs.FS) (cicci.ExpandedFiles, error) {
+	var expanded cicci.ExpandedFiles
+	var err error
+	if fsys != nil {
+		expanded, err = files.LoadAndExpandFS(fsys, b.keys)
+	} else {
+		expanded, err = files.LoadAndExpand(b.keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	errors := expanded.Validate()
+	if b.facts != nil {
+		errors = append(errors, b.facts.Validate(expanded)...)
+	}
+	for _, err := range errors {
+		b.progress.Warning(err)
+	}
+	return expanded, nil
+}
+
+// generate builds user-data, vendor-data, network-config and meta-data
+func (b *build) generate() error {
+	inputs := b.Inputs
+	if len(inputs) == 0 && b.InputFS == nil {
+		inputs = []string{"."}
+	}
+	var files cicci.CCFiles
+	var err error
+	if b.InputFS != nil {
+		files, err = cicci.CollectFilesFS(b.InputFS)
+		inputs = nil
+	} else {
+		files, err = cicci.CollectFiles(inputs)
+	}
+	if err != nil {
+		return stageError(StageInput, err, "can't find files to merge")
+	}
+	vendorFiles, err := cicci.CollectFiles(b.VendorInputs)
+	if err != nil {
+		return stageError(StageInput, err, "can't find vendor files to merge")
+	}
+	if b.InputFS == nil {
+		files = files.Without(vendorFiles)
+		// network-config and meta-data are NoCloud files of their own, e.g.
+		// Wi-Fi passwords must not end up in user-data
+		for _, exclude := range append([]string{b.NetworkConfig, b.MetaData}, b.ExcludeInputs...) {
+			if exclude != "" {
+				files = files.Without(cicci.CCFiles{cicci.CCFile(exclude)})
+			}
+		}
+	}
+	if err := b.lockInputs(files, vendorFiles); err != nil {
+		return stageError(StageInput, err, "")
+	}
+
+	var expanded cicci.ExpandedFiles
+	if len(files) != 0 {
+		if expanded, err = b.expand(files, b.InputFS); err != nil {
+			return stageError(StageExpand, err, "can't load/expand files")
+		}
+	}
+	if len(b.DataPartitions) > 0 {
+		mounts, err := b.DataPartitions.CloudConfig()
+		if err != nil {
+			return stageError(StageGenerate, err, "can't generate mounts")
+		}
+		expanded = append(expanded, mounts)
+	}
+	if len(expanded) != 0 {
+		b.userData, err = cicci.BuildArchive(inputs, expanded, b.Reproducible)
+		if err != nil {
+			return stageError(StageGenerate, err, "can't create multipart archive")
+		}
+		if b.userDataKey, err = archiveKey(inputs, expanded); err != nil {
+			return stageError(StageGenerate, err, "")
+		}
+	}
+
+	var expandedVendor cicci.ExpandedFiles
+	if len(vendorFiles) != 0 {
+		if expandedVendor, err = b.expand(vendorFiles, nil); err != nil {
+			return stageError(StageExpand, err, "can't load/expand vendor files")
+		}
+		b.vendorData, err = cicci.BuildArchive(b.VendorInputs, expandedVendor, b.Reproducible)
+		if err != nil {
+			return stageError(StageGenerate, err, "can't create vendor multipart archive")
+		}
+		if b.vendorDataKey, err = archiveKey(b.VendorInputs, expandedVendor); err != nil {
+			return stageError(StageGenerate, err, "")
+		}
+	}
+	b.parts = append(manifestParts("user-data", expanded), manifestParts("vendor-data", expandedVendor)...)
+
+	if b.NetworkConfig != "" {
+		file := cicci.CCFile(b.NetworkConfig)
+		expandedNetworkConfig, err := file.LoadAndExpand(b.keys)
+		if err != nil {
+			return stageError(StageExpand, err, "can't load/expand network-config")
+		}
+		if err := cicci.ValidateNetworkConfig(expandedNetworkConfig.Content); err != nil {
+			b.progress.Warning(fmt.Errorf("%s: %w", expandedNetworkConfig.OriginalFilename, err))
+		}
+		b.networkConfig = expandedNetworkConfig.Content
+	}
+
+	// generate meta-data, extra keys from MetaData and MetaDataSet win
+	extraMetaData := make(map[string]interface{})
+	if b.MetaData != "" {
+		file := cicci.CCFile(b.MetaData)
+		expandedMetaData, err := file.LoadAndExpand(b.keys)
+		if err != nil {
+			return stageError(StageExpand, err, "can't load/expand meta-data")
+		}
+		extraMetaData, err = cicci.ParseMetaData(expandedMetaData.Content)
+		if err != nil {
+			return stageError(StageExpand, err, "can't parse meta-data")
+		}
+	}
+	for k, v := range b.MetaDataSet {
+		extraMetaData[k] = v
+	}
+	// vendor-data is merged below user-data, so user-data wins
+	merged := append(append(cicci.ExpandedFiles{}, expandedVendor...), expanded...)
+	b.hostname = b.Hostname
+	if b.hostname == "" {
+		b.hostname = cicci.Hostname(merged)
+	}
+	metaData, err := cicci.NewMetaData(merged, b.networkConfig, b.hostname, extraMetaData)
+	if err != nil {
+		return stageError(StageGenerate, err, "can't generate meta-data")
+	}
+	b.metaData, err = metaData.Render()
+	if err != nil {
+		return stageError(StageGenerate, err, "can't generate meta-data")
+	}
+	return nil
+}
+
+// write copies the base image to the output and modifies it
+func (b *build) write() error {
+	diskIDSource, err := b.DiskID.Source(b.hostname, b.sources.random())
+	if err != nil {
+		return stageError(StageInput, err, "can't set disk identifiers")
+	}
+
+	// copy the file to the output
+	if err := ioutils.Copy(b.ctx, b.cached, b.output, b.progress); err != nil {
+		return stageError(StageImage, err, "can't copy %s", b.cached)
+	}
+
+	if b.Size > 0 {
+		if err := b.begin("growing %s to %d bytes", b.target, b.Size); err != nil {
+			return stageError(StageImage, err, "")
+		}
+		partition, err := GrowImage(b.output, b.Size)
+		if err != nil {
+			return stageError(StageImage, err, "can't grow %s", b.target)
+		}
+		b.stepf("partition %d now ends at %d bytes", partition.Index, partition.Start+partition.Size)
+	}
+
+	if len(b.DataPartitions) > 0 {
+		if err := b.begin("adding data partitions"); err != nil {
+			return stageError(StageImage, err, "")
+		}
+		partitions, err := b.DataPartitions.Append(b.output, b.sources)
+		if err != nil {
+			return stageError(StageImage, err, "can't add data partitions")
+		}
+		for i, partition := range partitions {
+			b.stepf("partition %d: %s (%s, %d bytes)", partition.Index, b.DataPartitions[i].Label, b.DataPartitions[i].FSType, partition.Size)
+		}
+	}
+
+	var partUUIDs PartUUIDs
+	if diskIDSource != nil {
+		if err := b.begin("setting new disk identifiers"); err != nil {
+			return stageError(StageImage, err, "")
+		}
+		if partUUIDs, err = SetDiskIdentifiers(b.output, diskIDSource); err != nil {
+			return stageError(StageImage, err, "can't set disk identifiers")
+		}
+	}
+
+	// inject the cloud-config
+	if err := b.begin("modifying %s", b.target); err != nil {
+		return stageError(StageImage, err, "")
+	}
+	img, err := OpenImageWith(b.output, OpenOptions{BootPartition: b.BootPartition, Sources: b.sources})
+	if err != nil {
+		return stageError(StageImage, err, "can't open %s", b.target)
+	}
+	if err := b.modify(img, partUUIDs); err != nil {
+		img.Close()
+		return stageError(StageImage, err, "")
+	}
+
+	b.stepf("syncing %s", b.target)
+	b.injected, b.bootIndex = img.Injected(), img.BootPartition().Index
+	b.summary.Files = b.injected
+	if err := img.Close(); err != nil {
+		return stageError(StageImage, err, "can't sync %s", b.target)
+	}
+	return nil
+}
+
+// modify writes the generated files and applies all edits to img
+func (b *build) modify(img *Image, partUUIDs PartUUIDs) error {
+	if len(partUUIDs) > 0 {
+		if err := b.begin("updating PARTUUID references"); err != nil {
+			return err
+		}
+		if err := img.ApplyPartUUIDs(partUUIDs); err != nil {
+			return err
+		}
+	}
+
+	if b.userData != "" {
+		userData, err := GzipString(b.userData)
+		if err != nil {
+			return err
+		}
+		if err := b.begin("adding user-data"); err != nil {
+			return err
+		}
+		if err := img.InjectFile("user-data", userData); err != nil {
+			return err
+		}
+	}
+
+	if b.vendorData != "" {
+		vendorData, err := GzipString(b.vendorData)
+		if err != nil {
+			return err
+		}
+		if err := b.begin("adding vendor-data"); err != nil {
+			return err
+		}
+		if err := img.InjectFile("vendor-data", vendorData); err != nil {
+			return err
+		}
+	}
+
+	if err := b.begin("adding meta-data"); err != nil {
+		return err
+	}
+	if err := img.InjectFile("meta-data", []byte(b.metaData)); err != nil {
+		return err
+	}
+
+	if b.networkConfig != "" {
+		if err := b.begin("adding network-config"); err != nil {
+			return err
+		}
+		if err := img.InjectFile("network-config", []byte(b.networkConfig)); err != nil {
+			return err
+		}
+	}
+
+	for _, bootfile := range b.BootFiles {
+		data, err := os.ReadFile(bootfile)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(bootfile)
+		if err := b.begin("adding %s", name); err != nil {
+			return err
+		}
+		if err := img.InjectFile(name, data); err != nil {
+			return err
+		}
+	}
+
+	if len(b.ConfigTxtEdits) > 0 {
+		if err := b.begin("modifying %s", ConfigTxtName); err != nil {
+			return err
+		}
+		if err := b.ConfigTxtEdits.Apply(img); err != nil {
+			return err
+		}
+	}
+
+	if len(b.CmdlineEdits) > 0 {
+		if err := b.begin("modifying %s", CmdlineTxtName); err != nil {
+			return err
+		}
+		if err := b.CmdlineEdits.Apply(img); err != nil {
+			return err
+		}
+	}
+
+	if b.Size > 0 && b.GrowRootFS {
+		if err := b.begin("growing the root file system"); err != nil {
+			return err
+		}
+		from, to, err := img.GrowRootFS()
+		if err != nil {
+			return err
+		}
+		b.stepf("root file system grown from %d to %d bytes", from, to)
+	}
+
+	if len(b.RootFiles) > 0 {
+		if err := b.begin("adding files to the root file system"); err != nil {
+			return err
+		}
+		if err := b.RootFiles.Apply(img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the output image
+func (b *build) verify() error {
+	if b.SkipVerify {
+		return nil
+	}
+	b.stepf("verifying %s", b.target)
+	if problems := VerifyImage(b.output, b.bootIndex, b.injected); len(problems) > 0 {
+		return stageError(StageVerify, &VerifyError{Problems: problems}, "")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package piccu
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderExcludesNoCloudFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"user.yaml":           "#cloud-config\nhostname: pi\n",
+		"network-config.yaml": "version: 2\nwifis:\n  wlan0:\n    access-points:\n      home:\n        password: wifi-psk\n",
+		"meta-data.yaml":      "instance-id: meta-secret\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builder := &Builder{
+		Inputs:        []string{dir},
+		NetworkConfig: filepath.Join(dir, "network-config.yaml"),
+		MetaData:      filepath.Join(dir, "meta-data.yaml"),
+		CacheDir:      t.TempDir(),
+	}
+	userData, err := builder.Render(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(userData, "hostname: pi") {
+		t.Errorf("user.yaml missing from user-data:\n%s", userData)
+	}
+	for _, leaked := range []string{"wifi-psk", "meta-secret"} {
+		if strings.Contains(userData, leaked) {
+			t.Errorf("user-data contains %s:\n%s", leaked, userData)
+		}
+	}
+}
+
+func TestConcurrentBuilds(t *testing.T) {
+	base := fat12Image(t)
+	input := filepath.Join(t.TempDir(), "user.yaml")
+	if err := os.WriteFile(input, []byte("#cloud-config\nhostname: pi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	outputs := []string{"random-1.img", "reproducible-1.img", "random-2.img", "reproducible-2.img"}
+	errs := make(chan error, len(outputs))
+	for i, output := range outputs {
+		builder := &Builder{
+			BaseImage:    base,
+			CacheDir:     t.TempDir(),
+			Inputs:       []string{input},
+			Reproducible: i%2 == 1,
+			Output:       filepath.Join(out, output),
+		}
+		go func() {
+			_, err := builder.Build(context.Background())
+			errs <- err
+		}()
+	}
+	for range outputs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := os.ReadFile(filepath.Join(out, "reproducible-1.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.ReadFile(filepath.Join(out, "reproducible-2.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("reproducible builds next to random ones differ")
+	}
+}
@@ -0,0 +1,133 @@
+package piccu
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheEntry is a file in the image cache
+type CacheEntry struct {
+	Path string `json:"path"`
+	// Image is the release of the file (codename:architecture), empty for
+	// files that don't belong to a known release
+	Image string `json:"image,omitempty"`
+	// Kind is download, image, lock or unknown
+	Kind    string    `json:"kind"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// cacheKinds maps the file suffixes of cached releases to their kind
+var cacheKinds = map[string]string{
+	".img.xz": "download",
+	".img":    "image",
+	".lock":   "lock",
+}
+
+// cacheEntryImage returns the release and kind of a file name in the cache
+func cacheEntryImage(name string) (*ImageSource, string) {
+	for i := range ImageSources {
+		img := &ImageSources[i]
+		prefix := fmt.Sprintf("%s-%s-%s", img.Release, img.Codename, img.Architecture)
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if kind, found := cacheKinds[name[len(prefix):]]; found {
+			return img, kind
+		}
+	}
+	return nil, "unknown"
+}
+
+// ListCache returns the files in the image cache, a missing cache is empty
+func ListCache(cachedir string) ([]CacheEntry, error) {
+	if cachedir == "" {
+		cachedir = cacheDirName
+	}
+	dirEntries, err := os.ReadDir(cachedir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]CacheEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+		entry := CacheEntry{Path: filepath.Join(cachedir, dirEntry.Name()), Size: info.Size(), ModTime: info.ModTime()}
+		var img *ImageSource
+		img, entry.Kind = cacheEntryImage(dirEntry.Name())
+		if img != nil {
+			entry.Image = img.Codename + ":" + img.Architecture
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// CleanCache removes the extracted images from the cache, they are extracted
+// again on the next build. With downloads the downloads are removed as well.
+// Each release is locked while its files are removed, so running fetches
+// finish first. It returns the removed entries.
+func CleanCache(ctx context.Context, cachedir string, downloads bool, lockTimeout time.Duration) ([]CacheEntry, error) {
+	entries, err := ListCache(cachedir)
+	if err != nil {
+		return nil, err
+	}
+	byImage := make(map[string][]CacheEntry)
+	locks := make(map[string]string)
+	for _, entry := range entries {
+		switch {
+		case entry.Kind == "lock":
+			locks[entry.Image] = entry.Path
+		case entry.Kind == "image", entry.Kind == "download" && downloads:
+			byImage[entry.Image] = append(byImage[entry.Image], entry)
+		}
+	}
+	images := make([]string, 0, len(byImage))
+	for image := range byImage {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	var removed []CacheEntry
+	for _, image := range images {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		err := removeLocked(ctx, locks[image], lockTimeout, byImage[image], func(entry CacheEntry) {
+			removed = append(removed, entry)
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// removeLocked removes entries while holding lockName, if there is one
+func removeLocked(ctx context.Context, lockName string, lockTimeout time.Duration, entries []CacheEntry, removed func(CacheEntry)) error {
+	if lockName != "" {
+		lock, err := newFlock(ctx, lockName, lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	for _, entry := range entries {
+		if err := os.Remove(entry.Path); err != nil {
+			return err
+		}
+		removed(entry)
+	}
+	return nil
+}
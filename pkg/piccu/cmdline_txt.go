@@ -0,0 +1,171 @@
+package piccu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CmdlineTxtName is the default kernel command line file
+const CmdlineTxtName = "cmdline.txt"
+
+// CmdlineParam is a single kernel parameter, either `key` or `key=value`
+type CmdlineParam struct {
+	Key      string
+	Value    string
+	HasValue bool
+}
+
+func (p CmdlineParam) String() string {
+	if !p.HasValue {
+		return p.Key
+	}
+	if strings.ContainsAny(p.Value, " \t") {
+		return p.Key + "=\"" + p.Value + "\""
+	}
+	return p.Key + "=" + p.Value
+}
+
+// ParseCmdlineParam parses `key` or `key=value`
+func ParseCmdlineParam(param string) CmdlineParam {
+	parts := strings.SplitN(param, "=", 2)
+	if len(parts) == 1 {
+		return CmdlineParam{Key: parts[0]}
+	}
+	return CmdlineParam{
+		Key:      parts[0],
+		Value:    strings.Trim(parts[1], "\""),
+		HasValue: true,
+	}
+}
+
+// CmdlineTxt is the parsed kernel command line, parameters keep their order
+type CmdlineTxt struct {
+	Name   string
+	Params []CmdlineParam
+}
+
+// ParseCmdlineTxt splits a kernel command line into parameters, double
+// quoted values may contain spaces
+func ParseCmdlineTxt(name, content string) *CmdlineTxt {
+	result := &CmdlineTxt{Name: name}
+	token := &strings.Builder{}
+	quoted := false
+	for _, r := range content {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			token.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if token.Len() > 0 {
+				result.Params = append(result.Params, ParseCmdlineParam(token.String()))
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if token.Len() > 0 {
+		result.Params = append(result.Params, ParseCmdlineParam(token.String()))
+	}
+	return result
+}
+
+// String returns the command line as the single line the firmware expects
+func (c *CmdlineTxt) String() string {
+	params := make([]string, len(c.Params))
+	for i, p := range c.Params {
+		params[i] = p.String()
+	}
+	return strings.Join(params, " ") + "\n"
+}
+
+// Get returns all values of key
+func (c *CmdlineTxt) Get(key string) (values []string) {
+	for _, p := range c.Params {
+		if p.Key == key {
+			values = append(values, p.Value)
+		}
+	}
+	return
+}
+
+// Set replaces the first occurrence of key and removes all others, the
+// parameter is appended if the key does not exist yet
+func (c *CmdlineTxt) Set(param CmdlineParam) {
+	found := false
+	kept := c.Params[:0]
+	for _, p := range c.Params {
+		if p.Key != param.Key {
+			kept = append(kept, p)
+			continue
+		}
+		if !found {
+			found = true
+			kept = append(kept, param)
+		}
+	}
+	c.Params = kept
+	if !found {
+		c.Params = append(c.Params, param)
+	}
+}
+
+// Add appends the parameter unless it exists with the same value, this is
+// needed for repeated keys like console=
+func (c *CmdlineTxt) Add(param CmdlineParam) {
+	for _, p := range c.Params {
+		if p == param {
+			return
+		}
+	}
+	c.Params = append(c.Params, param)
+}
+
+// Remove removes key, a parameter with value only removes matching values
+func (c *CmdlineTxt) Remove(param CmdlineParam) {
+	kept := c.Params[:0]
+	for _, p := range c.Params {
+		if p.Key == param.Key && (!param.HasValue || p.Value == param.Value) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	c.Params = kept
+}
+
+// LoadCmdlineTxt reads the kernel command line referenced by config.txt
+func LoadCmdlineTxt(img *Image) (*CmdlineTxt, error) {
+	name := CmdlineTxtName
+	if config, err := LoadConfigTxt(img); err == nil {
+		if values := config.Get("all", "cmdline"); len(values) > 0 && values[len(values)-1] != "" {
+			name = values[len(values)-1]
+		}
+	}
+	content, err := img.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", name, err)
+	}
+	return ParseCmdlineTxt(name, string(content)), nil
+}
+
+// Save writes the kernel command line back to the image
+func (c *CmdlineTxt) Save(img *Image) error {
+	return img.InjectFile(c.Name, []byte(c.String()))
+}
+
+// CmdlineEdit is a single change to the kernel command line
+type CmdlineEdit struct {
+	Type  EditType
+	Param CmdlineParam
+}
+
+func (e CmdlineEdit) Apply(cmdline *CmdlineTxt) {
+	switch e.Type {
+	case EditSet:
+		cmdline.Set(e.Param)
+	case EditAdd:
+		cmdline.Add(e.Param)
+	case EditRemove:
+		cmdline.Remove(e.Param)
+	}
+}
@@ -0,0 +1,93 @@
+package piccu
+
+import (
+	"flag"
+	"strings"
+)
+
+type CmdlineEdits []CmdlineEdit
+
+type CmdlineSetFlag CmdlineEdits
+type CmdlineAddFlag CmdlineEdits
+type CmdlineRemoveFlag CmdlineEdits
+
+var _ flag.Value = (*CmdlineSetFlag)(nil)
+var _ flag.Value = (*CmdlineAddFlag)(nil)
+var _ flag.Value = (*CmdlineRemoveFlag)(nil)
+
+// NewCmdlineFlagset returns flags that record kernel command line edits in the order given
+func NewCmdlineFlagset() (*CmdlineEdits, *CmdlineSetFlag, *CmdlineAddFlag, *CmdlineRemoveFlag) {
+	result := make(CmdlineEdits, 0)
+	return &result, (*CmdlineSetFlag)(&result), (*CmdlineAddFlag)(&result), (*CmdlineRemoveFlag)(&result)
+}
+
+// ofType returns the edits of one type, e.g. for the String of a flag
+func (edits CmdlineEdits) ofType(editType EditType) CmdlineEdits {
+	result := make(CmdlineEdits, 0, len(edits))
+	for _, e := range edits {
+		if e.Type == editType {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (edits CmdlineEdits) String() string {
+	entries := make([]string, 0, len(edits))
+	for _, e := range edits {
+		entries = append(entries, e.Param.String())
+	}
+	return strings.Join(entries, " ")
+}
+
+// Apply loads the kernel command line from the image, applies all edits and
+// writes it back
+func (edits CmdlineEdits) Apply(img *Image) error {
+	if len(edits) == 0 {
+		return nil
+	}
+	cmdline, err := LoadCmdlineTxt(img)
+	if err != nil {
+		return err
+	}
+	for _, edit := range edits {
+		edit.Apply(cmdline)
+	}
+	return cmdline.Save(img)
+}
+
+func (f *CmdlineSetFlag) Set(value string) error {
+	*f = append(*f, CmdlineEdit{
+		Type:  EditSet,
+		Param: ParseCmdlineParam(value),
+	})
+	return nil
+}
+
+func (f *CmdlineSetFlag) String() string {
+	return CmdlineEdits(*f).ofType(EditSet).String()
+}
+
+func (f *CmdlineAddFlag) Set(value string) error {
+	*f = append(*f, CmdlineEdit{
+		Type:  EditAdd,
+		Param: ParseCmdlineParam(value),
+	})
+	return nil
+}
+
+func (f *CmdlineAddFlag) String() string {
+	return CmdlineEdits(*f).ofType(EditAdd).String()
+}
+
+func (f *CmdlineRemoveFlag) Set(value string) error {
+	*f = append(*f, CmdlineEdit{
+		Type:  EditRemove,
+		Param: ParseCmdlineParam(value),
+	})
+	return nil
+}
+
+func (f *CmdlineRemoveFlag) String() string {
+	return CmdlineEdits(*f).ofType(EditRemove).String()
+}
@@ -0,0 +1,73 @@
+package piccu
+
+import "testing"
+
+const testCmdline = `console=serial0,115200 dwc_otg.lpm_enable=0 console=tty1 root=LABEL=writable rootfstype=ext4 rootwait fixrtc quiet splash`
+
+func TestCmdlineRoundTrip(t *testing.T) {
+	cmdline := ParseCmdlineTxt(CmdlineTxtName, testCmdline+"\n")
+	if got := cmdline.String(); got != testCmdline+"\n" {
+		t.Errorf("round trip changed cmdline.txt: %q", got)
+	}
+	if got := cmdline.Get("console"); len(got) != 2 || got[0] != "serial0,115200" || got[1] != "tty1" {
+		t.Errorf("console = %q", got)
+	}
+	if got := cmdline.Get("root"); len(got) != 1 || got[0] != "LABEL=writable" {
+		t.Errorf("root = %q", got)
+	}
+
+	quoted := ParseCmdlineTxt(CmdlineTxtName, "a=\"b c\"\td\r\n")
+	if got, want := quoted.String(), "a=\"b c\" d\n"; got != want {
+		t.Errorf("quoted = %q, want %q", got, want)
+	}
+	if got := quoted.Get("a"); len(got) != 1 || got[0] != "b c" {
+		t.Errorf("a = %q", got)
+	}
+}
+
+func TestCmdlineEdits(t *testing.T) {
+	tests := []struct {
+		name string
+		edit CmdlineEdit
+		want string
+	}{
+		{"set replaces the first and drops the others", CmdlineEdit{EditSet, ParseCmdlineParam("console=ttyAMA0")}, "console=ttyAMA0 dwc_otg.lpm_enable=0 root=LABEL=writable rootfstype=ext4 rootwait fixrtc quiet splash\n"},
+		{"set appends new keys", CmdlineEdit{EditSet, ParseCmdlineParam("cgroup_enable=memory")}, testCmdline + " cgroup_enable=memory\n"},
+		{"add keeps repeated keys", CmdlineEdit{EditAdd, ParseCmdlineParam("console=ttyS0")}, testCmdline + " console=ttyS0\n"},
+		{"add skips existing parameters", CmdlineEdit{EditAdd, ParseCmdlineParam("console=tty1")}, testCmdline + "\n"},
+		{"remove a value", CmdlineEdit{EditRemove, ParseCmdlineParam("console=tty1")}, "console=serial0,115200 dwc_otg.lpm_enable=0 root=LABEL=writable rootfstype=ext4 rootwait fixrtc quiet splash\n"},
+		{"remove a key", CmdlineEdit{EditRemove, ParseCmdlineParam("console")}, "dwc_otg.lpm_enable=0 root=LABEL=writable rootfstype=ext4 rootwait fixrtc quiet splash\n"},
+		{"remove a flag", CmdlineEdit{EditRemove, ParseCmdlineParam("quiet")}, "console=serial0,115200 dwc_otg.lpm_enable=0 console=tty1 root=LABEL=writable rootfstype=ext4 rootwait fixrtc splash\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmdline := ParseCmdlineTxt(CmdlineTxtName, testCmdline)
+			test.edit.Apply(cmdline)
+			if got := cmdline.String(); got != test.want {
+				t.Errorf("got  %q\nwant %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyPartUUIDsCmdlineErrors(t *testing.T) {
+	uuids := PartUUIDs{"12345678-02": "87654321-02"}
+	img, err := OpenImage(fat12Image(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	// no cmdline.txt and no root file system, nothing to rewrite
+	if err := img.ApplyPartUUIDs(uuids); err != nil {
+		t.Errorf("image without cmdline.txt: %s", err)
+	}
+	if err := img.InjectFile("config.txt", []byte("cmdline=README/cmdline.txt\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.InjectFile("README", []byte("not a directory\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.ApplyPartUUIDs(uuids); err == nil {
+		t.Error("unreadable cmdline.txt was skipped")
+	}
+}
@@ -0,0 +1,360 @@
+package piccu
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// ConfigTxtName is the name of the raspberry pi firmware configuration
+const ConfigTxtName = "config.txt"
+
+// UserConfigTxtName is the file older ubuntu images include for user changes
+const UserConfigTxtName = "usercfg.txt"
+
+// ConfigTxtLine is a single line of a config.txt file
+type ConfigTxtLine struct {
+	// Section is the conditional filter the line is in, e.g. "all" or "pi4"
+	Section string
+	// Key is the setting name, empty for comments, blank lines and section headers
+	Key string
+	// Value is the setting value
+	Value string
+
+	separator string
+	raw       string
+}
+
+func (l *ConfigTxtLine) String() string {
+	if l.raw != "" || l.Key == "" {
+		return l.raw
+	}
+	return l.Key + l.separator + l.Value
+}
+
+// ConfigTxt is a parsed config.txt including all files pulled in with `include`
+type ConfigTxt struct {
+	Name     string
+	Lines    []*ConfigTxtLine
+	Includes map[string]*ConfigTxt
+
+	startSection string
+	modified     bool
+}
+
+// ParseConfigTxt parses a config.txt file, includes have to be resolved by the caller
+func ParseConfigTxt(name, content, section string) *ConfigTxt {
+	result := &ConfigTxt{
+		Name:         name,
+		Includes:     make(map[string]*ConfigTxt),
+		startSection: section,
+	}
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.TrimSuffix(content, "\n")
+	if content == "" {
+		return result
+	}
+	for _, raw := range strings.Split(content, "\n") {
+		line := &ConfigTxtLine{
+			Section: section,
+			raw:     raw,
+		}
+		trimmed := strings.TrimSpace(raw)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			line.Section = section
+		default:
+			line.Key, line.separator, line.Value = splitConfigTxtLine(trimmed)
+		}
+		result.Lines = append(result.Lines, line)
+	}
+	return result
+}
+
+// splitConfigTxtLine splits `key=value` as well as `initramfs initrd.img followkernel`
+func splitConfigTxtLine(line string) (key, separator, value string) {
+	i := strings.IndexAny(line, "= \t")
+	if i < 0 {
+		return line, "", ""
+	}
+	key = line[:i]
+	value = strings.TrimLeft(line[i:], " \t")
+	separator = line[i : len(line)-len(value)]
+	if strings.HasPrefix(value, "=") && !strings.Contains(separator, "=") {
+		separator += "="
+		value = value[1:]
+	}
+	return
+}
+
+// LoadConfigTxt reads config.txt and all included files from the image
+func LoadConfigTxt(img *Image) (*ConfigTxt, error) {
+	return loadConfigTxt(img, ConfigTxtName, "all", 0)
+}
+
+func loadConfigTxt(img *Image, name, section string, depth int) (*ConfigTxt, error) {
+	if depth > 8 {
+		return nil, fmt.Errorf("%s: includes nested too deep", name)
+	}
+	content, err := img.ReadFile(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read %s: %s", name, err)
+	}
+	config := ParseConfigTxt(name, string(content), section)
+	for _, line := range config.Lines {
+		if line.Key != "include" || line.Value == "" {
+			continue
+		}
+		// the firmware resolves includes relative to the boot partition
+		included, err := loadConfigTxt(img, path.Clean(line.Value), line.Section, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		config.Includes[included.Name] = included
+	}
+	return config, nil
+}
+
+// Save writes config.txt and all modified includes back to the image
+func (c *ConfigTxt) Save(img *Image) error {
+	for _, include := range c.Includes {
+		if err := include.Save(img); err != nil {
+			return err
+		}
+	}
+	if !c.modified {
+		return nil
+	}
+	return img.InjectFile(c.Name, []byte(c.String()))
+}
+
+func (c *ConfigTxt) String() string {
+	buf := &strings.Builder{}
+	for _, line := range c.Lines {
+		buf.WriteString(line.String())
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// Target returns the file that receives new settings: usercfg.txt if it is
+// included, config.txt otherwise
+func (c *ConfigTxt) Target() *ConfigTxt {
+	for _, file := range c.all() {
+		if file.Name == UserConfigTxtName {
+			return file
+		}
+	}
+	return c
+}
+
+func (c *ConfigTxt) all() []*ConfigTxt {
+	result := []*ConfigTxt{c}
+	for _, include := range c.Includes {
+		result = append(result, include.all()...)
+	}
+	return result
+}
+
+// Get returns all values of key in the given section
+func (c *ConfigTxt) Get(section, key string) (values []string) {
+	for _, file := range c.all() {
+		for _, line := range file.Lines {
+			if line.Key == key && line.Section == section {
+				values = append(values, line.Value)
+			}
+		}
+	}
+	return
+}
+
+// Set replaces all occurrences of key in section with a single key=value.
+// dtparam lines are matched by the parameter name, so setting audio=off
+// keeps the other parameters. dtoverlay lines load one overlay each, they
+// are added like Add does.
+func (c *ConfigTxt) Set(section, key, value string) {
+	if key == "dtoverlay" {
+		c.Add(section, key, value)
+		return
+	}
+	name := dtparamName(key, value)
+	target := c.Target()
+	var found *ConfigTxtLine
+	for _, file := range c.all() {
+		kept := file.Lines[:0]
+		for _, line := range file.Lines {
+			if line.Key != key || line.Section != section || dtparamName(line.Key, line.Value) != name {
+				kept = append(kept, line)
+				continue
+			}
+			if found == nil && file == target {
+				found = line
+				kept = append(kept, line)
+				if line.Value != value {
+					line.Value = value
+					line.raw = ""
+					file.modified = true
+				}
+				continue
+			}
+			file.modified = true
+		}
+		file.Lines = kept
+	}
+	if found == nil {
+		target.append(section, key, value)
+	}
+}
+
+// dtparamName returns the parameter a dtparam value sets, e.g. audio for
+// audio=on, and "" for other keys
+func dtparamName(key, value string) string {
+	if key != "dtparam" {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(value, "=", 2)[0])
+}
+
+// Add adds key=value to section unless the exact setting exists already
+func (c *ConfigTxt) Add(section, key, value string) {
+	for _, v := range c.Get(section, key) {
+		if v == value {
+			return
+		}
+	}
+	c.Target().append(section, key, value)
+}
+
+// Remove removes key from section, an empty section matches all sections
+// and an empty value matches all values
+func (c *ConfigTxt) Remove(section, key, value string) {
+	for _, file := range c.all() {
+		kept := file.Lines[:0]
+		for _, line := range file.Lines {
+			if line.Key == key &&
+				(section == "" || line.Section == section) &&
+				(value == "" || line.Value == value) {
+				file.modified = true
+				continue
+			}
+			kept = append(kept, line)
+		}
+		file.Lines = kept
+	}
+}
+
+// append adds a setting after the last setting of section, a new section is
+// started at the end of the file if the section does not exist yet
+func (c *ConfigTxt) append(section, key, value string) {
+	c.modified = true
+	line := &ConfigTxtLine{
+		Section:   section,
+		Key:       key,
+		separator: "=",
+		Value:     value,
+	}
+	last := -1
+	for i, l := range c.Lines {
+		if l.Section == section && strings.TrimSpace(l.String()) != "" {
+			last = i
+		}
+	}
+	if last >= 0 {
+		c.Lines = append(c.Lines[:last+1], append([]*ConfigTxtLine{line}, c.Lines[last+1:]...)...)
+		return
+	}
+	if c.endSection() == section {
+		c.Lines = append(c.Lines, line)
+		return
+	}
+	c.Lines = append(c.Lines, &ConfigTxtLine{Section: section, raw: "[" + section + "]"}, line)
+	// included files must not change the filter of the including file
+	if c.Name != ConfigTxtName && section != c.startSection {
+		c.Lines = append(c.Lines, &ConfigTxtLine{Section: c.startSection, raw: "[" + c.startSection + "]"})
+	}
+}
+
+func (c *ConfigTxt) endSection() string {
+	if len(c.Lines) == 0 {
+		return c.startSection
+	}
+	return c.Lines[len(c.Lines)-1].Section
+}
+
+// EditType is the type of change applied to config.txt or cmdline.txt
+type EditType int
+
+const (
+	EditSet EditType = iota
+	EditAdd
+	EditRemove
+)
+
+// ConfigTxtEdit is a single change to config.txt, parsed from `[section]key=value`
+type ConfigTxtEdit struct {
+	Type    EditType
+	Section string
+	Key     string
+	Value   string
+}
+
+// ParseConfigTxtEdit parses `[section]key=value`, the section defaults to
+// "all" for set and add and to every section for remove
+func ParseConfigTxtEdit(editType EditType, value string) (ConfigTxtEdit, error) {
+	edit := ConfigTxtEdit{Type: editType}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return edit, fmt.Errorf("missing ] in %s", value)
+		}
+		edit.Section = strings.TrimSpace(value[1:end])
+		value = strings.TrimSpace(value[end+1:])
+	} else if editType != EditRemove {
+		edit.Section = "all"
+	}
+	edit.Key, _, edit.Value = splitConfigTxtLine(value)
+	if edit.Key == "" {
+		return edit, fmt.Errorf("missing key in %s", value)
+	}
+	return edit, nil
+}
+
+// Apply applies the edit, new dtoverlay entries are checked against the
+// overlays shipped in the image
+func (e ConfigTxtEdit) Apply(config *ConfigTxt, overlays map[string]bool) error {
+	if e.Key == "dtoverlay" && e.Type != EditRemove && overlays != nil {
+		name := strings.SplitN(e.Value, ",", 2)[0]
+		if name != "" && !overlays[strings.ToLower(name)] {
+			return fmt.Errorf("unknown dtoverlay %s, no overlays/%s.dtbo in image", name, name)
+		}
+	}
+	switch e.Type {
+	case EditSet:
+		config.Set(e.Section, e.Key, e.Value)
+	case EditAdd:
+		config.Add(e.Section, e.Key, e.Value)
+	case EditRemove:
+		config.Remove(e.Section, e.Key, e.Value)
+	}
+	return nil
+}
+
+// Overlays returns the lower case names of all device tree overlays in the image
+func (img *Image) Overlays() (map[string]bool, error) {
+	entries, err := img.ReadDir("overlays")
+	if err != nil {
+		return nil, err
+	}
+	overlays := make(map[string]bool)
+	for _, e := range entries {
+		name := strings.ToLower(e.Name)
+		if !e.IsDir && strings.HasSuffix(name, ".dtbo") {
+			overlays[strings.TrimSuffix(name, ".dtbo")] = true
+		}
+	}
+	return overlays, nil
+}
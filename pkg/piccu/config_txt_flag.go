@@ -0,0 +1,102 @@
+package piccu
+
+import (
+	"flag"
+	"strings"
+)
+
+type ConfigTxtEdits []ConfigTxtEdit
+
+type ConfigTxtSetFlag ConfigTxtEdits
+type ConfigTxtAddFlag ConfigTxtEdits
+type ConfigTxtRemoveFlag ConfigTxtEdits
+
+var _ flag.Value = (*ConfigTxtSetFlag)(nil)
+var _ flag.Value = (*ConfigTxtAddFlag)(nil)
+var _ flag.Value = (*ConfigTxtRemoveFlag)(nil)
+
+// NewConfigTxtFlagset returns flags that record config.txt edits in the order given
+func NewConfigTxtFlagset() (*ConfigTxtEdits, *ConfigTxtSetFlag, *ConfigTxtAddFlag, *ConfigTxtRemoveFlag) {
+	result := make(ConfigTxtEdits, 0)
+	return &result, (*ConfigTxtSetFlag)(&result), (*ConfigTxtAddFlag)(&result), (*ConfigTxtRemoveFlag)(&result)
+}
+
+// ofType returns the edits of one type, e.g. for the String of a flag
+func (edits ConfigTxtEdits) ofType(editType EditType) ConfigTxtEdits {
+	result := make(ConfigTxtEdits, 0, len(edits))
+	for _, e := range edits {
+		if e.Type == editType {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func (edits ConfigTxtEdits) String() string {
+	entries := make([]string, 0, len(edits))
+	for _, e := range edits {
+		entries = append(entries, "["+e.Section+"]"+e.Key+"="+e.Value)
+	}
+	return strings.Join(entries, " ")
+}
+
+// Apply loads config.txt from the image, applies all edits and writes it back
+func (edits ConfigTxtEdits) Apply(img *Image) error {
+	if len(edits) == 0 {
+		return nil
+	}
+	config, err := LoadConfigTxt(img)
+	if err != nil {
+		return err
+	}
+	overlays, err := img.Overlays()
+	if err != nil {
+		// images without overlays directory can't be validated
+		overlays = nil
+	}
+	for _, edit := range edits {
+		if err := edit.Apply(config, overlays); err != nil {
+			return err
+		}
+	}
+	return config.Save(img)
+}
+
+func (f *ConfigTxtSetFlag) Set(value string) error {
+	edit, err := ParseConfigTxtEdit(EditSet, value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, edit)
+	return nil
+}
+
+func (f *ConfigTxtSetFlag) String() string {
+	return ConfigTxtEdits(*f).ofType(EditSet).String()
+}
+
+func (f *ConfigTxtAddFlag) Set(value string) error {
+	edit, err := ParseConfigTxtEdit(EditAdd, value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, edit)
+	return nil
+}
+
+func (f *ConfigTxtAddFlag) String() string {
+	return ConfigTxtEdits(*f).ofType(EditAdd).String()
+}
+
+func (f *ConfigTxtRemoveFlag) Set(value string) error {
+	edit, err := ParseConfigTxtEdit(EditRemove, value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, edit)
+	return nil
+}
+
+func (f *ConfigTxtRemoveFlag) String() string {
+	return ConfigTxtEdits(*f).ofType(EditRemove).String()
+}
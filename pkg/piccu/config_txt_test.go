@@ -0,0 +1,141 @@
+package piccu
+
+import "testing"
+
+const testConfigTxt = `# comment
+[pi4]
+max_framebuffers=2
+
+[all]
+arm_64bit=1
+dtparam=audio=on
+initramfs initrd.img followkernel
+`
+
+func TestConfigTxtRoundTrip(t *testing.T) {
+	config := ParseConfigTxt(ConfigTxtName, testConfigTxt, "all")
+	if got := config.String(); got != testConfigTxt {
+		t.Errorf("round trip changed config.txt:\n%s", got)
+	}
+	if got := config.Get("all", "initramfs"); len(got) != 1 || got[0] != "initrd.img followkernel" {
+		t.Errorf("initramfs = %q", got)
+	}
+	if got := config.Get("pi4", "max_framebuffers"); len(got) != 1 || got[0] != "2" {
+		t.Errorf("[pi4]max_framebuffers = %q", got)
+	}
+}
+
+func TestConfigTxtEdits(t *testing.T) {
+	tests := []struct {
+		name  string
+		edits []string
+		types []EditType
+		want  string
+	}{
+		{
+			name:  "set replaces in place",
+			edits: []string{"[pi4]max_framebuffers=1"},
+			types: []EditType{EditSet},
+			want:  "# comment\n[pi4]\nmax_framebuffers=1\n\n[all]\narm_64bit=1\ndtparam=audio=on\ninitramfs initrd.img followkernel\n",
+		},
+		{
+			name:  "set appends to the section",
+			edits: []string{"enable_uart=1"},
+			types: []EditType{EditSet},
+			want:  "# comment\n[pi4]\nmax_framebuffers=2\n\n[all]\narm_64bit=1\ndtparam=audio=on\ninitramfs initrd.img followkernel\nenable_uart=1\n",
+		},
+		{
+			name:  "add keeps existing values",
+			edits: []string{"[pi4]max_framebuffers=2", "[pi4]dtoverlay=disable-bt"},
+			types: []EditType{EditAdd, EditAdd},
+			want:  "# comment\n[pi4]\nmax_framebuffers=2\ndtoverlay=disable-bt\n\n[all]\narm_64bit=1\ndtparam=audio=on\ninitramfs initrd.img followkernel\n",
+		},
+		{
+			name:  "new sections go to the end",
+			edits: []string{"[cm4]otg_mode=1"},
+			types: []EditType{EditSet},
+			want:  testConfigTxt + "[cm4]\notg_mode=1\n",
+		},
+		{
+			name:  "remove key=value in every section",
+			edits: []string{"dtparam=audio=on"},
+			types: []EditType{EditRemove},
+			want:  "# comment\n[pi4]\nmax_framebuffers=2\n\n[all]\narm_64bit=1\ninitramfs initrd.img followkernel\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := ParseConfigTxt(ConfigTxtName, testConfigTxt, "all")
+			for i, value := range test.edits {
+				edit, err := ParseConfigTxtEdit(test.types[i], value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := edit.Apply(config, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := config.String(); got != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+			if !config.modified {
+				t.Error("config.txt not marked as modified")
+			}
+		})
+	}
+}
+
+func TestConfigTxtDtparams(t *testing.T) {
+	const content = "[all]\ndtparam=audio=on\ndtparam=i2c_arm=on\ndtparam=spi=on\ndtoverlay=vc4-kms-v3d\ndtoverlay=disable-bt\n"
+	config := ParseConfigTxt(ConfigTxtName, content, "all")
+	for _, value := range []string{"dtparam=audio=off", "dtoverlay=i2c-rtc,ds3231", "dtoverlay=disable-bt", "dtparam=spi=on"} {
+		edit, err := ParseConfigTxtEdit(EditSet, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := edit.Apply(config, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "[all]\ndtparam=audio=off\ndtparam=i2c_arm=on\ndtparam=spi=on\ndtoverlay=vc4-kms-v3d\ndtoverlay=disable-bt\ndtoverlay=i2c-rtc,ds3231\n"
+	if got := config.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if got := ParseConfigTxt(ConfigTxtName, want, "all").String(); got != want {
+		t.Errorf("round trip changed config.txt:\n%s", got)
+	}
+}
+
+func TestConfigTxtIncludes(t *testing.T) {
+	config := ParseConfigTxt(ConfigTxtName, "[all]\narm_64bit=1\ninclude usercfg.txt\n", "all")
+	user := ParseConfigTxt(UserConfigTxtName, "enable_uart=0\n", "all")
+	config.Includes[user.Name] = user
+
+	config.Set("all", "enable_uart", "1")
+	config.Set("pi4", "dtoverlay", "i2c-rtc,ds3231")
+	if got, want := user.String(), "enable_uart=1\n[pi4]\ndtoverlay=i2c-rtc,ds3231\n[all]\n"; got != want {
+		t.Errorf("usercfg.txt:\n%s\nwant:\n%s", got, want)
+	}
+	if config.modified {
+		t.Errorf("config.txt modified:\n%s", config.String())
+	}
+
+	config.Remove("", "enable_uart", "")
+	if got := config.Get("all", "enable_uart"); len(got) != 0 {
+		t.Errorf("enable_uart not removed: %q", got)
+	}
+}
+
+func TestConfigTxtOverlays(t *testing.T) {
+	config := ParseConfigTxt(ConfigTxtName, testConfigTxt, "all")
+	edit, err := ParseConfigTxtEdit(EditAdd, "dtoverlay=missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := edit.Apply(config, map[string]bool{"disable-bt": true}); err == nil {
+		t.Error("unknown overlay accepted")
+	}
+	if _, err := ParseConfigTxtEdit(EditSet, "[pi4"); err == nil {
+		t.Error("missing ] accepted")
+	}
+}
@@ -0,0 +1,367 @@
+package piccu
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/ext4"
+	"github.com/rtreffer/piccu/pkg/flags"
+)
+
+// partitionAlignment is the start alignment of new partitions
+const partitionAlignment = 1024 * 1024
+
+var validLabel = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DataPartition is an extra partition appended to the image, it is mounted
+// by label with a generated cloud-config mounts entry
+type DataPartition struct {
+	Label string
+	Size  int64
+	// FSType is vfat or ext4
+	FSType string
+	// Source is an optional local directory copied into the partition
+	Source string
+	// MountPoint defaults to /mnt/<label>
+	MountPoint string
+}
+
+// ParseDataPartition parses LABEL:SIZE:FSTYPE[:SRC[:MOUNTPOINT]], e.g.
+// data:2G:vfat:./data:/data or backup:8G:ext4
+func ParseDataPartition(value string) (DataPartition, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 3 || len(parts) > 5 {
+		return DataPartition{}, fmt.Errorf("invalid partition %s, expected LABEL:SIZE:FSTYPE[:SRC[:MOUNTPOINT]]", value)
+	}
+	result := DataPartition{
+		Label:  parts[0],
+		FSType: parts[2],
+	}
+	if len(parts) >= 4 {
+		result.Source = parts[3]
+	}
+	if len(parts) == 5 && parts[4] != "" {
+		result.MountPoint = path.Clean("/" + parts[4])
+	} else {
+		result.MountPoint = path.Join("/mnt", result.Label)
+	}
+	var size flags.ByteSize
+	if err := size.Set(parts[1]); err != nil {
+		return result, err
+	}
+	result.Size = (int64(size) + partitionAlignment - 1) / partitionAlignment * partitionAlignment
+	if result.Size == 0 {
+		return result, fmt.Errorf("invalid partition %s: size is 0", value)
+	}
+	if !validLabel.MatchString(result.Label) {
+		return result, fmt.Errorf("invalid partition label %s, use letters, digits, _ and -", result.Label)
+	}
+	switch result.FSType {
+	case "vfat":
+		if len(result.Label) > 11 {
+			return result, fmt.Errorf("vfat label %s is longer than 11 characters", result.Label)
+		}
+	case "ext4":
+		if len(result.Label) > 16 {
+			return result, fmt.Errorf("ext4 label %s is longer than 16 characters", result.Label)
+		}
+	default:
+		return result, fmt.Errorf("unsupported file system %s, expected vfat or ext4", result.FSType)
+	}
+	return result, nil
+}
+
+func (p DataPartition) String() string {
+	size := flags.ByteSize(p.Size)
+	return fmt.Sprintf("%s:%s:%s:%s:%s", p.Label, size.String(), p.FSType, p.Source, p.MountPoint)
+}
+
+// MountEntry is the cloud-config mounts entry, nofail keeps the system
+// booting without the partition
+func (p DataPartition) MountEntry() []string {
+	return []string{"LABEL=" + p.Label, p.MountPoint, p.FSType, "defaults,nofail", "0", "2"}
+}
+
+// DataPartitions records --partition flags in the order given
+type DataPartitions []DataPartition
+
+var _ flag.Value = (*DataPartitions)(nil)
+
+func (partitions *DataPartitions) Set(value string) error {
+	partition, err := ParseDataPartition(value)
+	if err != nil {
+		return err
+	}
+	*partitions = append(*partitions, partition)
+	return nil
+}
+
+func (partitions *DataPartitions) String() string {
+	entries := make([]string, 0, len(*partitions))
+	for _, partition := range *partitions {
+		entries = append(entries, partition.String())
+	}
+	return strings.Join(entries, " ")
+}
+
+// CloudConfig returns the generated mounts cloud-config, it is merged into
+// user-data by appending to the list of mounts
+func (partitions DataPartitions) CloudConfig() (cicci.ExpandedFile, error) {
+	mounts := make([][]string, 0, len(partitions))
+	for _, partition := range partitions {
+		mounts = append(mounts, partition.MountEntry())
+	}
+	content, err := yaml.Marshal(map[string]interface{}{"mounts": mounts})
+	if err != nil {
+		return cicci.ExpandedFile{}, err
+	}
+	return cicci.ExpandedFile{
+		OriginalFilename: "--partition",
+		Filename:         "piccu-mounts.yaml",
+		Content:          "#cloud-config\n" + string(content),
+	}, nil
+}
+
+// Append adds the partitions after the last partition of the image file,
+// formats them and copies their source directories. Sources provide the file
+// system UUIDs, partition GUIDs and timestamps.
+func (partitions DataPartitions) Append(file string, sources Sources) ([]Partition, error) {
+	for _, partition := range partitions {
+		if partition.Source == "" {
+			continue
+		}
+		if info, err := os.Stat(partition.Source); err != nil {
+			return nil, err
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("partition %s: %s is not a directory", partition.Label, partition.Source)
+		}
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	d, err := diskfs.OpenWithMode(file, diskfs.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	partitionTable, err := d.GetPartitionTable()
+	d.File.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// place the partitions and grow the file to hold them
+	end := int64(0)
+	for _, p := range partitionTable.GetPartitions() {
+		if p.GetSize() > 0 && p.GetStart()+p.GetSize() > end {
+			end = p.GetStart() + p.GetSize()
+		}
+	}
+	starts := make([]int64, len(partitions))
+	for i, partition := range partitions {
+		starts[i] = (end + partitionAlignment - 1) / partitionAlignment * partitionAlignment
+		end = starts[i] + partition.Size
+	}
+	if table, ok := partitionTable.(*gpt.Table); ok {
+		// room for the backup partition array and header
+		end += int64(gptEntries*128 + table.LogicalSectorSize)
+	}
+	if end > stat.Size() {
+		if err := os.Truncate(file, end); err != nil {
+			return nil, err
+		}
+	}
+
+	d, err = diskfs.OpenWithMode(file, diskfs.ReadWriteExclusive)
+	if err != nil {
+		return nil, err
+	}
+	defer d.File.Close()
+	indexes := make([]int, len(partitions))
+	switch table := partitionTable.(type) {
+	case *mbr.Table:
+		for i, partition := range partitions {
+			if indexes[i], err = addMBRPartition(table, partition, starts[i]); err != nil {
+				return nil, err
+			}
+		}
+	case *gpt.Table:
+		table = rebuildGPT(table)
+		for i, partition := range partitions {
+			if indexes[i], err = addGPTPartition(table, partition, starts[i], sources); err != nil {
+				return nil, err
+			}
+		}
+		partitionTable = table
+	default:
+		return nil, fmt.Errorf("unsupported partition table %s", partitionTable.Type())
+	}
+	if err := d.Partition(partitionTable); err != nil {
+		return nil, err
+	}
+
+	result := make([]Partition, 0, len(partitions))
+	for i, partition := range partitions {
+		p, _ := newPartition(indexes[i], partitionTable.GetPartitions()[indexes[i]-1])
+		if err := partition.format(d, p, sources); err != nil {
+			return nil, fmt.Errorf("partition %s: %s", partition.Label, err)
+		}
+		result = append(result, p)
+	}
+	return result, d.File.Sync()
+}
+
+func addMBRPartition(table *mbr.Table, partition DataPartition, start int64) (int, error) {
+	sectorSize := int64(table.LogicalSectorSize)
+	if (start+partition.Size)/sectorSize > 1<<32-1 {
+		return 0, fmt.Errorf("partition %s ends beyond the MBR limit of 2TiB", partition.Label)
+	}
+	partitionType := mbr.Linux
+	if partition.FSType == "vfat" {
+		partitionType = mbr.Fat32LBA
+	}
+	entry := &mbr.Partition{
+		Type:  partitionType,
+		Start: uint32(start / sectorSize),
+		Size:  uint32(partition.Size / sectorSize),
+		// the partition is beyond CHS addressing
+		StartCylinder: 0xff, StartHead: 0xfe, StartSector: 0xff,
+		EndCylinder: 0xff, EndHead: 0xfe, EndSector: 0xff,
+	}
+	for i, p := range table.Partitions {
+		if p.Type == mbr.Empty {
+			table.Partitions[i] = entry
+			return i + 1, nil
+		}
+	}
+	if len(table.Partitions) < 4 {
+		table.Partitions = append(table.Partitions, entry)
+		return len(table.Partitions), nil
+	}
+	return 0, fmt.Errorf("no free MBR entry for partition %s", partition.Label)
+}
+
+func addGPTPartition(table *gpt.Table, partition DataPartition, start int64, sources Sources) (int, error) {
+	sectorSize := uint64(table.LogicalSectorSize)
+	partitionType := gpt.LinuxFilesystem
+	if partition.FSType == "vfat" {
+		partitionType = gpt.MicrosoftBasicData
+	}
+	guid, err := sources.uuid()
+	if err != nil {
+		return 0, err
+	}
+	entry := &gpt.Partition{
+		GUID:  guid,
+		Start: uint64(start) / sectorSize,
+		End:   uint64(start+partition.Size)/sectorSize - 1,
+		Size:  uint64(partition.Size),
+		Type:  partitionType,
+		Name:  partition.Label,
+	}
+	for i, p := range table.Partitions {
+		if p.Type == gpt.Unused {
+			table.Partitions[i] = entry
+			return i + 1, nil
+		}
+	}
+	if len(table.Partitions) < gptEntries {
+		table.Partitions = append(table.Partitions, entry)
+		return len(table.Partitions), nil
+	}
+	return 0, fmt.Errorf("no free GPT entry for partition %s", partition.Label)
+}
+
+// format creates the file system and copies the source directory
+func (partition DataPartition) format(d *disk.Disk, p Partition, sources Sources) error {
+	if partition.FSType == "vfat" {
+		fsys, err := d.CreateFilesystem(disk.FilesystemSpec{
+			Partition:   p.Index,
+			FSType:      filesystem.TypeFat32,
+			VolumeLabel: partition.Label,
+		})
+		if err != nil {
+			return err
+		}
+		if partition.Source != "" {
+			if err := copyFatTree(fsys, partition.Source); err != nil {
+				return err
+			}
+		}
+		if !sources.Reproducible {
+			return nil
+		}
+		// go-diskfs uses the current time for entries and the volume ID
+		fat, err := newFatFS(&partitionDevice{file: d.File, offset: p.Start, size: p.Size}, false, sources)
+		if err != nil {
+			return err
+		}
+		id := make([]byte, 4)
+		if _, err := io.ReadFull(sources.random(), id); err != nil {
+			return err
+		}
+		return fat.normalize(sources.fatNow(), binary.LittleEndian.Uint32(id))
+	}
+
+	dev := &partitionDevice{file: d.File, offset: p.Start, size: p.Size}
+	fsys, err := ext4.Format(dev, p.Size, partition.Label, sources.ext4())
+	if err != nil {
+		return err
+	}
+	if partition.Source == "" {
+		return nil
+	}
+	return copyTree(fsys, partition.Source, "/", 0, 0, 0)
+}
+
+// copyFatTree copies a local directory into a FAT file system, FAT has no
+// symlinks, ownership or permissions
+func copyFatTree(fsys filesystem.FileSystem, source string) error {
+	return filepath.Walk(source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
+		}
+		dest := path.Join("/", filepath.ToSlash(rel))
+		switch {
+		case info.IsDir():
+			if dest == "/" {
+				return nil
+			}
+			return fsys.Mkdir(dest)
+		case info.Mode().IsRegular():
+			src, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			dst, err := fsys.OpenFile(dest, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(dst, src); err != nil {
+				return fmt.Errorf("%s: %s", dest, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("%s: unsupported file type %s on vfat", name, info.Mode().Type())
+	})
+}
@@ -0,0 +1,209 @@
+package piccu
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+
+	"github.com/rtreffer/piccu/pkg/ext4"
+)
+
+// mbrDiskSignatureOffset is the offset of the 32 bit MBR disk signature
+const mbrDiskSignatureOffset = 440
+
+// DiskID selects how the disk signature and partition UUIDs of the output
+// image are set
+type DiskID string
+
+const (
+	// DiskIDKeep keeps the identifiers of the base image
+	DiskIDKeep DiskID = "keep"
+	// DiskIDRandom picks new identifiers for every build, reproducible
+	// builds reject it
+	DiskIDRandom DiskID = "random"
+	// DiskIDHostname derives the identifiers from the hostname, rebuilding
+	// the image of a host keeps them
+	DiskIDHostname DiskID = "hostname"
+)
+
+func (d *DiskID) Set(value string) error {
+	switch DiskID(value) {
+	case DiskIDKeep, DiskIDRandom, DiskIDHostname:
+		*d = DiskID(value)
+		return nil
+	}
+	return fmt.Errorf("invalid disk id %s, expected keep, random or hostname", value)
+}
+
+func (d *DiskID) String() string {
+	if d == nil || *d == "" {
+		return string(DiskIDKeep)
+	}
+	return string(*d)
+}
+
+// Source returns the reader new identifiers are taken from, random is the
+// source of DiskIDRandom
+func (d DiskID) Source(hostname string, random io.Reader) (io.Reader, error) {
+	switch d {
+	case DiskIDRandom:
+		return random, nil
+	case DiskIDHostname:
+		if hostname == "" {
+			return nil, fmt.Errorf("can't derive disk identifiers without a hostname")
+		}
+		return newSeededReader("piccu disk " + hostname), nil
+	}
+	return nil, nil
+}
+
+// PartUUIDs maps the old PARTUUID of each partition to its new one
+type PartUUIDs map[string]string
+
+// SetDiskIdentifiers replaces the MBR disk signature or the GPT disk GUID
+// and partition GUIDs of the image file with values read from source. It
+// returns the changed PARTUUIDs as the kernel formats them.
+func SetDiskIdentifiers(file string, source io.Reader) (PartUUIDs, error) {
+	d, err := diskfs.OpenWithMode(file, diskfs.ReadWriteExclusive)
+	if err != nil {
+		return nil, err
+	}
+	defer d.File.Close()
+	partitionTable, err := d.GetPartitionTable()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(PartUUIDs)
+	switch table := partitionTable.(type) {
+	case *mbr.Table:
+		if err := setMBRDiskSignature(d.File, table, source, result); err != nil {
+			return nil, err
+		}
+	case *gpt.Table:
+		table = rebuildGPT(table)
+		if table.GUID, err = readUUID(source); err != nil {
+			return nil, err
+		}
+		for _, p := range table.Partitions {
+			if p.Type == gpt.Unused {
+				continue
+			}
+			guid, err := readUUID(source)
+			if err != nil {
+				return nil, err
+			}
+			result[strings.ToLower(p.GUID)] = strings.ToLower(guid)
+			p.GUID = guid
+		}
+		if err := table.Write(d.File, d.Size); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported partition table %s", partitionTable.Type())
+	}
+	return result, d.File.Sync()
+}
+
+func setMBRDiskSignature(file *os.File, table *mbr.Table, source io.Reader, result PartUUIDs) error {
+	b := make([]byte, 4)
+	if _, err := file.ReadAt(b, mbrDiskSignatureOffset); err != nil {
+		return err
+	}
+	old := binary.LittleEndian.Uint32(b)
+	signature := old
+	// 0 means no signature, the new one has to differ from the base image
+	for signature == 0 || signature == old {
+		if _, err := io.ReadFull(source, b); err != nil {
+			return err
+		}
+		signature = binary.LittleEndian.Uint32(b)
+	}
+	if _, err := file.WriteAt(b, mbrDiskSignatureOffset); err != nil {
+		return err
+	}
+	for i, p := range table.Partitions {
+		if p.Type == mbr.Empty {
+			continue
+		}
+		result[fmt.Sprintf("%08x-%02x", old, i+1)] = fmt.Sprintf("%08x-%02x", signature, i+1)
+	}
+	return nil
+}
+
+// readUUID reads a version 4 UUID from source
+func readUUID(source io.Reader) (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(source, b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Replace rewrites PARTUUID=<old> references in content, it returns false
+// if nothing was replaced
+func (uuids PartUUIDs) Replace(content string) (string, bool) {
+	changed := false
+	for old, uuid := range uuids {
+		pattern := regexp.MustCompile(`(?i)(PARTUUID=)` + regexp.QuoteMeta(old) + `\b`)
+		replaced := pattern.ReplaceAllString(content, "${1}"+uuid)
+		changed = changed || replaced != content
+		content = replaced
+	}
+	return content, changed
+}
+
+// ApplyPartUUIDs rewrites the PARTUUID references of the kernel command line
+// and of /etc/fstab in the root file system, a missing command line, fstab or
+// root file system (e.g. a NoCloud seed image) is skipped
+func (img *Image) ApplyPartUUIDs(uuids PartUUIDs) error {
+	if len(uuids) == 0 {
+		return nil
+	}
+	// images without cmdline.txt have nothing to rewrite
+	if cmdline, err := LoadCmdlineTxt(img); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	} else if err == nil {
+		changed := false
+		for i, param := range cmdline.Params {
+			if value, replaced := uuids.Replace(param.Value); replaced {
+				cmdline.Params[i].Value = value
+				changed = true
+			}
+		}
+		if changed {
+			if err := cmdline.Save(img); err != nil {
+				return err
+			}
+		}
+	}
+
+	rootfs, err := img.RootFS()
+	if err != nil {
+		return nil
+	}
+	info, err := rootfs.Stat("etc/fstab")
+	if err != nil {
+		return nil
+	}
+	fstab, err := rootfs.ReadFile("etc/fstab")
+	if err != nil {
+		return err
+	}
+	content, replaced := uuids.Replace(string(fstab))
+	if !replaced {
+		return nil
+	}
+	inode := info.Sys().(*ext4.Inode)
+	return rootfs.WriteFile("etc/fstab", []byte(content), ext4.Attr{Mode: info.Mode(), UID: inode.UID, GID: inode.GID})
+}
@@ -1,6 +1,7 @@
 package piccu
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -8,34 +9,77 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
+	"github.com/rtreffer/piccu/pkg/ioutils"
+	"github.com/rtreffer/piccu/pkg/progress"
 )
 
 const cacheDirName = ".cache"
 
+// DefaultLockTimeout is how long Fetch waits for another process that
+// fetches the same image
+const DefaultLockTimeout = 10 * time.Minute
+
+// lockPollInterval is the delay between attempts to take a held lock
+const lockPollInterval = 100 * time.Millisecond
+
 type flock int
 
-func newFlock(lockname string) (lock flock, err error) {
-	lockfd, fd_err := syscall.Open(lockname, syscall.O_CREAT, 0644)
+// newFlock takes an exclusive lock on lockname and records the pid of this
+// process in it. It gives up after timeout and reports the pid of the holder.
+func newFlock(ctx context.Context, lockname string, timeout time.Duration) (lock flock, err error) {
+	lockfd, fd_err := syscall.Open(lockname, syscall.O_CREAT|syscall.O_RDWR, 0644)
 	if fd_err != nil {
 		return flock(lockfd), fd_err
 	}
-	flock_err := syscall.Flock(lockfd, syscall.LOCK_EX)
-	if flock_err != nil {
-		syscall.Close(lockfd)
-		lockfd = 0
+	deadline := time.Now().Add(timeout)
+	for {
+		flock_err := syscall.Flock(lockfd, syscall.LOCK_EX|syscall.LOCK_NB)
+		if flock_err == nil {
+			break
+		}
+		if flock_err != syscall.EWOULDBLOCK && flock_err != syscall.EINTR {
+			syscall.Close(lockfd)
+			return 0, flock_err
+		}
+		if time.Now().After(deadline) {
+			holder := lockHolder(lockname)
+			syscall.Close(lockfd)
+			return 0, fmt.Errorf("timed out after %s waiting for %s, held by %s", timeout, lockname, holder)
+		}
+		select {
+		case <-ctx.Done():
+			syscall.Close(lockfd)
+			return 0, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := syscall.Ftruncate(lockfd, 0); err == nil {
+		syscall.Pwrite(lockfd, pid, 0)
 	}
-	return flock(lockfd), flock_err
+	return flock(lockfd), nil
+}
+
+// lockHolder describes the process that holds lockname
+func lockHolder(lockname string) string {
+	content, err := os.ReadFile(lockname)
+	pid := strings.TrimSpace(string(content))
+	if err != nil || pid == "" {
+		return "an unknown process"
+	}
+	return "pid " + pid
 }
 
 func (f flock) Unlock() error {
 	return syscall.Close(int(f))
 }
 
-func verifyDownload(img ImageSource, file string, refresh time.Duration) (bool, error) {
+func verifyDownload(ctx context.Context, img ImageSource, file string, refresh time.Duration, reporter progress.Reporter) (bool, error) {
 	stat, err := os.Stat(file)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -69,12 +113,10 @@ func verifyDownload(img ImageSource, file string, refresh time.Duration) (bool,
 	}
 	defer f.Close()
 
-	bar := progressbar.DefaultBytes(
-		stat.Size(),
-		"verify "+filepath.Base(file),
-	)
+	transfer := reporter.Transfer("verify "+filepath.Base(file), stat.Size())
+	defer transfer.Done()
 
-	_, err = io.Copy(io.MultiWriter(hash, bar), f)
+	_, err = io.Copy(io.MultiWriter(hash, transfer), ioutils.ContextReader(ctx, f))
 	if err != nil {
 		return false, err
 	}
@@ -84,7 +126,7 @@ func verifyDownload(img ImageSource, file string, refresh time.Duration) (bool,
 	return img.Checksum == ref, nil
 }
 
-func verifyImage(img ImageSource, file string, refresh time.Duration) (bool, error) {
+func verifyImage(ctx context.Context, img ImageSource, file string, refresh time.Duration, reporter progress.Reporter) (bool, error) {
 	stat, err := os.Stat(file)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -118,12 +160,10 @@ func verifyImage(img ImageSource, file string, refresh time.Duration) (bool, err
 	}
 	defer f.Close()
 
-	bar := progressbar.DefaultBytes(
-		stat.Size(),
-		"verify "+filepath.Base(file),
-	)
+	transfer := reporter.Transfer("verify "+filepath.Base(file), stat.Size())
+	defer transfer.Done()
 
-	_, err = io.Copy(io.MultiWriter(hash, bar), f)
+	_, err = io.Copy(io.MultiWriter(hash, transfer), ioutils.ContextReader(ctx, f))
 	if err != nil {
 		return false, err
 	}
@@ -133,21 +173,23 @@ func verifyImage(img ImageSource, file string, refresh time.Duration) (bool, err
 	return img.ImageChecksum == ref, nil
 }
 
-func Download(url, target, checksum string, expectedSize int64) error {
+// Download fetches url to target, a partial target is removed if the
+// download fails or ctx is cancelled
+func Download(ctx context.Context, url, target, checksum string, expectedSize int64, reporter progress.Reporter) (err error) {
+	reporter = progress.OrSilent(reporter)
 	os.Remove(target)
-	resp, err := http.Get(url)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	f, err := os.Create(target)
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer resp.Body.Close()
 
 	l := resp.ContentLength
-	if l != 0 && expectedSize != 0 && l != expectedSize {
+	if l > 0 && expectedSize != 0 && l != expectedSize {
 		return fmt.Errorf("expected download size of %d, got %d", expectedSize, l)
 	}
 	if l > expectedSize {
@@ -156,15 +198,29 @@ func Download(url, target, checksum string, expectedSize int64) error {
 	if expectedSize == 0 {
 		expectedSize = -1
 	}
+	if err := ioutils.CheckFreeSpace(target, expectedSize); err != nil {
+		return err
+	}
+
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(target)
+		}
+	}()
 
 	hash := sha256.New()
 
-	bar := progressbar.DefaultBytes(
-		expectedSize,
-		"download "+filepath.Base(target),
-	)
+	transfer := reporter.Transfer("download "+filepath.Base(target), expectedSize)
+	defer transfer.Done()
 
-	_, err = io.Copy(io.MultiWriter(f, hash, bar), resp.Body)
+	_, err = io.Copy(io.MultiWriter(f, hash, transfer), ioutils.ContextReader(ctx, resp.Body))
 	if err != nil {
 		return err
 	}
@@ -216,14 +272,14 @@ func ImageFilename(img ImageSource, cachedir string) (string, error) {
 	return filepath.Join(dir, fmt.Sprintf("%s-%s-%s.img", img.Release, img.Codename, img.Architecture)), nil
 }
 
-func fetchDownload(img ImageSource, cachedir string, refresh time.Duration) error {
+func fetchDownload(ctx context.Context, img ImageSource, cachedir string, refresh time.Duration, reporter progress.Reporter) error {
 	downloadName, err := DownloadName(img, cachedir)
 	if err != nil {
 		return err
 	}
 
 	// we are done if we can verify the download
-	verified, err := verifyDownload(img, downloadName, refresh)
+	verified, err := verifyDownload(ctx, img, downloadName, refresh, reporter)
 	if err != nil {
 		return err
 	}
@@ -231,50 +287,53 @@ func fetchDownload(img ImageSource, cachedir string, refresh time.Duration) erro
 		return nil
 	}
 
-	return Download(img.URL, downloadName, img.Checksum, img.Filesize)
+	return Download(ctx, img.URL, downloadName, img.Checksum, img.Filesize, reporter)
 }
 
-// Fetch fetches the image and returns a raw image file path
-func Fetch(img ImageSource, cachedir string, refresh time.Duration) (string, error) {
+// Fetch fetches the image and returns a raw image file path and whether it
+// was cached already. Concurrent fetches of the same image wait up to
+// lockTimeout for each other.
+func Fetch(ctx context.Context, img ImageSource, cachedir string, refresh, lockTimeout time.Duration, reporter progress.Reporter) (string, bool, error) {
+	reporter = progress.OrSilent(reporter)
 	downloadName, err := DownloadName(img, cachedir)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	lockName, err := LockfileName(img, cachedir)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	imageName, err := ImageFilename(img, cachedir)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	lock, err := newFlock(lockName)
+	lock, err := newFlock(ctx, lockName, lockTimeout)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	defer lock.Unlock()
 
 	// check if we can verify the image
-	verified, err := verifyImage(img, imageName, refresh)
+	verified, err := verifyImage(ctx, img, imageName, refresh, reporter)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	if verified {
-		return imageName, nil
+		return imageName, true, nil
 	}
 
 	// we need to at least download the file
-	err = fetchDownload(img, cachedir, refresh)
+	err = fetchDownload(ctx, img, cachedir, refresh, reporter)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	// and extract it
-	err = ExtractXz(downloadName, imageName, img.ImageChecksum, img.ExtractedFilesize)
+	err = ExtractXz(ctx, downloadName, imageName, img.ImageChecksum, img.ExtractedFilesize, reporter)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
-	return imageName, nil
+	return imageName, false, nil
 }
@@ -1,6 +1,7 @@
 package piccu
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -9,11 +10,16 @@ import (
 	"path/filepath"
 
 	"github.com/klauspost/readahead"
-	"github.com/schollz/progressbar/v3"
 	"github.com/ulikunitz/xz"
+
+	"github.com/rtreffer/piccu/pkg/ioutils"
+	"github.com/rtreffer/piccu/pkg/progress"
 )
 
-func ExtractXz(file, target, checksum string, expectedSize int64) error {
+// ExtractXz decompresses file to target, a partial target is removed if the
+// extraction fails or ctx is cancelled
+func ExtractXz(ctx context.Context, file, target, checksum string, expectedSize int64, reporter progress.Reporter) (err error) {
+	reporter = progress.OrSilent(reporter)
 	in, err := os.Open(file)
 	if err != nil {
 		return err
@@ -29,22 +35,31 @@ func ExtractXz(file, target, checksum string, expectedSize int64) error {
 	ra := readahead.NewReader(r)
 	defer ra.Close()
 
-	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
-	if err != nil {
+	if expectedSize == 0 {
+		expectedSize = -1
+	}
+	if err := ioutils.CheckFreeSpace(target, expectedSize); err != nil {
 		return err
 	}
 
-	if expectedSize == 0 {
-		expectedSize = -1
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(target)
+		}
+	}()
 
 	hash := sha256.New()
 
-	bar := progressbar.DefaultBytes(
-		expectedSize,
-		"extract "+filepath.Base(target),
-	)
-	_, err = io.Copy(io.MultiWriter(out, hash, bar), ra)
+	transfer := reporter.Transfer("extract "+filepath.Base(target), expectedSize)
+	defer transfer.Done()
+	_, err = io.Copy(io.MultiWriter(out, hash, transfer), ioutils.ContextReader(ctx, ra))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,481 @@
+package piccu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+)
+
+// maxFATProblems stops the check from flooding the output on a file system
+// that is not FAT at all
+const maxFATProblems = 100
+
+// fatGeometry is the BIOS parameter block of a FAT file system
+type fatGeometry struct {
+	// Bits is 12, 16 or 32
+	Bits              int
+	BytesPerSector    int64
+	SectorsPerCluster int64
+	ReservedSectors   int64
+	FATs              int64
+	RootEntries       int64
+	TotalSectors      int64
+	FATSectors        int64
+	RootCluster       uint32
+	FSInfoSector      int64
+	Media             byte
+	// Clusters is the number of data clusters, they are numbered from 2
+	Clusters uint32
+}
+
+func (g *fatGeometry) clusterSize() int64 {
+	return g.BytesPerSector * g.SectorsPerCluster
+}
+
+func (g *fatGeometry) rootDirOffset() int64 {
+	return (g.ReservedSectors + g.FATs*g.FATSectors) * g.BytesPerSector
+}
+
+func (g *fatGeometry) dataOffset() int64 {
+	rootDirSectors := (g.RootEntries*32 + g.BytesPerSector - 1) / g.BytesPerSector
+	return g.rootDirOffset() + rootDirSectors*g.BytesPerSector
+}
+
+func (g *fatGeometry) clusterOffset(cluster uint32) int64 {
+	return g.dataOffset() + int64(cluster-2)*g.clusterSize()
+}
+
+// eoc is the smallest end of chain marker, bad is the bad cluster marker
+func (g *fatGeometry) eoc() uint32 {
+	switch g.Bits {
+	case 12:
+		return 0xff8
+	case 16:
+		return 0xfff8
+	}
+	return 0x0ffffff8
+}
+
+func (g *fatGeometry) bad() uint32 {
+	return g.eoc() - 1
+}
+
+// entry reads the FAT entry of a cluster, FAT12 packs two entries into three
+// bytes and the upper four bits of FAT32 entries are reserved
+func (g *fatGeometry) entry(fat []byte, cluster uint32) uint32 {
+	switch g.Bits {
+	case 12:
+		value := uint32(binary.LittleEndian.Uint16(fat[cluster+cluster/2:]))
+		if cluster&1 == 1 {
+			return value >> 4
+		}
+		return value & 0xfff
+	case 16:
+		return uint32(binary.LittleEndian.Uint16(fat[cluster*2:]))
+	}
+	return binary.LittleEndian.Uint32(fat[cluster*4:]) & 0x0fffffff
+}
+
+// setEntry writes the FAT entry of a cluster and keeps the bits that belong
+// to the neighbouring FAT12 entry or are reserved in FAT32
+func (g *fatGeometry) setEntry(fat []byte, cluster, value uint32) {
+	le := binary.LittleEndian
+	switch g.Bits {
+	case 12:
+		offset := cluster + cluster/2
+		old := uint32(le.Uint16(fat[offset:]))
+		if cluster&1 == 1 {
+			value = old&0x000f | value<<4
+		} else {
+			value = old&0xf000 | value&0xfff
+		}
+		le.PutUint16(fat[offset:], uint16(value))
+	case 16:
+		le.PutUint16(fat[cluster*2:], uint16(value))
+	default:
+		le.PutUint32(fat[cluster*4:], le.Uint32(fat[cluster*4:])&0xf0000000|value&0x0fffffff)
+	}
+}
+
+// parseFATGeometry reads and sanity checks the boot sector
+func parseFATGeometry(sector []byte, size int64) (*fatGeometry, error) {
+	le := binary.LittleEndian
+	if sector[510] != 0x55 || sector[511] != 0xaa {
+		return nil, fmt.Errorf("boot sector signature missing")
+	}
+	g := &fatGeometry{
+		BytesPerSector:    int64(le.Uint16(sector[11:])),
+		SectorsPerCluster: int64(sector[13]),
+		ReservedSectors:   int64(le.Uint16(sector[14:])),
+		FATs:              int64(sector[16]),
+		RootEntries:       int64(le.Uint16(sector[17:])),
+		TotalSectors:      int64(le.Uint16(sector[19:])),
+		Media:             sector[21],
+		FATSectors:        int64(le.Uint16(sector[22:])),
+	}
+	if g.TotalSectors == 0 {
+		g.TotalSectors = int64(le.Uint32(sector[32:]))
+	}
+	if g.FATSectors == 0 {
+		g.FATSectors = int64(le.Uint32(sector[36:]))
+		g.RootCluster = le.Uint32(sector[44:])
+		g.FSInfoSector = int64(le.Uint16(sector[48:]))
+	}
+	switch g.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid bytes per sector %d", g.BytesPerSector)
+	}
+	if g.SectorsPerCluster == 0 || g.SectorsPerCluster&(g.SectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("invalid sectors per cluster %d", g.SectorsPerCluster)
+	}
+	if g.ReservedSectors == 0 || g.FATs == 0 || g.FATSectors == 0 {
+		return nil, fmt.Errorf("invalid reserved sectors, FAT count or FAT size")
+	}
+	if g.TotalSectors*g.BytesPerSector > size {
+		return nil, fmt.Errorf("file system of %d bytes is larger than its partition of %d bytes", g.TotalSectors*g.BytesPerSector, size)
+	}
+	dataStart := g.dataOffset() / g.BytesPerSector
+	if dataStart >= g.TotalSectors {
+		return nil, fmt.Errorf("no room for data clusters")
+	}
+	clusters := (g.TotalSectors - dataStart) / g.SectorsPerCluster
+	g.Clusters = uint32(clusters)
+	// like Linux, FAT32 is told apart by its boot sector and FAT12 from FAT16
+	// by the cluster count
+	switch {
+	case le.Uint16(sector[22:]) == 0:
+		g.Bits = 32
+	case clusters < 4085:
+		g.Bits = 12
+	default:
+		g.Bits = 16
+	}
+	if (int64(g.Clusters+2)*int64(g.Bits)+7)/8 > g.FATSectors*g.BytesPerSector {
+		return nil, fmt.Errorf("FAT of %d sectors is too small for %d clusters", g.FATSectors, g.Clusters)
+	}
+	return g, nil
+}
+
+// fatCheck holds the state of a consistency check
+type fatCheck struct {
+	dev      io.ReaderAt
+	geometry *fatGeometry
+	fat      []byte
+	// owner maps clusters to the path that uses them
+	owner    map[uint32]string
+	problems []error
+}
+
+func (c *fatCheck) problem(format string, args ...interface{}) {
+	if len(c.problems) < maxFATProblems {
+		c.problems = append(c.problems, fmt.Errorf(format, args...))
+	}
+}
+
+func (c *fatCheck) entry(cluster uint32) uint32 {
+	return c.geometry.entry(c.fat, cluster)
+}
+
+// chain follows the clusters of name from start, each cluster must be in
+// range, allocated and used once
+func (c *fatCheck) chain(name string, start uint32) []uint32 {
+	var result []uint32
+	for cluster := start; ; {
+		if cluster < 2 || cluster >= c.geometry.Clusters+2 {
+			c.problem("%s: cluster %d is out of range", name, cluster)
+			return result
+		}
+		if owner, ok := c.owner[cluster]; ok {
+			if owner == name {
+				c.problem("%s: cluster chain loops at cluster %d", name, cluster)
+			} else {
+				c.problem("%s: cluster %d is also used by %s", name, cluster, owner)
+			}
+			return result
+		}
+		c.owner[cluster] = name
+		result = append(result, cluster)
+		next := c.entry(cluster)
+		switch {
+		case next >= c.geometry.eoc():
+			return result
+		case next == 0:
+			c.problem("%s: cluster %d is used but marked free", name, cluster)
+			return result
+		case next == c.geometry.bad():
+			c.problem("%s: cluster %d is used but marked bad", name, cluster)
+			return result
+		}
+		cluster = next
+	}
+}
+
+// readClusters reads the content of a cluster chain
+func (c *fatCheck) readClusters(clusters []uint32) ([]byte, error) {
+	size := c.geometry.clusterSize()
+	result := make([]byte, int64(len(clusters))*size)
+	for i, cluster := range clusters {
+		if _, err := c.dev.ReadAt(result[int64(i)*size:int64(i+1)*size], c.geometry.clusterOffset(cluster)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// lfnChecksum is the checksum of a short name that long name entries carry
+func lfnChecksum(shortName []byte) byte {
+	sum := byte(0)
+	for _, b := range shortName[:11] {
+		sum = (sum>>1 | sum<<7) + b
+	}
+	return sum
+}
+
+// validShortName rejects characters that are not allowed in 8.3 names
+func validShortName(name []byte) bool {
+	for i, b := range name[:11] {
+		if i == 0 && b == 0x05 {
+			// 0xe5 escaped as 0x05
+			continue
+		}
+		if b < 0x20 || strings.IndexByte("\"*+,./:;<=>?[\\]|", b) >= 0 {
+			return false
+		}
+	}
+	return name[0] != ' '
+}
+
+// directory checks the entries of a directory and descends into its
+// subdirectories
+func (c *fatCheck) directory(name string, data []byte, isRoot bool) {
+	le := binary.LittleEndian
+	lfnChecksums := []byte(nil)
+	shortNames := make(map[string]bool)
+	for offset := 0; offset+32 <= len(data); offset += 32 {
+		entry := data[offset : offset+32]
+		if entry[0] == 0 {
+			return
+		}
+		if entry[0] == 0xe5 {
+			lfnChecksums = nil
+			continue
+		}
+		attr := entry[11]
+		if attr&0x3f == 0x0f {
+			lfnChecksums = append(lfnChecksums, entry[13])
+			continue
+		}
+		shortName := strings.TrimRight(string(entry[0:8]), " ")
+		if ext := strings.TrimRight(string(entry[8:11]), " "); ext != "" {
+			shortName += "." + ext
+		}
+		entryName := strings.TrimSuffix(name, "/") + "/" + shortName
+		checksum := lfnChecksum(entry)
+		for _, sum := range lfnChecksums {
+			if sum != checksum {
+				c.problem("%s: long name checksum mismatch", entryName)
+				break
+			}
+		}
+		lfnChecksums = nil
+		if attr&0x08 != 0 {
+			if !isRoot {
+				c.problem("%s: volume label outside of the root directory", entryName)
+			}
+			continue
+		}
+		isDot := shortName == "." || shortName == ".."
+		if !isDot && !validShortName(entry) {
+			c.problem("%s: invalid short name", entryName)
+		}
+		if shortNames[string(entry[0:11])] {
+			c.problem("%s: duplicate short name", entryName)
+		}
+		shortNames[string(entry[0:11])] = true
+		cluster := uint32(le.Uint16(entry[26:]))
+		if c.geometry.Bits == 32 {
+			cluster |= uint32(le.Uint16(entry[20:])) << 16
+		}
+		size := int64(le.Uint32(entry[28:]))
+
+		if isDot {
+			if isRoot {
+				c.problem("%s: dot entry in the root directory", entryName)
+			}
+			continue
+		}
+		if attr&0x10 != 0 {
+			if cluster == 0 {
+				c.problem("%s: directory without clusters", entryName)
+				continue
+			}
+			clusters := c.chain(entryName, cluster)
+			if len(clusters) == 0 {
+				continue
+			}
+			content, err := c.readClusters(clusters)
+			if err != nil {
+				c.problem("%s: %s", entryName, err)
+				continue
+			}
+			if len(content) < 64 || string(content[0:11]) != ".          " || string(content[32:43]) != "..         " {
+				c.problem("%s: directory does not start with . and ..", entryName)
+			}
+			c.directory(entryName, content, false)
+			continue
+		}
+		if size == 0 {
+			if cluster != 0 {
+				c.problem("%s: empty file has clusters", entryName)
+			}
+			continue
+		}
+		if cluster == 0 {
+			c.problem("%s: file of %d bytes has no clusters", entryName, size)
+			continue
+		}
+		clusters := c.chain(entryName, cluster)
+		if expected := (size + c.geometry.clusterSize() - 1) / c.geometry.clusterSize(); int64(len(clusters)) != expected {
+			c.problem("%s: %d bytes need %d clusters, the chain has %d", entryName, size, expected, len(clusters))
+		}
+	}
+}
+
+// CheckFAT checks the consistency of a FAT12, FAT16 or FAT32 file system:
+// the boot sector, the FAT copies, the directory entries and the cluster
+// chains. It returns the problems found, an empty result means clean.
+func CheckFAT(dev io.ReaderAt, size int64) []error {
+	sector := make([]byte, 512)
+	if _, err := dev.ReadAt(sector, 0); err != nil {
+		return []error{fmt.Errorf("can't read the boot sector: %s", err)}
+	}
+	geometry, err := parseFATGeometry(sector, size)
+	if err != nil {
+		return []error{err}
+	}
+	c := &fatCheck{
+		dev:      dev,
+		geometry: geometry,
+		owner:    make(map[uint32]string),
+	}
+
+	// all FAT copies must match, the first entries hold the media byte and
+	// dirty flags
+	fatSize := geometry.FATSectors * geometry.BytesPerSector
+	reserved := int64(geometry.Bits) / 4
+	for i := int64(0); i < geometry.FATs; i++ {
+		// FAT12 entries are read 16 bits at a time
+		fat := make([]byte, fatSize+2)
+		if _, err := dev.ReadAt(fat[:fatSize], (geometry.ReservedSectors+i*geometry.FATSectors)*geometry.BytesPerSector); err != nil {
+			return []error{fmt.Errorf("can't read FAT %d: %s", i+1, err)}
+		}
+		if i == 0 {
+			c.fat = fat
+			if fat[0] != geometry.Media {
+				c.problem("FAT media byte %02x does not match the boot sector media %02x", fat[0], geometry.Media)
+			}
+			// the clean shutdown bit of FAT16 and FAT32, FAT12 has none
+			clean := map[int]uint32{16: 0x8000, 32: 0x08000000}[geometry.Bits]
+			if c.entry(1)&clean != clean {
+				c.problem("volume is marked dirty")
+			}
+			continue
+		}
+		end := int64(geometry.Clusters+2) * int64(geometry.Bits) / 8
+		for offset := reserved; offset < end; offset++ {
+			if fat[offset] != c.fat[offset] {
+				c.problem("FAT %d differs from FAT 1 at byte %d", i+1, offset)
+				break
+			}
+		}
+	}
+
+	if geometry.Bits == 32 {
+		clusters := c.chain("/", geometry.RootCluster)
+		content, err := c.readClusters(clusters)
+		if err != nil {
+			return append(c.problems, fmt.Errorf("can't read the root directory: %s", err))
+		}
+		c.directory("/", content, true)
+	} else {
+		content := make([]byte, geometry.RootEntries*32)
+		if _, err := dev.ReadAt(content, geometry.rootDirOffset()); err != nil {
+			return append(c.problems, fmt.Errorf("can't read the root directory: %s", err))
+		}
+		c.directory("/", content, true)
+	}
+
+	// allocated clusters that no file uses are lost
+	lost, free := 0, uint32(0)
+	for cluster := uint32(2); cluster < geometry.Clusters+2; cluster++ {
+		value := c.entry(cluster)
+		if value == 0 {
+			free++
+			continue
+		}
+		if _, ok := c.owner[cluster]; !ok && value != geometry.bad() {
+			lost++
+		}
+	}
+	if lost > 0 {
+		c.problem("%d clusters are allocated but not used by any file", lost)
+	}
+
+	if geometry.Bits == 32 && geometry.FSInfoSector != 0 && geometry.FSInfoSector != 0xffff {
+		fsinfo := make([]byte, 512)
+		if _, err := dev.ReadAt(fsinfo, geometry.FSInfoSector*geometry.BytesPerSector); err == nil &&
+			binary.LittleEndian.Uint32(fsinfo[0:]) == 0x41615252 && binary.LittleEndian.Uint32(fsinfo[484:]) == 0x61417272 {
+			if count := binary.LittleEndian.Uint32(fsinfo[488:]); count != 0xffffffff && count != free {
+				c.problem("FSInfo free cluster count %d, counted %d", count, free)
+			}
+		}
+	}
+	return c.problems
+}
+
+// CheckFAT checks the boot partition of the image
+func (img *Image) CheckFAT() []error {
+	return CheckFAT(&partitionDevice{file: img.underlying, offset: img.boot.Start, size: img.boot.Size}, img.boot.Size)
+}
+
+// CheckImageFAT checks every FAT partition of an image file without mounting
+// it, problems are prefixed with the partition number
+func CheckImageFAT(file string) ([]error, error) {
+	d, err := diskfs.OpenWithMode(file, diskfs.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer d.File.Close()
+	table, err := d.GetPartitionTable()
+	if err != nil {
+		return nil, err
+	}
+	var problems []error
+	checked := 0
+	for i, p := range table.GetPartitions() {
+		partition, ok := newPartition(i+1, p)
+		if !ok {
+			continue
+		}
+		dev := &partitionDevice{file: d.File, offset: partition.Start, size: partition.Size}
+		sector := make([]byte, 512)
+		if _, err := dev.ReadAt(sector, 0); err != nil {
+			continue
+		}
+		if _, err := parseFATGeometry(sector, partition.Size); err != nil {
+			continue
+		}
+		checked++
+		for _, problem := range CheckFAT(dev, partition.Size) {
+			problems = append(problems, fmt.Errorf("partition %d: %s", partition.Index, problem))
+		}
+	}
+	if checked == 0 {
+		return nil, fmt.Errorf("no FAT partition in %s", file)
+	}
+	return problems, nil
+}
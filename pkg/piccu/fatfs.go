@@ -0,0 +1,644 @@
+package piccu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = 0x0f
+	// ntLowerBase and ntLowerExt mark short names shown in lower case
+	ntLowerBase = 0x08
+	ntLowerExt  = 0x10
+	// lfnChars is the number of UTF-16 units in a long name entry
+	lfnChars = 13
+)
+
+// shortNameChars are the characters besides A-Z and 0-9 allowed in 8.3 names
+const shortNameChars = "!#$%&'()-@^_`{}~"
+
+// fatFS reads and writes a FAT file system directly, it serves FAT12 boot
+// partitions because thinfs only supports FAT16 and FAT32
+type fatFS struct {
+	dev      *partitionDevice
+	geometry *fatGeometry
+	fat      []byte
+	readOnly bool
+	sources  Sources
+}
+
+// fatDir is a loaded directory, the FAT12/16 root directory has no clusters
+type fatDir struct {
+	clusters []uint32
+	data     []byte
+}
+
+// fatDirEntry is a parsed directory entry, first is the slot of the first
+// long name entry and slot the slot of the short entry
+type fatDirEntry struct {
+	name    string
+	short   []byte
+	attr    byte
+	cluster uint32
+	size    uint32
+	modTime time.Time
+	first   int
+	slot    int
+}
+
+func newFatFS(dev *partitionDevice, readOnly bool, sources Sources) (*fatFS, error) {
+	sector := make([]byte, 512)
+	if _, err := dev.ReadAt(sector, 0); err != nil {
+		return nil, err
+	}
+	geometry, err := parseFATGeometry(sector, dev.size)
+	if err != nil {
+		return nil, err
+	}
+	fatSize := geometry.FATSectors * geometry.BytesPerSector
+	// FAT12 entries are read 16 bits at a time
+	fat := make([]byte, fatSize+2)
+	if _, err := dev.ReadAt(fat[:fatSize], geometry.ReservedSectors*geometry.BytesPerSector); err != nil {
+		return nil, err
+	}
+	return &fatFS{dev: dev, geometry: geometry, fat: fat, readOnly: readOnly, sources: sources}, nil
+}
+
+// chain returns the clusters of a chain, it stops at clusters out of range
+// and on loops
+func (f *fatFS) chain(start uint32) []uint32 {
+	var result []uint32
+	for cluster := start; cluster >= 2 && cluster < f.geometry.Clusters+2; cluster = f.geometry.entry(f.fat, cluster) {
+		if uint32(len(result)) > f.geometry.Clusters {
+			break
+		}
+		result = append(result, cluster)
+	}
+	return result
+}
+
+func (f *fatFS) readClusters(clusters []uint32) ([]byte, error) {
+	size := f.geometry.clusterSize()
+	result := make([]byte, int64(len(clusters))*size)
+	for i, cluster := range clusters {
+		if _, err := f.dev.ReadAt(result[int64(i)*size:int64(i+1)*size], f.geometry.clusterOffset(cluster)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (f *fatFS) writeClusters(clusters []uint32, data []byte) error {
+	size := f.geometry.clusterSize()
+	for i, cluster := range clusters {
+		chunk := make([]byte, size)
+		if start := int64(i) * size; start < int64(len(data)) {
+			copy(chunk, data[start:])
+		}
+		if _, err := f.dev.WriteAt(chunk, f.geometry.clusterOffset(cluster)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFAT writes the FAT to every copy
+func (f *fatFS) writeFAT() error {
+	fatSize := f.geometry.FATSectors * f.geometry.BytesPerSector
+	for i := int64(0); i < f.geometry.FATs; i++ {
+		if _, err := f.dev.WriteAt(f.fat[:fatSize], (f.geometry.ReservedSectors+i*f.geometry.FATSectors)*f.geometry.BytesPerSector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alloc allocates a chain of count clusters from the first free clusters
+func (f *fatFS) alloc(count int) ([]uint32, error) {
+	result := make([]uint32, 0, count)
+	for cluster := uint32(2); cluster < f.geometry.Clusters+2 && len(result) < count; cluster++ {
+		if f.geometry.entry(f.fat, cluster) == 0 {
+			result = append(result, cluster)
+		}
+	}
+	if len(result) < count {
+		return nil, fmt.Errorf("no space left: %d clusters needed, %d free", count, len(result))
+	}
+	for i, cluster := range result {
+		next := f.geometry.eoc() | 0x7
+		if i+1 < len(result) {
+			next = result[i+1]
+		}
+		f.geometry.setEntry(f.fat, cluster, next)
+	}
+	return result, nil
+}
+
+func (f *fatFS) free(clusters []uint32) {
+	for _, cluster := range clusters {
+		f.geometry.setEntry(f.fat, cluster, 0)
+	}
+}
+
+func (f *fatFS) rootDir() (*fatDir, error) {
+	if f.geometry.Bits == 32 {
+		clusters := f.chain(f.geometry.RootCluster)
+		data, err := f.readClusters(clusters)
+		return &fatDir{clusters: clusters, data: data}, err
+	}
+	data := make([]byte, f.geometry.RootEntries*32)
+	_, err := f.dev.ReadAt(data, f.geometry.rootDirOffset())
+	return &fatDir{data: data}, err
+}
+
+// openDir loads a directory by path, names are matched case insensitive
+func (f *fatFS) openDir(name string) (*fatDir, error) {
+	dir, err := f.rootDir()
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if component == "" {
+			continue
+		}
+		entry := dir.find(component)
+		if entry == nil {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		if entry.attr&attrDirectory == 0 {
+			return nil, fmt.Errorf("%s: not a directory", name)
+		}
+		clusters := f.chain(entry.cluster)
+		data, err := f.readClusters(clusters)
+		if err != nil {
+			return nil, err
+		}
+		dir = &fatDir{clusters: clusters, data: data}
+	}
+	return dir, nil
+}
+
+func (f *fatFS) writeDir(dir *fatDir) error {
+	if dir.clusters == nil {
+		_, err := f.dev.WriteAt(dir.data, f.geometry.rootDirOffset())
+		return err
+	}
+	return f.writeClusters(dir.clusters, dir.data)
+}
+
+// entries parses the directory, deleted entries and volume labels are left
+// out
+func (dir *fatDir) entries() []fatDirEntry {
+	le := binary.LittleEndian
+	var result []fatDirEntry
+	var long []uint16
+	first, sequence, checksum := -1, 0, byte(0)
+	for slot := 0; slot*32+32 <= len(dir.data); slot++ {
+		entry := dir.data[slot*32 : slot*32+32]
+		if entry[0] == 0 {
+			break
+		}
+		if entry[0] == 0xe5 {
+			first = -1
+			continue
+		}
+		if entry[11]&0x3f == attrLongName {
+			if entry[0]&0x40 != 0 {
+				first, sequence, checksum = slot, int(entry[0]&0x1f), entry[13]
+				long = make([]uint16, sequence*lfnChars)
+			} else if first < 0 || int(entry[0]&0x1f) != sequence-1 || entry[13] != checksum {
+				first = -1
+				continue
+			}
+			sequence = int(entry[0] & 0x1f)
+			if sequence == 0 {
+				first = -1
+				continue
+			}
+			units := long[(sequence-1)*lfnChars:]
+			for i, offset := range lfnOffsets {
+				units[i] = le.Uint16(entry[offset:])
+			}
+			continue
+		}
+		if entry[11]&attrVolumeID != 0 {
+			first = -1
+			continue
+		}
+		parsed := fatDirEntry{
+			short:   entry[0:11],
+			attr:    entry[11],
+			cluster: uint32(le.Uint16(entry[26:])) | uint32(le.Uint16(entry[20:]))<<16,
+			size:    le.Uint32(entry[28:]),
+			modTime: fatTime(le.Uint16(entry[24:]), le.Uint16(entry[22:])),
+			first:   slot,
+			slot:    slot,
+		}
+		if first >= 0 && sequence == 1 && checksum == lfnChecksum(entry) {
+			parsed.first = first
+			for i, unit := range long {
+				if unit == 0 {
+					long = long[:i]
+					break
+				}
+			}
+			parsed.name = string(utf16.Decode(long))
+		} else {
+			parsed.name = displayShortName(entry)
+		}
+		first = -1
+		result = append(result, parsed)
+	}
+	return result
+}
+
+// lfnOffsets are the offsets of the 13 UTF-16 units in a long name entry
+var lfnOffsets = []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+func (dir *fatDir) find(name string) *fatDirEntry {
+	for _, entry := range dir.entries() {
+		if strings.EqualFold(entry.name, name) || strings.EqualFold(displayShortName(entry.short), name) {
+			return &entry
+		}
+	}
+	return nil
+}
+
+// freeSlots finds count consecutive free entries
+func (dir *fatDir) freeSlots(count int) int {
+	run := 0
+	for slot := 0; slot*32 < len(dir.data); slot++ {
+		if b := dir.data[slot*32]; b == 0 || b == 0xe5 {
+			run++
+			if run == count {
+				return slot - count + 1
+			}
+		} else {
+			run = 0
+		}
+	}
+	return -1
+}
+
+// displayShortName formats an 8.3 name, honouring the lower case flags
+func displayShortName(entry []byte) string {
+	base := strings.TrimRight(string(entry[0:8]), " ")
+	ext := strings.TrimRight(string(entry[8:11]), " ")
+	if strings.HasPrefix(base, "\x05") {
+		base = "\xe5" + base[1:]
+	}
+	if len(entry) > 12 && entry[12]&ntLowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if len(entry) > 12 && entry[12]&ntLowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// shortName derives the 8.3 name of a long name, a lossy conversion gets a
+// numeric tail that is unique in the directory
+func shortName(name string, dir *fatDir) []byte {
+	upper := strings.ToUpper(name)
+	base, ext := strings.TrimLeft(upper, "."), ""
+	if i := strings.LastIndex(base, "."); i >= 0 {
+		base, ext = base[:i], base[i+1:]
+	}
+	base, lossyBase := shortNamePart(base)
+	ext, lossyExt := shortNamePart(ext)
+	lossy := lossyBase || lossyExt || len(base) > 8 || len(ext) > 3 || base == ""
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	result := make([]byte, 11)
+	copy(result[8:], fmt.Sprintf("%-3s", ext))
+	if !lossy {
+		copy(result, fmt.Sprintf("%-8s", base))
+		return result
+	}
+	if base == "" {
+		base = "_"
+	}
+	for i := 1; ; i++ {
+		tail := "~" + strconv.Itoa(i)
+		prefix := base
+		if len(prefix) > 8-len(tail) {
+			prefix = prefix[:8-len(tail)]
+		}
+		copy(result, fmt.Sprintf("%-8s", prefix+tail))
+		if dir.find(displayShortName(result)) == nil {
+			return result
+		}
+	}
+}
+
+// shortNamePart replaces characters that are not allowed in 8.3 names
+func shortNamePart(part string) (string, bool) {
+	lossy := false
+	result := strings.Builder{}
+	for _, r := range part {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune(shortNameChars, r):
+			result.WriteRune(r)
+		case r == ' ' || r == '.':
+			lossy = true
+		default:
+			result.WriteByte('_')
+			lossy = true
+		}
+	}
+	return result.String(), lossy
+}
+
+// fatTime converts a FAT date and time in local time, FAT stores 2s steps
+func fatTime(date, t uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0xf), int(date&0x1f),
+		int(t>>11), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.Local)
+}
+
+// fatDateTime encodes the time in its own location like thinfs does
+func fatDateTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, time.Local)
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	return date, uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+}
+
+func (f *fatFS) ReadFile(name string) ([]byte, error) {
+	dir, err := f.openDir(path.Dir(path.Clean("/" + name)))
+	if err != nil {
+		return nil, err
+	}
+	entry := dir.find(path.Base(name))
+	if entry == nil {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	if entry.attr&attrDirectory != 0 {
+		return nil, fmt.Errorf("%s: is a directory", name)
+	}
+	clusters := f.chain(entry.cluster)
+	data, err := f.readClusters(clusters)
+	if err != nil {
+		return nil, err
+	}
+	if int(entry.size) > len(data) {
+		return nil, fmt.Errorf("%s: %d bytes but only %d clusters", name, entry.size, len(clusters))
+	}
+	return data[:entry.size], nil
+}
+
+func (f *fatFS) ReadDir(name string) ([]DirEntry, error) {
+	dir, err := f.openDir(name)
+	if err != nil {
+		return nil, err
+	}
+	var result []DirEntry
+	for _, entry := range dir.entries() {
+		if entry.name == "." || entry.name == ".." {
+			continue
+		}
+		result = append(result, DirEntry{
+			Name:    entry.name,
+			IsDir:   entry.attr&attrDirectory != 0,
+			Size:    int64(entry.size),
+			ModTime: entry.modTime,
+		})
+	}
+	return result, nil
+}
+
+// WriteFile creates or replaces a file, the parent directory must exist
+func (f *fatFS) WriteFile(name string, payload []byte) error {
+	if f.readOnly {
+		return fmt.Errorf("%s: read-only file system", name)
+	}
+	name = path.Clean("/" + name)
+	dir, err := f.openDir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if existing := dir.find(base); existing != nil {
+		if existing.attr&attrDirectory != 0 {
+			return fmt.Errorf("%s: is a directory", name)
+		}
+		f.free(f.chain(existing.cluster))
+		for slot := existing.first; slot <= existing.slot; slot++ {
+			dir.data[slot*32] = 0xe5
+		}
+		base = existing.name
+	}
+
+	clusterSize := f.geometry.clusterSize()
+	clusters, err := f.alloc(int((int64(len(payload)) + clusterSize - 1) / clusterSize))
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if err := f.writeClusters(clusters, payload); err != nil {
+		return err
+	}
+
+	short := shortName(base, dir)
+	var long []uint16
+	var caseFlags byte
+	switch display := displayShortName(short); {
+	case display == base:
+	case strings.ToLower(display) == base:
+		caseFlags = ntLowerBase | ntLowerExt
+	default:
+		long = utf16.Encode([]rune(base))
+		if len(long) > 255 {
+			return fmt.Errorf("%s: name longer than 255 characters", name)
+		}
+	}
+	longEntries := (len(long) + lfnChars - 1) / lfnChars
+	slot := dir.freeSlots(longEntries + 1)
+	if slot < 0 {
+		if dir.clusters == nil {
+			return fmt.Errorf("%s: root directory is full", name)
+		}
+		extra, err := f.alloc(int((int64(longEntries+1)*32 + clusterSize - 1) / clusterSize))
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		f.geometry.setEntry(f.fat, dir.clusters[len(dir.clusters)-1], extra[0])
+		dir.clusters = append(dir.clusters, extra...)
+		dir.data = append(dir.data, make([]byte, int64(len(extra))*clusterSize)...)
+		slot = dir.freeSlots(longEntries + 1)
+	}
+
+	le := binary.LittleEndian
+	checksum := lfnChecksum(short)
+	for i := 0; i < longEntries; i++ {
+		sequence := longEntries - i
+		entry := dir.data[(slot+i)*32 : (slot+i+1)*32]
+		for j := range entry {
+			entry[j] = 0
+		}
+		entry[0] = byte(sequence)
+		if i == 0 {
+			entry[0] |= 0x40
+		}
+		entry[11] = attrLongName
+		entry[13] = checksum
+		for j, offset := range lfnOffsets {
+			unit := uint16(0xffff)
+			if k := (sequence-1)*lfnChars + j; k < len(long) {
+				unit = long[k]
+			} else if k == len(long) {
+				unit = 0
+			}
+			le.PutUint16(entry[offset:], unit)
+		}
+	}
+	entry := dir.data[(slot+longEntries)*32 : (slot+longEntries+1)*32]
+	for j := range entry {
+		entry[j] = 0
+	}
+	copy(entry, short)
+	if entry[0] == 0xe5 {
+		entry[0] = 0x05
+	}
+	entry[11] = attrArchive
+	entry[12] = caseFlags
+	date, t := fatDateTime(f.sources.fatNow())
+	le.PutUint16(entry[14:], t)
+	le.PutUint16(entry[16:], date)
+	le.PutUint16(entry[18:], date)
+	le.PutUint16(entry[22:], t)
+	le.PutUint16(entry[24:], date)
+	if len(clusters) > 0 {
+		le.PutUint16(entry[20:], uint16(clusters[0]>>16))
+		le.PutUint16(entry[26:], uint16(clusters[0]))
+	}
+	le.PutUint32(entry[28:], uint32(len(payload)))
+
+	if err := f.writeDir(dir); err != nil {
+		return err
+	}
+	return f.writeFAT()
+}
+
+// Close has nothing to flush, every write updates the FAT copies
+func (f *fatFS) Close() error {
+	return nil
+}
+
+// label returns the volume label of the root directory or the boot sector
+func (f *fatFS) label() string {
+	if dir, err := f.rootDir(); err == nil {
+		for slot := 0; slot*32+32 <= len(dir.data); slot++ {
+			entry := dir.data[slot*32 : slot*32+32]
+			if entry[0] == 0 {
+				break
+			}
+			if entry[0] != 0xe5 && entry[11]&0x3f != attrLongName && entry[11]&attrVolumeID != 0 {
+				return strings.TrimRight(string(entry[0:11]), " ")
+			}
+		}
+	}
+	sector := make([]byte, 512)
+	if _, err := f.dev.ReadAt(sector, 0); err != nil {
+		return ""
+	}
+	offset := 38
+	if f.geometry.Bits == 32 {
+		offset = 66
+	}
+	if sector[offset] != 0x29 {
+		return ""
+	}
+	label := strings.TrimRight(string(sector[offset+5:offset+16]), " ")
+	if label == "NO NAME" {
+		return ""
+	}
+	return label
+}
+
+// normalize sets the times of all directory entries and the volume ID, it
+// makes file systems created by other tools reproducible
+func (f *fatFS) normalize(t time.Time, volumeID uint32) error {
+	le := binary.LittleEndian
+	date, timeOfDay := fatDateTime(t)
+	var walk func(dir *fatDir, depth int) error
+	walk = func(dir *fatDir, depth int) error {
+		if depth > 64 {
+			return fmt.Errorf("directories nested too deep")
+		}
+		for slot := 0; slot*32+32 <= len(dir.data); slot++ {
+			entry := dir.data[slot*32 : slot*32+32]
+			if entry[0] == 0 {
+				break
+			}
+			if entry[0] == 0xe5 || entry[11]&0x3f == attrLongName {
+				continue
+			}
+			entry[13] = 0
+			le.PutUint16(entry[14:], timeOfDay)
+			le.PutUint16(entry[16:], date)
+			le.PutUint16(entry[18:], date)
+			le.PutUint16(entry[22:], timeOfDay)
+			le.PutUint16(entry[24:], date)
+			if entry[11]&attrDirectory == 0 || entry[0] == '.' {
+				continue
+			}
+			cluster := uint32(le.Uint16(entry[26:])) | uint32(le.Uint16(entry[20:]))<<16
+			clusters := f.chain(cluster)
+			data, err := f.readClusters(clusters)
+			if err != nil {
+				return err
+			}
+			if err := walk(&fatDir{clusters: clusters, data: data}, depth+1); err != nil {
+				return err
+			}
+		}
+		return f.writeDir(dir)
+	}
+	root, err := f.rootDir()
+	if err != nil {
+		return err
+	}
+	if err := walk(root, 0); err != nil {
+		return err
+	}
+
+	offset := int64(39)
+	sectors := []int64{0}
+	if f.geometry.Bits == 32 {
+		offset = 67
+		sector := make([]byte, 512)
+		if _, err := f.dev.ReadAt(sector, 0); err != nil {
+			return err
+		}
+		if backup := int64(le.Uint16(sector[50:])); backup != 0 && backup != 0xffff {
+			sectors = append(sectors, backup)
+		}
+	}
+	id := make([]byte, 4)
+	le.PutUint32(id, volumeID)
+	for _, sector := range sectors {
+		if _, err := f.dev.WriteAt(id, sector*f.geometry.BytesPerSector+offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package piccu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fat12Image writes a 1 MiB FAT12 file system without partition table, the
+// layout of mkfs.fat -F 12 for a floppy sized disk
+func fat12Image(t *testing.T) string {
+	t.Helper()
+	const sectors = 2048
+	image := make([]byte, sectors*512)
+	le := binary.LittleEndian
+	boot := image[:512]
+	copy(boot, []byte{0xeb, 0x3c, 0x90})
+	copy(boot[3:], "mkfs.fat")
+	le.PutUint16(boot[11:], 512)
+	boot[13] = 1
+	le.PutUint16(boot[14:], 1)
+	boot[16] = 2
+	le.PutUint16(boot[17:], 224)
+	le.PutUint16(boot[19:], sectors)
+	boot[21] = 0xf8
+	le.PutUint16(boot[22:], 6)
+	le.PutUint16(boot[24:], 32)
+	le.PutUint16(boot[26:], 2)
+	boot[36] = 0x80
+	boot[38] = 0x29
+	le.PutUint32(boot[39:], 0x12345678)
+	copy(boot[43:], "BOOT       FAT12   ")
+	boot[510], boot[511] = 0x55, 0xaa
+	for fat := 0; fat < 2; fat++ {
+		copy(image[(1+fat*6)*512:], []byte{0xf8, 0xff, 0xff})
+	}
+	file := filepath.Join(t.TempDir(), "fat12.img")
+	if err := os.WriteFile(file, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFAT12InjectFile(t *testing.T) {
+	file := fat12Image(t)
+	files := map[string][]byte{
+		"config.txt":           []byte("arm_64bit=1\n"),
+		"cmdline.txt":          []byte("console=tty1 root=LABEL=writable\n"),
+		"user-data":            bytes.Repeat([]byte("#cloud-config\n"), 1000),
+		"network-config.yaml":  []byte("version: 2\n"),
+		"network-config.yaml~": []byte("backup\n"),
+		"README":               bytes.Repeat([]byte{0xaa}, 1537),
+	}
+	img, err := OpenImage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.BootPartition().FSType != "fat12" {
+		t.Fatalf("boot partition is %s", describeFS(img.BootPartition()))
+	}
+	for name, content := range files {
+		if err := img.InjectFile(name, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// replacing frees the old clusters
+	files["user-data"] = []byte("#cloud-config\nhostname: pi\n")
+	if err := img.InjectFile("user-data", files["user-data"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err = OpenImageReadOnly(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	for name, want := range files {
+		got, err := img.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s has %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+	entries, err := img.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if len(names) != len(files) {
+		t.Errorf("root directory lists %s", strings.Join(names, ", "))
+	}
+	if label := img.BootPartition().FSLabel; label != "BOOT" {
+		t.Errorf("label = %q", label)
+	}
+
+	raw, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	info, err := raw.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range CheckFAT(raw, info.Size()) {
+		t.Error(problem)
+	}
+}
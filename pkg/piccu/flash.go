@@ -0,0 +1,139 @@
+package piccu
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtreffer/piccu/pkg/ioutils"
+	"github.com/rtreffer/piccu/pkg/progress"
+)
+
+// Flash writes image to device and reads it back if verify is set. Devices
+// with mounted partitions are refused, other targets than block and
+// character devices are refused unless force is set.
+func Flash(ctx context.Context, image, device string, force, verify bool, reporter progress.Reporter) error {
+	reporter = progress.OrSilent(reporter)
+	imageStat, err := os.Stat(image)
+	if err != nil {
+		return err
+	}
+	deviceStat, err := os.Stat(device)
+	if err != nil {
+		return err
+	}
+	if deviceStat.Mode()&os.ModeDevice == 0 && !force {
+		return fmt.Errorf("%s is not a device, use --force to write it anyway", device)
+	}
+	if mounted, err := mountedPartitions(device); err != nil {
+		return err
+	} else if len(mounted) > 0 {
+		return fmt.Errorf("%s is mounted (%s), unmount it first", device, strings.Join(mounted, ", "))
+	}
+	if deviceStat.Mode()&os.ModeDevice != 0 {
+		size, err := deviceSize(device)
+		if err != nil {
+			return err
+		}
+		if size < imageStat.Size() {
+			return fmt.Errorf("%s has %d bytes, %s needs %d", device, size, image, imageStat.Size())
+		}
+	}
+
+	reporter.Step(fmt.Sprintf("writing %s to %s", image, device))
+	if err := ioutils.Copy(ctx, image, device, reporter); err != nil {
+		return err
+	}
+	if err := syncFile(device); err != nil {
+		return err
+	}
+	if !verify {
+		return nil
+	}
+	reporter.Step(fmt.Sprintf("verifying %s", device))
+	return compareFiles(ctx, image, device, imageStat.Size(), reporter)
+}
+
+// mountedPartitions returns the mounted partitions of device according to
+// /proc/mounts, e.g. /dev/sdb1 for /dev/sdb
+func mountedPartitions(device string) ([]string, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := os.ReadFile("/proc/mounts")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	scanner := bufio.NewScanner(bytes.NewReader(mounts))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/") {
+			continue
+		}
+		source, err := filepath.EvalSymlinks(fields[0])
+		if err != nil {
+			continue
+		}
+		// /dev/sdb1, /dev/mmcblk0p1 and /dev/nvme0n1p1 start with the device
+		if source == resolved || strings.HasPrefix(source, resolved) && strings.Trim(strings.TrimPrefix(source, resolved), "p0123456789") == "" {
+			result = append(result, fields[0]+" on "+fields[1])
+		}
+	}
+	return result, scanner.Err()
+}
+
+func deviceSize(device string) (int64, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.Seek(0, io.SeekEnd)
+}
+
+func syncFile(name string) error {
+	file, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// compareFiles compares the sha256 of the first size bytes of a and b
+func compareFiles(ctx context.Context, a, b string, size int64, reporter progress.Reporter) error {
+	sums := make([][]byte, 0, 2)
+	for _, name := range []string{a, b} {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		transfer := reporter.Transfer("verify "+filepath.Base(name), size)
+		hash := sha256.New()
+		_, err = io.Copy(io.MultiWriter(hash, transfer), ioutils.ContextReader(ctx, io.LimitReader(file, size)))
+		transfer.Done()
+		file.Close()
+		if err != nil {
+			return err
+		}
+		sums = append(sums, hash.Sum(nil))
+	}
+	if !bytes.Equal(sums[0], sums[1]) {
+		return fmt.Errorf("%s differs from %s after writing it", b, a)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package piccu
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rtreffer/piccu/pkg/ioutils"
+)
+
+// OutputFormat is a file a build writes
+type OutputFormat string
+
+const (
+	// FormatImage is the raw image at Output
+	FormatImage OutputFormat = "img"
+	// FormatImageGzip is the gzip compressed image at Output.gz
+	FormatImageGzip OutputFormat = "img.gz"
+	// FormatUserData is the user-data archive next to Output, with .img
+	// replaced by .user-data
+	FormatUserData OutputFormat = "user-data"
+)
+
+// OutputFormats is a repeatable --format flag, empty means FormatImage
+type OutputFormats []OutputFormat
+
+func (f *OutputFormats) Set(value string) error {
+	switch OutputFormat(value) {
+	case FormatImage, FormatImageGzip, FormatUserData:
+		for _, format := range *f {
+			if format == OutputFormat(value) {
+				return nil
+			}
+		}
+		*f = append(*f, OutputFormat(value))
+		return nil
+	}
+	return fmt.Errorf("invalid format %s, expected img, img.gz or user-data", value)
+}
+
+func (f *OutputFormats) String() string {
+	if f == nil || len(*f) == 0 {
+		return string(FormatImage)
+	}
+	formats := make([]string, 0, len(*f))
+	for _, format := range *f {
+		formats = append(formats, string(format))
+	}
+	return strings.Join(formats, ",")
+}
+
+// Has returns true if format is selected, no formats select FormatImage
+func (f OutputFormats) Has(format OutputFormat) bool {
+	if len(f) == 0 {
+		return format == FormatImage
+	}
+	for _, selected := range f {
+		if selected == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the file format is written to for the output image
+func (format OutputFormat) Path(output string) string {
+	switch format {
+	case FormatImageGzip:
+		return output + ".gz"
+	case FormatUserData:
+		return strings.TrimSuffix(output, ".img") + ".user-data"
+	}
+	return output
+}
+
+// ExportSummary describes a file written in addition to the image
+type ExportSummary struct {
+	Format OutputFormat `json:"format"`
+	Path   string       `json:"path"`
+	SHA256 string       `json:"sha256"`
+	Size   int64        `json:"size"`
+}
+
+// export writes the formats other than the raw image to temporary files,
+// they are committed together with the image
+func (b *build) export() error {
+	for _, format := range b.Formats {
+		if format == FormatImage {
+			continue
+		}
+		target := format.Path(b.summary.Output)
+		if err := b.begin("writing %s", target); err != nil {
+			return stageError(StageImage, err, "")
+		}
+		output, err := newOutputFile(target, b.Force)
+		if err != nil {
+			return stageError(StageImage, err, "can't write %s", target)
+		}
+		b.exports = append(b.exports, output)
+		summary, err := b.exportFormat(format, output)
+		if err != nil {
+			return stageError(StageImage, err, "can't write %s", target)
+		}
+		b.summary.Exports = append(b.summary.Exports, summary)
+	}
+	return nil
+}
+
+func (b *build) exportFormat(format OutputFormat, output *outputFile) (ExportSummary, error) {
+	summary := ExportSummary{Format: format, Path: output.Target}
+	file, err := os.OpenFile(output.Path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return summary, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	out := io.MultiWriter(file, hash)
+
+	switch format {
+	case FormatUserData:
+		if _, err := io.WriteString(out, b.userData); err != nil {
+			return summary, err
+		}
+	case FormatImageGzip:
+		if err := b.gzipImage(out); err != nil {
+			return summary, err
+		}
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return summary, err
+	}
+	if err := file.Close(); err != nil {
+		return summary, err
+	}
+	summary.SHA256, summary.Size = hex.EncodeToString(hash.Sum(nil)), stat.Size()
+	return summary, nil
+}
+
+// gzipImage compresses the image to out, the gzip header has no name and
+// no mtime like GzipString
+func (b *build) gzipImage(out io.Writer) error {
+	image, err := os.Open(b.output)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+	stat, err := image.Stat()
+	if err != nil {
+		return err
+	}
+	transfer := b.progress.Transfer("compress "+filepath.Base(b.target), stat.Size())
+	defer transfer.Done()
+	w, err := gzip.NewWriterLevel(out, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, io.TeeReader(ioutils.ContextReader(b.ctx, image), transfer)); err != nil {
+		return err
+	}
+	return w.Close()
+}
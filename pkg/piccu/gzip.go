@@ -3,14 +3,19 @@ package piccu
 import (
 	"bytes"
 	"compress/gzip"
+	"io"
+	"time"
 )
 
+// GzipString compresses input, the gzip header has no name and a zero mtime
+// so the output only depends on the input
 func GzipString(input string) ([]byte, error) {
 	buf := bytes.NewBuffer(make([]byte, 0, len(input)))
 	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
 	if err != nil {
 		return nil, err
 	}
+	w.Header.ModTime = time.Time{}
 	_, err = w.Write([]byte(input))
 	if err != nil {
 		return nil, err
@@ -18,3 +23,17 @@ func GzipString(input string) ([]byte, error) {
 	err = w.Close()
 	return buf.Bytes(), err
 }
+
+// Gunzip decompresses gzip data, other data is returned unchanged because
+// cloud-init accepts both
+func Gunzip(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
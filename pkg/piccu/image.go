@@ -1,103 +1,359 @@
 package piccu
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
-
-	blockfile "go.fuchsia.dev/fuchsia/src/lib/thinfs/block/file"
-	"go.fuchsia.dev/fuchsia/src/lib/thinfs/fs"
-	"go.fuchsia.dev/fuchsia/src/lib/thinfs/fs/msdosfs"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/diskfs/go-diskfs"
-	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+	part "github.com/diskfs/go-diskfs/partition/part"
+
+	"github.com/rtreffer/piccu/pkg/ext4"
 )
 
+// DirEntry is a single entry of a directory on the boot partition
+type DirEntry struct {
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Partition is an entry of the partition table of an image
+type Partition struct {
+	// Index is the 1 based partition number
+	Index int `json:"index"`
+	// Start and Size are in bytes
+	Start int64 `json:"start"`
+	Size  int64 `json:"size"`
+	// Type is the MBR type (e.g. "0c") or GPT type GUID
+	Type string `json:"type"`
+	// Label is the GPT partition name
+	Label string `json:"label,omitempty"`
+	// FSType is fat12, fat16, fat32 or ext4 when detected
+	FSType string `json:"fs_type,omitempty"`
+	// FSLabel is the FAT volume label
+	FSLabel string `json:"fs_label,omitempty"`
+}
+
+// bootLabels are the labels of seed partitions in order of preference:
+// Ubuntu, Raspberry Pi OS (old and new) and NoCloud seed images
+var bootLabels = []string{"system-boot", "boot", "bootfs", "cidata"}
+
+// OpenOptions select how an image is opened
+type OpenOptions struct {
+	ReadOnly bool
+	// BootPartition is the 1 based index of the boot partition, 0 selects
+	// the FAT partition by label or the first FAT partition
+	BootPartition int
+	// Sources are the clock and identifier source of writes
+	Sources Sources
+}
+
 type Image struct {
 	path       string
 	underlying *os.File
-	offset     int64
-	length     int64
-	block      *blockfile.File
-	fs         fs.FileSystem
+	// boot is the partition holding fs, index 0 is a file system without
+	// partition table
+	boot       Partition
+	fs         bootFS
+	partitions []Partition
+	readOnly   bool
+	sources    Sources
+	rootfs     *ext4.FileSystem
+	// rootPartition holds the root file system
+	rootPartition Partition
+	// injected maps boot partition files to the sha256 of their content
+	injected map[string]string
 }
 
-func OpenImage(file string) (result *Image, err error) {
-	result = &Image{
-		path: file,
+// partitionDevice gives access to one partition of the image file
+type partitionDevice struct {
+	file   *os.File
+	offset int64
+	size   int64
+}
+
+func (dev *partitionDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= dev.size {
+		return 0, io.EOF
+	}
+	if remaining := dev.size - off; int64(len(p)) > remaining {
+		n, err := dev.file.ReadAt(p[:remaining], dev.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
 	}
+	return dev.file.ReadAt(p, dev.offset+off)
+}
 
-	disk, err := diskfs.Open(file)
-	if err != nil {
-		return
+func (dev *partitionDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > dev.size {
+		return 0, fmt.Errorf("write at %d beyond the partition end", off)
 	}
+	return dev.file.WriteAt(p, dev.offset+off)
+}
 
-	blockSize := disk.PhysicalBlocksize
+func OpenImage(file string) (result *Image, err error) {
+	return OpenImageWith(file, OpenOptions{})
+}
 
-	partitionTable, err := disk.GetPartitionTable()
-	if err != nil {
-		disk.File.Close()
-		return
+// OpenImageReadOnly opens an image without write access, e.g. the cached
+// image in order to read facts
+func OpenImageReadOnly(file string) (result *Image, err error) {
+	return OpenImageWith(file, OpenOptions{ReadOnly: true})
+}
+
+// OpenImageWith opens an image and mounts its boot partition, MBR and GPT
+// partition tables and FAT12, FAT16 and FAT32 are supported
+func OpenImageWith(file string, options OpenOptions) (result *Image, err error) {
+	result = &Image{
+		path:     file,
+		readOnly: options.ReadOnly,
+		sources:  options.Sources,
 	}
 
-	partitions := partitionTable.GetPartitions()
-	for i := 1; i <= len(partitions); i++ {
-		fs, err := disk.GetFilesystem(i)
-		if err != nil || fs.Type() != filesystem.TypeFat32 {
-			continue
+	mode := diskfs.ReadWriteExclusive
+	if options.ReadOnly {
+		mode = diskfs.ReadOnly
+	}
+	disk, err := diskfs.OpenWithMode(file, mode)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := disk.PhysicalBlocksize
+	if partitionTable, err := disk.GetPartitionTable(); err == nil {
+		partitions := partitionTable.GetPartitions()
+		for i := 1; i <= len(partitions); i++ {
+			if partition, ok := newPartition(i, partitions[i-1]); ok {
+				result.partitions = append(result.partitions, probePartition(disk.File, partition))
+			}
 		}
-
-		result.offset = partitions[i-1].GetStart()
-		result.length = partitions[i-1].GetSize()
-		break
 	}
-
+	size := disk.Size
 	disk.File.Close()
 
-	result.underlying, err = os.OpenFile(file, os.O_RDWR|os.O_EXCL, os.FileMode(0644))
+	result.boot, err = selectBootPartition(file, result.partitions, options.BootPartition, size)
 	if err != nil {
 		return nil, err
 	}
 
-	result.block, err = blockfile.NewRange(result.underlying, blockSize, result.offset, result.length)
+	flags := os.O_RDWR | os.O_EXCL
+	if options.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	result.underlying, err = os.OpenFile(file, flags, os.FileMode(0644))
 	if err != nil {
-		result.underlying.Close()
 		return nil, err
 	}
 
-	result.fs, err = msdosfs.New("/", result.block, fs.ReadWrite)
+	dev := &partitionDevice{file: result.underlying, offset: result.boot.Start, size: result.boot.Size}
+	if result.boot.FSType == "fat12" {
+		result.fs, err = newFatFS(dev, options.ReadOnly, options.Sources)
+	} else {
+		result.fs, err = newThinFS(dev, blockSize, options.ReadOnly, options.Sources)
+	}
 	if err != nil {
 		result.underlying.Close()
-		return nil, err
+		return nil, fmt.Errorf("partition %d: %s", result.boot.Index, err)
 	}
-
 	return result, nil
 }
 
+// probePartition detects FAT and ext4 file systems and reads FAT labels
+func probePartition(file *os.File, partition Partition) Partition {
+	dev := &partitionDevice{file: file, offset: partition.Start, size: partition.Size}
+	if fat, err := newFatFS(dev, true, Sources{}); err == nil {
+		partition.FSType = fmt.Sprintf("fat%d", fat.geometry.Bits)
+		partition.FSLabel = fat.label()
+	} else if ext4.Probe(dev) {
+		partition.FSType = "ext4"
+	}
+	return partition
+}
+
+// selectBootPartition picks the partition by index, by label or the first
+// FAT partition. A FAT file system without partition table is used whole.
+func selectBootPartition(file string, partitions []Partition, index int, size int64) (Partition, error) {
+	if index > 0 {
+		for _, partition := range partitions {
+			if partition.Index != index {
+				continue
+			}
+			if !strings.HasPrefix(partition.FSType, "fat") {
+				return partition, fmt.Errorf("boot partition %d of %s is not FAT but %s", index, file, describeFS(partition))
+			}
+			return partition, nil
+		}
+		return Partition{}, fmt.Errorf("%s has no partition %d", file, index)
+	}
+	for _, label := range bootLabels {
+		for _, partition := range partitions {
+			if strings.HasPrefix(partition.FSType, "fat") &&
+				(strings.EqualFold(partition.FSLabel, label) || strings.EqualFold(partition.Label, label)) {
+				return partition, nil
+			}
+		}
+	}
+	for _, partition := range partitions {
+		if strings.HasPrefix(partition.FSType, "fat") {
+			return partition, nil
+		}
+	}
+	if file, err := os.Open(file); err == nil {
+		whole := probePartition(file, Partition{Size: size})
+		file.Close()
+		if strings.HasPrefix(whole.FSType, "fat") {
+			return whole, nil
+		}
+	}
+	if len(partitions) == 0 {
+		return Partition{}, fmt.Errorf("%s has no partition table and no FAT file system", file)
+	}
+	found := make([]string, 0, len(partitions))
+	for _, partition := range partitions {
+		found = append(found, fmt.Sprintf("%d (%s)", partition.Index, describeFS(partition)))
+	}
+	return Partition{}, fmt.Errorf("%s has no FAT boot partition, partitions: %s", file, strings.Join(found, ", "))
+}
+
+func describeFS(partition Partition) string {
+	if partition.FSType == "" {
+		return "type " + partition.Type
+	}
+	return partition.FSType
+}
+
+// BootPartition returns the partition that holds the boot files
+func (img *Image) BootPartition() Partition {
+	return img.boot
+}
+
+func newPartition(index int, p part.Partition) (Partition, bool) {
+	result := Partition{
+		Index: index,
+		Start: p.GetStart(),
+		Size:  p.GetSize(),
+	}
+	switch p := p.(type) {
+	case *mbr.Partition:
+		if p.Type == mbr.Empty {
+			return result, false
+		}
+		result.Type = fmt.Sprintf("%02x", byte(p.Type))
+	case *gpt.Partition:
+		if p.Type == gpt.Unused {
+			return result, false
+		}
+		result.Type = string(p.Type)
+		result.Label = p.Name
+	}
+	return result, result.Size > 0
+}
+
+// Partitions returns the used entries of the partition table
+func (img *Image) Partitions() []Partition {
+	return img.partitions
+}
+
+// RootFS opens the root file system, this is the ext4 partition labelled
+// "writable" or the first ext4 partition. It is writable unless the image
+// was opened read-only.
+func (img *Image) RootFS() (*ext4.FileSystem, error) {
+	if img.rootfs != nil {
+		return img.rootfs, nil
+	}
+	var fallback *ext4.FileSystem
+	var fallbackPartition Partition
+	for _, partition := range img.partitions {
+		dev := &partitionDevice{file: img.underlying, offset: partition.Start, size: partition.Size}
+		if !ext4.Probe(dev) {
+			continue
+		}
+		var rootfs *ext4.FileSystem
+		var err error
+		if img.readOnly {
+			rootfs, err = ext4.New(dev)
+		} else {
+			if rootfs, err = ext4.NewWritable(dev); err == nil {
+				rootfs.SetSources(img.sources.ext4())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("partition %d: %s", partition.Index, err)
+		}
+		if rootfs.Label() == "writable" {
+			img.rootfs, img.rootPartition = rootfs, partition
+			return rootfs, nil
+		}
+		if fallback == nil {
+			fallback, fallbackPartition = rootfs, partition
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("no ext4 root partition in %s", img.path)
+	}
+	img.rootfs, img.rootPartition = fallback, fallbackPartition
+	return fallback, nil
+}
+
+// Close unmounts the boot partition, syncs and closes the image file
 func (img *Image) Close() error {
-	// close the filesystem, block backend, file
-	img.fs.Close()
-	img.block.Flush()
-	img.block.Close()
-	img.underlying.Sync()
-	return img.underlying.Close()
+	fsErr := img.fs.Close()
+	syncErr := img.underlying.Sync()
+	if err := img.underlying.Close(); err != nil {
+		return err
+	}
+	if fsErr != nil {
+		return fsErr
+	}
+	return syncErr
+}
+
+// Injected returns the hex sha256 of every file written with InjectFile,
+// keyed by path
+func (img *Image) Injected() map[string]string {
+	return img.injected
 }
 
 func (img *Image) InjectFile(path string, payload []byte) error {
-	img.fs.RootDirectory().Unlink(path)
-	file, _, _, err := img.fs.RootDirectory().Open(path, fs.OpenFlagCreate|fs.OpenFlagWrite|fs.OpenFlagFile)
-	if err != nil {
+	if err := img.fs.WriteFile(path, payload); err != nil {
 		return err
 	}
-	defer func() {
-		file.Sync()
-		file.Close()
-	}()
-	n, err := file.Write(payload, 0, fs.WhenceFromStart)
+	if img.injected == nil {
+		img.injected = make(map[string]string)
+	}
+	sum := sha256.Sum256(payload)
+	img.injected[path] = hex.EncodeToString(sum[:])
+	return nil
+}
+
+// InjectRootFile writes a file to the root file system, missing parent
+// directories are created owned by root
+func (img *Image) InjectRootFile(name string, payload []byte, attr ext4.Attr) error {
+	rootfs, err := img.RootFS()
 	if err != nil {
 		return err
 	}
-	if n != len(payload) {
-		return fmt.Errorf("expected to write %d, wrote %d", len(payload), n)
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if err := rootfs.MkdirAll(path.Dir(name), ext4.Attr{Mode: 0755}); err != nil {
+		return err
 	}
-	return nil
+	return rootfs.WriteFile(name, payload, attr)
+}
+
+func (img *Image) ReadFile(path string) ([]byte, error) {
+	return img.fs.ReadFile(path)
+}
+
+func (img *Image) ReadDir(path string) ([]DirEntry, error) {
+	return img.fs.ReadDir(path)
 }
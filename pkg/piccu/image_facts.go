@@ -0,0 +1,258 @@
+package piccu
+
+import (
+	"bufio"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/ext4"
+)
+
+// ImageFacts describes what is installed on the root file system of an image
+type ImageFacts struct {
+	// OSRelease are the keys of /etc/os-release, e.g. VERSION_ID=22.04
+	OSRelease map[string]string
+	// CloudInitVersion is the installed cloud-init package version
+	CloudInitVersion string
+	// KernelVersions are the installed kernels, newest last
+	KernelVersions []string
+	// DefaultUser is the cloud-init default user (e.g. ubuntu)
+	DefaultUser string
+	// Users are the regular users of /etc/passwd
+	Users []string
+
+	root *ext4.FileSystem
+}
+
+// ReadImageFacts reads the facts from the root file system of the image,
+// missing files leave the corresponding facts empty
+func ReadImageFacts(img *Image) (*ImageFacts, error) {
+	root, err := img.RootFS()
+	if err != nil {
+		return nil, err
+	}
+	facts := &ImageFacts{
+		OSRelease: make(map[string]string),
+		root:      root,
+	}
+	if data, err := root.ReadFile("etc/os-release"); err == nil {
+		facts.OSRelease = parseOSRelease(string(data))
+	} else if data, err := root.ReadFile("usr/lib/os-release"); err == nil {
+		facts.OSRelease = parseOSRelease(string(data))
+	}
+	if data, err := root.ReadFile("var/lib/dpkg/status"); err == nil {
+		facts.CloudInitVersion = dpkgVersion(string(data), "cloud-init")
+	}
+	facts.KernelVersions = kernelVersions(root)
+	if data, err := root.ReadFile("etc/cloud/cloud.cfg"); err == nil {
+		facts.DefaultUser = cloudDefaultUser(data)
+	}
+	if data, err := root.ReadFile("etc/passwd"); err == nil {
+		facts.Users = passwdUsers(string(data))
+	}
+	return facts, nil
+}
+
+// KernelVersion returns the newest installed kernel
+func (facts *ImageFacts) KernelVersion() string {
+	if len(facts.KernelVersions) == 0 {
+		return ""
+	}
+	return facts.KernelVersions[len(facts.KernelVersions)-1]
+}
+
+// TemplateKeys returns the facts as template keys, os-release keys are
+// prefixed with IMAGE_OS_ (e.g. IMAGE_OS_VERSION_ID)
+func (facts *ImageFacts) TemplateKeys() map[string]string {
+	keys := make(map[string]string)
+	for k, v := range facts.OSRelease {
+		keys["IMAGE_OS_"+k] = v
+	}
+	keys["IMAGE_CLOUD_INIT_VERSION"] = facts.CloudInitVersion
+	keys["IMAGE_KERNEL_VERSION"] = facts.KernelVersion()
+	keys["IMAGE_DEFAULT_USER"] = facts.DefaultUser
+	keys["IMAGE_USERS"] = strings.Join(facts.Users, ",")
+	return keys
+}
+
+// Validate checks expanded files against the image, e.g. that the
+// interpreter of each script exists. The image must still be open.
+func (facts *ImageFacts) Validate(files cicci.ExpandedFiles) (result []error) {
+	for _, file := range files {
+		if !file.IsScript {
+			continue
+		}
+		interpreter := shebangInterpreter(file.Content)
+		if interpreter == "" || !path.IsAbs(interpreter) {
+			continue
+		}
+		info, err := facts.root.Stat(strings.TrimPrefix(interpreter, "/"))
+		if err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			result = append(result,
+				fmt.Errorf("%s: interpreter %s does not exist in the image", file.OriginalFilename, interpreter))
+		}
+	}
+	if facts.CloudInitVersion == "" {
+		result = append(result, fmt.Errorf("cloud-init is not installed in the image"))
+	}
+	return
+}
+
+func shebangInterpreter(content string) string {
+	if !strings.HasPrefix(content, "#!") {
+		return ""
+	}
+	line := strings.SplitN(content[2:], "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+func parseOSRelease(content string) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := parts[1]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, "'\"")
+		}
+		result[parts[0]] = value
+	}
+	return result
+}
+
+// dpkgVersion returns the version of an installed package from dpkg status
+func dpkgVersion(status, pkg string) string {
+	scanner := bufio.NewScanner(strings.NewReader(status))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	name, version, installed := "", "", false
+	for {
+		more := scanner.Scan()
+		line := scanner.Text()
+		if !more || line == "" {
+			if name == pkg && installed {
+				return version
+			}
+			if !more {
+				return ""
+			}
+			name, version, installed = "", "", false
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "Package:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "Package:"))
+		case strings.HasPrefix(line, "Version:"):
+			version = strings.TrimSpace(strings.TrimPrefix(line, "Version:"))
+		case strings.HasPrefix(line, "Status:"):
+			installed = strings.HasSuffix(strings.TrimSpace(line), " installed")
+		}
+	}
+}
+
+func kernelVersions(root *ext4.FileSystem) []string {
+	var result []string
+	if entries, err := root.ReadDir("lib/modules"); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				result = append(result, entry.Name())
+			}
+		}
+	}
+	if len(result) == 0 {
+		entries, _ := root.ReadDir("boot")
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "vmlinuz-") {
+				result = append(result, strings.TrimPrefix(entry.Name(), "vmlinuz-"))
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return compareVersions(result[i], result[j]) < 0
+	})
+	return result
+}
+
+// compareVersions compares versions like 5.15.0-1010-raspi, runs of digits
+// compare as numbers and everything else byte by byte
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		aDigits, bDigits := isDigit(a[0]), isDigit(b[0])
+		if aDigits != bDigits {
+			return strings.Compare(a, b)
+		}
+		aRun, bRun := leadingRun(a, aDigits), leadingRun(b, bDigits)
+		if aDigits {
+			aNum, bNum := strings.TrimLeft(aRun, "0"), strings.TrimLeft(bRun, "0")
+			if len(aNum) != len(bNum) {
+				return len(aNum) - len(bNum)
+			}
+		}
+		if c := strings.Compare(aRun, bRun); c != 0 {
+			return c
+		}
+		a, b = a[len(aRun):], b[len(bRun):]
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// leadingRun returns the leading digits or non-digits of s
+func leadingRun(s string, digits bool) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i]
+}
+
+func cloudDefaultUser(cloudCfg []byte) string {
+	var cfg struct {
+		SystemInfo struct {
+			DefaultUser struct {
+				Name string `yaml:"name"`
+			} `yaml:"default_user"`
+		} `yaml:"system_info"`
+	}
+	if err := yaml.Unmarshal(cloudCfg, &cfg); err != nil {
+		return ""
+	}
+	return cfg.SystemInfo.DefaultUser.Name
+}
+
+// passwdUsers returns the users with a regular uid (1000 to 65533)
+func passwdUsers(passwd string) []string {
+	var result []string
+	for _, line := range strings.Split(passwd, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil || uid < 1000 || uid >= 65534 {
+			continue
+		}
+		result = append(result, fields[0])
+	}
+	return result
+}
@@ -0,0 +1,18 @@
+package piccu
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	versions := []string{"5.15.0-1010-raspi", "5.4.0-1080-raspi", "5.15.0-999-raspi", "5.15.0-1010-raspi+", "5.15.0-1010"}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+	want := []string{"5.4.0-1080-raspi", "5.15.0-999-raspi", "5.15.0-1010", "5.15.0-1010-raspi", "5.15.0-1010-raspi+"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("got %q, want %q", versions, want)
+	}
+}
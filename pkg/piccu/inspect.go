@@ -0,0 +1,78 @@
+package piccu
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+)
+
+// Inspection describes what was baked into an image
+type Inspection struct {
+	Image      string      `json:"image"`
+	Partitions []Partition `json:"partitions"`
+	// BootPartition is the index of the boot partition, 0 without table
+	BootPartition int `json:"boot_partition"`
+	// BootFiles lists the boot partition recursively, names are paths
+	BootFiles     []DirEntry          `json:"boot_files"`
+	UserData      []cicci.ArchivePart `json:"user_data,omitempty"`
+	VendorData    []cicci.ArchivePart `json:"vendor_data,omitempty"`
+	MetaData      string              `json:"meta_data,omitempty"`
+	NetworkConfig string              `json:"network_config,omitempty"`
+}
+
+// Inspect reads the partitions, boot files and NoCloud files of an image
+func Inspect(img *Image) (*Inspection, error) {
+	result := &Inspection{
+		Image:         img.path,
+		Partitions:    img.Partitions(),
+		BootPartition: img.BootPartition().Index,
+	}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := img.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("%s: %s", dir, err)
+		}
+		for _, entry := range entries {
+			entry.Name = path.Join(dir, entry.Name)
+			result.BootFiles = append(result.BootFiles, entry)
+			if entry.IsDir {
+				if err := walk(entry.Name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("."); err != nil {
+		return nil, err
+	}
+
+	for _, archive := range []struct {
+		name  string
+		parts *[]cicci.ArchivePart
+	}{
+		{"user-data", &result.UserData},
+		{"vendor-data", &result.VendorData},
+	} {
+		data, err := img.ReadFile(archive.name)
+		if err != nil {
+			continue
+		}
+		data, err = Gunzip(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", archive.name, err)
+		}
+		if *archive.parts, err = cicci.ParseMultipartArchive(string(data)); err != nil {
+			return nil, fmt.Errorf("%s: %s", archive.name, err)
+		}
+	}
+	if data, err := img.ReadFile("meta-data"); err == nil {
+		result.MetaData = string(data)
+	}
+	if data, err := img.ReadFile("network-config"); err == nil {
+		result.NetworkConfig = string(data)
+	}
+	return result, nil
+}
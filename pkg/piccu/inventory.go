@@ -0,0 +1,268 @@
+package piccu
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rtreffer/piccu/pkg/progress"
+)
+
+// DefaultWorkers is the number of images an inventory builds at once
+const DefaultWorkers = 4
+
+// Inventory is a hosts.yaml, the hosts of a batch build. Variables of a host
+// override the ones of its groups, in order, which override the global ones.
+// Relative paths are relative to the directory of the file.
+type Inventory struct {
+	Variables map[string]interface{} `yaml:"variables"`
+	// Inputs are merged into the user-data of every host
+	Inputs []string                  `yaml:"inputs"`
+	Groups map[string]InventoryGroup `yaml:"groups"`
+	Hosts  map[string]InventoryHost  `yaml:"hosts"`
+
+	// Path is the file the inventory was loaded from
+	Path string `yaml:"-"`
+}
+
+// InventoryGroup are variables and inputs shared by hosts
+type InventoryGroup struct {
+	Variables map[string]interface{} `yaml:"variables"`
+	// Inputs are merged into the user-data of every host of the group
+	Inputs []string `yaml:"inputs"`
+}
+
+// InventoryHost is a single image of a batch build
+type InventoryHost struct {
+	Groups    []string               `yaml:"groups"`
+	Variables map[string]interface{} `yaml:"variables"`
+	// Inputs are merged into the user-data of the host
+	Inputs []string `yaml:"inputs"`
+	// Output is the image of the host, default HOST.img
+	Output string `yaml:"output"`
+}
+
+// hostNamePattern are valid hostnames, they name the output files
+var hostNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?$`)
+
+// LoadInventory reads an inventory and checks its hosts and groups
+func LoadInventory(path string) (*Inventory, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inventory := &Inventory{Path: path}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(inventory); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(inventory.Hosts) == 0 {
+		return nil, fmt.Errorf("%s: no hosts", path)
+	}
+	for _, name := range inventory.HostNames() {
+		if !hostNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid hostname %s", path, name)
+		}
+		for _, group := range inventory.Hosts[name].Groups {
+			if _, found := inventory.Groups[group]; !found {
+				return nil, fmt.Errorf("%s: host %s: unknown group %s", path, name, group)
+			}
+		}
+	}
+	return inventory, nil
+}
+
+// HostNames returns the hosts in alphabetical order
+func (inv *Inventory) HostNames() []string {
+	names := make([]string, 0, len(inv.Hosts))
+	for name := range inv.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// path resolves a path of the inventory file
+func (inv *Inventory) path(name string) string {
+	dir := filepath.Dir(inv.Path)
+	if name == "" || dir == "." || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// HostVariables returns the template keys of a host: the global variables,
+// the ones of its groups and its own, later ones win. hostname defaults to
+// the name of the host.
+func (inv *Inventory) HostVariables(name string) map[string]string {
+	host := inv.Hosts[name]
+	result := map[string]string{"hostname": name}
+	layers := []map[string]interface{}{inv.Variables}
+	for _, group := range host.Groups {
+		layers = append(layers, inv.Groups[group].Variables)
+	}
+	layers = append(layers, host.Variables)
+	for _, layer := range layers {
+		for key, value := range layer {
+			result[key] = fmt.Sprint(value)
+		}
+	}
+	return result
+}
+
+// HostInputs returns the global inputs, the ones of the groups and then the
+// ones of the host itself
+func (inv *Inventory) HostInputs(name string) []string {
+	host := inv.Hosts[name]
+	var inputs []string
+	for _, input := range inv.Inputs {
+		inputs = append(inputs, inv.path(input))
+	}
+	for _, group := range host.Groups {
+		for _, input := range inv.Groups[group].Inputs {
+			inputs = append(inputs, inv.path(input))
+		}
+	}
+	for _, input := range host.Inputs {
+		inputs = append(inputs, inv.path(input))
+	}
+	return inputs
+}
+
+// uniqueInputs drops inputs that name the same path as an earlier one
+func uniqueInputs(inputs []string) []string {
+	seen := make(map[string]bool, len(inputs))
+	result := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		if clean := filepath.Clean(input); !seen[clean] {
+			seen[clean] = true
+			result = append(result, input)
+		}
+	}
+	return result
+}
+
+// HostOutput returns the image file of a host
+func (inv *Inventory) HostOutput(name string) string {
+	if output := inv.Hosts[name].Output; output != "" {
+		return inv.path(output)
+	}
+	return inv.path(name + ".img")
+}
+
+// HostBuilder returns the builder of a host: base with the inputs, secrets,
+// hostname and output of the host, the variables override the secrets of
+// base. The inputs of base are shared by every host and come first, inputs
+// listed more than once are merged once, at their first position.
+func (inv *Inventory) HostBuilder(base *Builder, name string) *Builder {
+	builder := *base
+	builder.host = name
+	builder.Inputs = uniqueInputs(append(append([]string{}, base.Inputs...), inv.HostInputs(name)...))
+	builder.ExcludeInputs = append(append([]string{}, base.ExcludeInputs...), inv.Path)
+	builder.Secrets = make(map[string]string)
+	for key, value := range base.Secrets {
+		builder.Secrets[key] = value
+	}
+	variables := inv.HostVariables(name)
+	for key, value := range variables {
+		builder.Secrets[key] = value
+	}
+	builder.Hostname = variables["hostname"]
+	builder.Output = inv.HostOutput(name)
+	if base.Progress != nil {
+		builder.Progress = progress.Prefixed(base.Progress, name+": ")
+	}
+	return &builder
+}
+
+// BatchError is returned by BuildInventory if some hosts failed, it unwraps
+// to the error of the first failed host
+type BatchError struct {
+	Hosts  int
+	Failed []string
+	Err    error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d hosts failed: %s", len(e.Failed), e.Hosts, strings.Join(e.Failed, ", "))
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// BuildInventory builds the image of every host of inventory from base.
+// The base image is fetched or hashed once, the output directories are
+// created, up to workers images are built at once, default DefaultWorkers.
+// The summaries are in the order of HostNames, failed hosts don't stop the
+// others. Every host reports its own errors and summary.
+func BuildInventory(ctx context.Context, base *Builder, inventory *Inventory, workers int) ([]*BuildSummary, error) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if base.LockFile != "" {
+		return nil, stageError(StageInput, fmt.Errorf("lock files are not supported by inventory builds"), "")
+	}
+	shared := *base
+	if shared.BaseImage == "" {
+		state := &build{Builder: base, ctx: ctx, progress: progress.OrSilent(base.Progress), summary: &BuildSummary{}}
+		if err := state.download(); err != nil {
+			return nil, err
+		}
+		shared.prefetched = state.cached
+	} else {
+		sum, _, err := hashFile(ctx, base.BaseImage, base.BaseImage, progress.OrSilent(base.Progress))
+		if err != nil {
+			return nil, stageError(StageInput, err, "can't hash %s", base.BaseImage)
+		}
+		shared.baseImageSHA256 = sum
+	}
+
+	names := inventory.HostNames()
+	for _, name := range names {
+		if err := os.MkdirAll(filepath.Dir(inventory.HostOutput(name)), 0755); err != nil {
+			return nil, stageError(StageInput, err, "can't create the output directory of %s", name)
+		}
+	}
+	summaries := make([]*BuildSummary, len(names))
+	errs := make([]error, len(names))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range queue {
+				summaries[index], errs[index] = inventory.HostBuilder(&shared, names[index]).Build(ctx)
+			}
+		}()
+	}
+	for index := range names {
+		queue <- index
+	}
+	close(queue)
+	wg.Wait()
+
+	batchErr := &BatchError{Hosts: len(names)}
+	for index, err := range errs {
+		if err != nil {
+			batchErr.Failed = append(batchErr.Failed, names[index])
+			if batchErr.Err == nil {
+				batchErr.Err = err
+			}
+		}
+	}
+	if batchErr.Err != nil {
+		return summaries, batchErr
+	}
+	return summaries, nil
+}
@@ -0,0 +1,54 @@
+package piccu
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInventoryHostBuilder(t *testing.T) {
+	inventory, err := LoadInventory(filepath.Join("..", "..", "inventory", "hosts.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	examples := filepath.Join("..", "..", "examples")
+	base := &Builder{Inputs: []string{filepath.Join(examples, "piuser.yaml"), "extra.yaml"}, Secrets: map[string]string{"domain": "example.org", "token": "secret"}}
+	tests := []struct {
+		host      string
+		inputs    []string
+		output    string
+		variables map[string]string
+	}{
+		{
+			host:      "grafana",
+			inputs:    []string{"piuser.yaml", "extra.yaml", "hostname.tpl.yaml", "avahi.yaml", "grafana.yaml"},
+			output:    filepath.Join("..", "..", "inventory", "grafana.img"),
+			variables: map[string]string{"hostname": "grafana", "domain": "lan", "role": "monitoring", "token": "secret"},
+		},
+		{
+			host:      "ntp1",
+			inputs:    []string{"piuser.yaml", "extra.yaml", "hostname.tpl.yaml", "avahi.yaml", "ntp.yaml"},
+			output:    filepath.Join("..", "..", "inventory", "time", "ntp1.img"),
+			variables: map[string]string{"hostname": "ntp1", "domain": "lan", "token": "secret"},
+		},
+	}
+	for _, test := range tests {
+		builder := inventory.HostBuilder(base, test.host)
+		var inputs []string
+		for _, input := range builder.Inputs {
+			inputs = append(inputs, filepath.Base(input))
+		}
+		if !reflect.DeepEqual(inputs, test.inputs) {
+			t.Errorf("%s: inputs %q, want %q", test.host, inputs, test.inputs)
+		}
+		if builder.Output != test.output || builder.Hostname != test.host {
+			t.Errorf("%s: output %s, hostname %s", test.host, builder.Output, builder.Hostname)
+		}
+		if !reflect.DeepEqual(builder.Secrets, test.variables) {
+			t.Errorf("%s: secrets %v, want %v", test.host, builder.Secrets, test.variables)
+		}
+	}
+	if len(base.Inputs) != 2 || base.Secrets["domain"] != "example.org" {
+		t.Error("HostBuilder changed the base builder")
+	}
+}
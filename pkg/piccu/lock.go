@@ -0,0 +1,226 @@
+package piccu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+)
+
+// LockFile is the lock file written next to piccu.yaml
+const LockFile = "piccu.lock"
+
+// lockVersion is the format version of lock files
+const lockVersion = 1
+
+// Lock pins what went into a build: the base image, the hash of every
+// input file and the names of the secrets
+type Lock struct {
+	Version int         `json:"version"`
+	Image   LockedImage `json:"image"`
+	// Inputs maps user-data, vendor-data, network-config, meta-data and
+	// boot files to their sha256
+	Inputs map[string]string `json:"inputs"`
+	// Secrets are the names of the secrets, never their values
+	Secrets []string `json:"secrets"`
+}
+
+// LockedImage is a release of the image catalog or a local base image
+type LockedImage struct {
+	Release       string `json:"release,omitempty"`
+	Codename      string `json:"codename,omitempty"`
+	Architecture  string `json:"architecture,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Checksum      string `json:"checksum,omitempty"`
+	ImageChecksum string `json:"image_checksum,omitempty"`
+	// File and SHA256 describe a local base image
+	File   string `json:"file,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func lockedImageSource(img ImageSource) LockedImage {
+	return LockedImage{
+		Release:       img.Release,
+		Codename:      img.Codename,
+		Architecture:  img.Architecture,
+		URL:           img.URL,
+		Checksum:      img.Checksum,
+		ImageChecksum: img.ImageChecksum,
+	}
+}
+
+// LoadLock reads a lock file
+func LoadLock(path string) (*Lock, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{}
+	if err := json.Unmarshal(content, lock); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if lock.Version != lockVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", path, lock.Version)
+	}
+	return lock, nil
+}
+
+// Save writes the lock file, replacing it atomically
+func (l *Lock) Save(path string) error {
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	output, err := newOutputFile(path, false)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(output.Path, append(content, '\n'), 0644); err != nil {
+		output.Abort()
+		return err
+	}
+	return output.Commit()
+}
+
+// Diff describes how l drifted from locked, it is empty if nothing changed
+func (l *Lock) Diff(locked *Lock) []string {
+	var result []string
+	if l.Image != locked.Image {
+		result = append(result, fmt.Sprintf("image %s drifted from %s", l.Image.describe(), locked.Image.describe()))
+	}
+	for _, name := range sortedStringKeys(locked.Inputs) {
+		if sum, found := l.Inputs[name]; !found {
+			result = append(result, fmt.Sprintf("input %s was removed", name))
+		} else if sum != locked.Inputs[name] {
+			result = append(result, fmt.Sprintf("input %s changed", name))
+		}
+	}
+	for _, name := range sortedStringKeys(l.Inputs) {
+		if _, found := locked.Inputs[name]; !found {
+			result = append(result, fmt.Sprintf("input %s was added", name))
+		}
+	}
+	secrets := make(map[string]bool)
+	for _, name := range locked.Secrets {
+		secrets[name] = true
+	}
+	for _, name := range l.Secrets {
+		if !secrets[name] {
+			result = append(result, fmt.Sprintf("secret %s was added", name))
+		}
+		delete(secrets, name)
+	}
+	for _, name := range locked.Secrets {
+		if secrets[name] {
+			result = append(result, fmt.Sprintf("secret %s was removed", name))
+		}
+	}
+	return result
+}
+
+func (img LockedImage) describe() string {
+	if img.File != "" {
+		return fmt.Sprintf("%s (sha256:%s)", img.File, img.SHA256)
+	}
+	return fmt.Sprintf("%s:%s (%s, %s)", img.Codename, img.Architecture, img.URL, img.ImageChecksum)
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// DriftError is returned by locked builds whose inputs changed
+type DriftError struct {
+	LockFile string
+	Changes  []string
+}
+
+func (e *DriftError) Error() string {
+	message := fmt.Sprintf("%s is out of date, build without --locked to update it:", e.LockFile)
+	for _, change := range e.Changes {
+		message += "\n  " + change
+	}
+	return message
+}
+
+// lockImage records the base image and, for locked builds, refuses an image
+// that drifted before it is downloaded
+func (b *build) lockImage(image LockedImage) error {
+	if b.lock == nil {
+		return nil
+	}
+	b.lock.Image = image
+	if b.locked != nil && b.locked.Image != image {
+		return &DriftError{LockFile: b.LockFile, Changes: []string{
+			fmt.Sprintf("image %s drifted from %s", image.describe(), b.locked.Image.describe()),
+		}}
+	}
+	return nil
+}
+
+// lockFiles records the sha256 of input files, read from fsys if set
+func (b *build) lockFiles(files cicci.CCFiles, fsys fs.FS) error {
+	if b.lock == nil {
+		return nil
+	}
+	for _, file := range files {
+		var content []byte
+		var err error
+		if fsys != nil {
+			content, err = fs.ReadFile(fsys, string(file))
+		} else {
+			content, err = os.ReadFile(string(file))
+		}
+		if err != nil {
+			return fmt.Errorf("can't hash %s: %w", file, err)
+		}
+		sum := sha256.Sum256(content)
+		b.lock.Inputs[string(file)] = hex.EncodeToString(sum[:])
+	}
+	return nil
+}
+
+// lockInputs records every file that goes into user-data, vendor-data,
+// network-config, meta-data and the boot partition
+func (b *build) lockInputs(files, vendorFiles cicci.CCFiles) error {
+	if b.lock == nil {
+		return nil
+	}
+	if err := b.lockFiles(files, b.InputFS); err != nil {
+		return err
+	}
+	other := append(cicci.CCFiles{}, vendorFiles...)
+	for _, name := range append([]string{b.NetworkConfig, b.MetaData}, b.BootFiles...) {
+		if name != "" {
+			other = append(other, cicci.CCFile(name))
+		}
+	}
+	return b.lockFiles(other, nil)
+}
+
+// checkLock records the secret names and compares the lock of a locked
+// build, other builds write it once they succeeded. The lock is recorded
+// for the manifest even without LockFile.
+func (b *build) checkLock() error {
+	if b.lock == nil {
+		return nil
+	}
+	b.lock.Secrets = sortedStringKeys(b.Secrets)
+	if b.locked == nil {
+		return nil
+	}
+	if changes := b.lock.Diff(b.locked); len(changes) > 0 {
+		return stageError(StageInput, &DriftError{LockFile: b.LockFile, Changes: changes}, "")
+	}
+	return nil
+}
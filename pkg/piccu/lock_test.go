@@ -0,0 +1,61 @@
+package piccu
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testLock() *Lock {
+	return &Lock{
+		Version: lockVersion,
+		Image:   LockedImage{File: "base.img", SHA256: "aa"},
+		Inputs:  map[string]string{"user-data/a.yaml": "01", "user-data/b.yaml": "02", "boot/config.txt": "03"},
+		Secrets: []string{"FOO", "hostname"},
+	}
+}
+
+func TestLockDiff(t *testing.T) {
+	if diff := testLock().Diff(testLock()); len(diff) != 0 {
+		t.Errorf("identical locks differ: %q", diff)
+	}
+
+	current := testLock()
+	current.Image.SHA256 = "bb"
+	current.Inputs["user-data/a.yaml"] = "11"
+	delete(current.Inputs, "user-data/b.yaml")
+	current.Inputs["user-data/c.yaml"] = "04"
+	current.Secrets = []string{"hostname", "BAR"}
+	want := []string{
+		"image base.img (sha256:bb) drifted from base.img (sha256:aa)",
+		"input user-data/a.yaml changed",
+		"input user-data/b.yaml was removed",
+		"input user-data/c.yaml was added",
+		"secret BAR was added",
+		"secret FOO was removed",
+	}
+	if diff := current.Diff(testLock()); !reflect.DeepEqual(diff, want) {
+		t.Errorf("got  %q\nwant %q", diff, want)
+	}
+
+	// the order of secrets doesn't matter
+	reordered := testLock()
+	reordered.Secrets = []string{"hostname", "FOO"}
+	if diff := reordered.Diff(testLock()); len(diff) != 0 {
+		t.Errorf("reordered secrets differ: %q", diff)
+	}
+}
+
+func TestLockSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LockFile)
+	if err := testLock().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, testLock()) {
+		t.Errorf("got %+v, want %+v", loaded, testLock())
+	}
+}
@@ -0,0 +1,326 @@
+package piccu
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/rtreffer/piccu/pkg/cicci"
+	"github.com/rtreffer/piccu/pkg/ioutils"
+	"github.com/rtreffer/piccu/pkg/progress"
+)
+
+// ManifestSuffix names the manifest next to an output
+const ManifestSuffix = ".manifest.json"
+
+// manifestVersion is the format version of manifests
+const manifestVersion = 1
+
+// Manifest describes what went into a build and what came out of it. It
+// never contains secret values, only their names.
+type Manifest struct {
+	Version     int       `json:"version"`
+	ToolVersion string    `json:"tool_version"`
+	BuildTime   time.Time `json:"build_time"`
+	BuildKey    string    `json:"build_key"`
+	// BaseImage is the release or local file the image was built from
+	BaseImage LockedImage `json:"base_image"`
+	// Inputs maps the input files to their sha256
+	Inputs map[string]string `json:"inputs"`
+	// Parts are the parts of user-data and vendor-data in archive order
+	Parts   []ManifestPart `json:"parts"`
+	Secrets []string       `json:"secrets"`
+	// Files maps the files written to the boot partition to their sha256
+	Files   map[string]string `json:"files"`
+	Outputs []ManifestOutput  `json:"outputs"`
+	// Signature is set if the manifest is signed
+	Signature *ManifestSignature `json:"signature,omitempty"`
+}
+
+// ManifestPart is a part of the user-data or vendor-data archive
+type ManifestPart struct {
+	Archive  string `json:"archive"`
+	File     string `json:"file"`
+	Script   bool   `json:"script,omitempty"`
+	Template bool   `json:"template,omitempty"`
+}
+
+// ManifestOutput is a file written by the build
+type ManifestOutput struct {
+	Format OutputFormat `json:"format"`
+	// File is the name of the output, relative to the manifest
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// ManifestSignature is an ed25519 signature of the manifest without it
+type ManifestSignature struct {
+	Algorithm string `json:"algorithm"`
+	// PublicKey is the signing key in authorized_keys format
+	PublicKey string `json:"public_key"`
+	Value     string `json:"value"`
+}
+
+func manifestParts(archive string, files cicci.ExpandedFiles) []ManifestPart {
+	parts := make([]ManifestPart, 0, len(files))
+	for _, file := range files {
+		parts = append(parts, ManifestPart{Archive: archive, File: file.OriginalFilename, Script: file.IsScript, Template: file.IsTemplate})
+	}
+	return parts
+}
+
+// LoadManifest reads a manifest, its signature is not checked
+func LoadManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", path, manifest.Version)
+	}
+	return manifest, nil
+}
+
+// Save writes the manifest, replacing it atomically
+func (m *Manifest) Save(path string) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	output, err := newOutputFile(path, false)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(output.Path, append(content, '\n'), 0644); err != nil {
+		output.Abort()
+		return err
+	}
+	return output.Commit()
+}
+
+// signedContent is the manifest without signature, as signed
+func (m *Manifest) signedContent() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign signs the manifest with key
+func (m *Manifest) Sign(key ed25519.PrivateKey) error {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	content, err := m.signedContent()
+	if err != nil {
+		return err
+	}
+	m.Signature = &ManifestSignature{
+		Algorithm: "ed25519",
+		PublicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(key, content)),
+	}
+	return nil
+}
+
+// VerifySignature checks the signature of the manifest. It must be made by
+// trusted if set, otherwise the embedded public key is used. That proves
+// nothing about the signer, anyone who modified the manifest can sign it
+// again with their own key.
+func (m *Manifest) VerifySignature(trusted ed25519.PublicKey) error {
+	if m.Signature == nil {
+		return errors.New("the manifest is not signed")
+	}
+	if m.Signature.Algorithm != "ed25519" {
+		return fmt.Errorf("unsupported signature algorithm %s", m.Signature.Algorithm)
+	}
+	embedded, err := parsePublicKey([]byte(m.Signature.PublicKey))
+	if err != nil {
+		return fmt.Errorf("invalid public key in manifest: %w", err)
+	}
+	if trusted != nil && !trusted.Equal(embedded) {
+		return errors.New("the manifest is signed by another key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature.Value)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	content, err := m.signedContent()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(embedded, content, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Fingerprint returns the SHA256 fingerprint of the signing key like
+// ssh-keygen -l shows it
+func (s *ManifestSignature) Fingerprint() (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.PublicKey))
+	if err != nil {
+		return "", fmt.Errorf("invalid public key in manifest: %w", err)
+	}
+	return ssh.FingerprintSHA256(key), nil
+}
+
+// LoadSigningKey reads an unencrypted ed25519 private key in OpenSSH or
+// PKCS#8 PEM format
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ssh.ParseRawPrivateKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		return key, nil
+	case *ed25519.PrivateKey:
+		return *key, nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 key", path)
+}
+
+// LoadPublicKey reads an ed25519 public key in authorized_keys or PKIX PEM
+// format
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+func parsePublicKey(content []byte) (ed25519.PublicKey, error) {
+	var key interface{}
+	if block, _ := pem.Decode(content); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = parsed
+	} else {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, err
+		}
+		if cryptoKey, ok := parsed.(ssh.CryptoPublicKey); ok {
+			key = cryptoKey.CryptoPublicKey()
+		}
+	}
+	if key, ok := key.(ed25519.PublicKey); ok {
+		return key, nil
+	}
+	return nil, errors.New("not an ed25519 key")
+}
+
+// ManifestError lists the differences between an image and its manifest
+type ManifestError struct {
+	Problems []string
+}
+
+func (e *ManifestError) Error() string {
+	return "the image doesn't match its manifest: " + strings.Join(e.Problems, ", ")
+}
+
+// VerifyManifest checks the sha256 of image against the output of the
+// manifest with the same file name, or the raw image. Only the size of the
+// output is read, so a device the image was flashed to can be checked.
+func VerifyManifest(ctx context.Context, image string, manifest *Manifest, reporter progress.Reporter) error {
+	reporter = progress.OrSilent(reporter)
+	var output *ManifestOutput
+	for i := range manifest.Outputs {
+		candidate := &manifest.Outputs[i]
+		if candidate.File == filepath.Base(image) || (output == nil && candidate.Format == FormatImage) {
+			output = candidate
+		}
+	}
+	if output == nil {
+		return errors.New("the manifest lists no image")
+	}
+	in, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	transfer := reporter.Transfer("hash "+filepath.Base(image), output.Size)
+	defer transfer.Done()
+	hash := sha256.New()
+	read, err := io.Copy(io.MultiWriter(hash, transfer), ioutils.ContextReader(ctx, io.LimitReader(in, output.Size)))
+	if err != nil {
+		return err
+	}
+	var problems []string
+	if read != output.Size {
+		problems = append(problems, fmt.Sprintf("%s has %d bytes, expected %d", image, read, output.Size))
+	} else if sum := hex.EncodeToString(hash.Sum(nil)); sum != output.SHA256 {
+		problems = append(problems, fmt.Sprintf("%s has sha256 %s, expected %s", image, sum, output.SHA256))
+	}
+	if len(problems) > 0 {
+		return &ManifestError{Problems: problems}
+	}
+	return nil
+}
+
+// saveManifest writes the manifest of the outputs, signed if ManifestKey is
+// set. Devices have no manifest.
+func (b *build) saveManifest() error {
+	if b.manifestFile == "" {
+		return nil
+	}
+	manifest := &Manifest{
+		Version:     manifestVersion,
+		ToolVersion: GetVersion(),
+		BuildTime:   b.started.UTC(),
+		BuildKey:    b.summary.BuildKey,
+		BaseImage:   b.lock.Image,
+		Inputs:      b.lock.Inputs,
+		Parts:       b.parts,
+		Secrets:     b.lock.Secrets,
+		Files:       b.injected,
+		Outputs:     []ManifestOutput{},
+	}
+	if b.summary.Output != "" {
+		manifest.Outputs = append(manifest.Outputs, ManifestOutput{Format: FormatImage, File: filepath.Base(b.summary.Output), SHA256: b.summary.SHA256, Size: b.summary.Size})
+	}
+	for _, export := range b.summary.Exports {
+		manifest.Outputs = append(manifest.Outputs, ManifestOutput{Format: export.Format, File: filepath.Base(export.Path), SHA256: export.SHA256, Size: export.Size})
+	}
+	if b.signingKey != nil {
+		if err := manifest.Sign(b.signingKey); err != nil {
+			return err
+		}
+	}
+	if err := manifest.Save(b.manifestFile); err != nil {
+		return err
+	}
+	b.summary.Manifest = b.manifestFile
+	return nil
+}
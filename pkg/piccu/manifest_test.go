@@ -0,0 +1,48 @@
+package piccu
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestManifestSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &Manifest{Version: manifestVersion, BuildKey: "key", Inputs: map[string]string{"a.yaml": "01"}}
+	if err := manifest.VerifySignature(nil); err == nil {
+		t.Error("unsigned manifest verified")
+	}
+	if err := manifest.Sign(private); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.VerifySignature(public); err != nil {
+		t.Error(err)
+	}
+	if err := manifest.VerifySignature(other); err == nil {
+		t.Error("manifest verified with another key")
+	}
+
+	sshKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := manifest.Signature.Fingerprint()
+	if err != nil || fingerprint != ssh.FingerprintSHA256(sshKey) || !strings.HasPrefix(fingerprint, "SHA256:") {
+		t.Errorf("fingerprint %s (%v), want %s", fingerprint, err, ssh.FingerprintSHA256(sshKey))
+	}
+
+	manifest.Inputs["a.yaml"] = "02"
+	if err := manifest.VerifySignature(public); err == nil {
+		t.Error("modified manifest verified")
+	}
+}
@@ -0,0 +1,85 @@
+package piccu
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// outputFile is where a build writes its image. Regular files are built in
+// a temporary file next to the target and renamed over it when the build
+// succeeded, devices are written in place.
+type outputFile struct {
+	// Target is the file the image ends up in
+	Target string
+	// Path is the file the build writes, equal to Target for devices
+	Path string
+	mode os.FileMode
+}
+
+// newOutputFile checks target and creates the temporary file. Symlinks and
+// other non-regular files are refused unless force is set, then symlinks are
+// resolved and devices are overwritten in place.
+func newOutputFile(target string, force bool) (*outputFile, error) {
+	stat, err := os.Lstat(target)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	mode := os.FileMode(0644)
+	if err == nil && !stat.Mode().IsRegular() {
+		if !force {
+			return nil, fmt.Errorf("%s is %s, use --force to overwrite it", target, describeFileMode(stat.Mode()))
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			if target, err = filepath.EvalSymlinks(target); err != nil {
+				return nil, err
+			}
+			stat, err = os.Stat(target)
+		}
+		if err == nil && !stat.Mode().IsRegular() {
+			return &outputFile{Target: target, Path: target}, nil
+		}
+	}
+	if err == nil {
+		mode = stat.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &outputFile{Target: target, Path: tmp.Name(), mode: mode}, nil
+}
+
+func describeFileMode(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return "a symlink"
+	case mode&os.ModeDevice != 0:
+		return "a device"
+	case mode.IsDir():
+		return "a directory"
+	}
+	return "not a regular file"
+}
+
+// Commit renames the finished image over the target
+func (o *outputFile) Commit() error {
+	if o.Path == o.Target {
+		return nil
+	}
+	if err := os.Chmod(o.Path, o.mode); err != nil {
+		return err
+	}
+	return os.Rename(o.Path, o.Target)
+}
+
+// Abort removes the temporary file, the target is kept
+func (o *outputFile) Abort() {
+	if o.Path != o.Target {
+		os.Remove(o.Path)
+	}
+}
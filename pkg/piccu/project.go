@@ -0,0 +1,215 @@
+package piccu
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// ProjectFile is the project file `piccu build` reads from the current
+// directory
+const ProjectFile = "piccu.yaml"
+
+//go:embed piccu.schema.json
+var projectSchema string
+var compiledProjectSchema = jsonschema.MustCompileString("piccu.schema.json", projectSchema)
+
+// Project is a piccu.yaml, the flags of `piccu build` as a file. Relative
+// paths are relative to the directory of the file.
+type Project struct {
+	Image struct {
+		Ubuntu        string      `yaml:"ubuntu"`
+		File          string      `yaml:"file"`
+		CacheDir      string      `yaml:"cache_dir"`
+		BootPartition int         `yaml:"boot_partition"`
+		Size          interface{} `yaml:"size"`
+		GrowRootFS    bool        `yaml:"grow_rootfs"`
+		DiskID        string      `yaml:"disk_id"`
+	} `yaml:"image"`
+	Output  string   `yaml:"output"`
+	Formats []string `yaml:"formats"`
+	Inputs  []string `yaml:"inputs"`
+	Vendor  []string `yaml:"vendor"`
+	Secrets []struct {
+		Plain string `yaml:"plain"`
+		Pass  string `yaml:"pass"`
+		Set   string `yaml:"set"`
+		Unset string `yaml:"unset"`
+	} `yaml:"secrets"`
+	Pass struct {
+		Config   string `yaml:"config"`
+		StoreDir string `yaml:"store_dir"`
+	} `yaml:"pass"`
+	Variables     map[string]interface{} `yaml:"variables"`
+	Hostname      string                 `yaml:"hostname"`
+	NetworkConfig string                 `yaml:"network_config"`
+	MetaData      string                 `yaml:"meta_data"`
+	MetaDataSet   map[string]interface{} `yaml:"meta_data_set"`
+	BootFiles     []string               `yaml:"boot_files"`
+	RootFiles     []string               `yaml:"root_files"`
+	Partitions    []string               `yaml:"partitions"`
+	ConfigTxt     ProjectEdits           `yaml:"config_txt"`
+	Cmdline       ProjectEdits           `yaml:"cmdline"`
+	Reproducible  bool                   `yaml:"reproducible"`
+	Verify        *bool                  `yaml:"verify"`
+	LockTimeout   string                 `yaml:"lock_timeout"`
+	Inventory     string                 `yaml:"inventory"`
+	ManifestKey   string                 `yaml:"manifest_key"`
+
+	// Path is the file the project was loaded from
+	Path string `yaml:"-"`
+}
+
+// ProjectEdits are the set/add/remove edits of config.txt or cmdline.txt
+type ProjectEdits struct {
+	Set    []string `yaml:"set"`
+	Add    []string `yaml:"add"`
+	Remove []string `yaml:"remove"`
+}
+
+// ProjectFlag is a flag of `piccu build` set by a project file
+type ProjectFlag struct {
+	Name  string
+	Value string
+}
+
+// LoadProject reads and validates a project file
+func LoadProject(path string) (*Project, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := yaml.Unmarshal(content, &value); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if value == nil {
+		value = map[string]interface{}{}
+	}
+	if err := compiledProjectSchema.Validate(value); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	project := &Project{Path: path}
+	if err := yaml.Unmarshal(content, project); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return project, nil
+}
+
+// path resolves a path of the project file
+func (p *Project) path(name string) string {
+	dir := filepath.Dir(p.Path)
+	if name == "" || dir == "." || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(dir, name)
+}
+
+// InputPaths returns the inputs relative to the current directory
+func (p *Project) InputPaths() []string {
+	inputs := make([]string, 0, len(p.Inputs))
+	for _, input := range p.Inputs {
+		inputs = append(inputs, p.path(input))
+	}
+	return inputs
+}
+
+// Flags returns the flags the project sets, in the order they apply.
+// Secrets keep their order, variables are set after them.
+func (p *Project) Flags() []ProjectFlag {
+	var result []ProjectFlag
+	add := func(name, value string) {
+		if value != "" {
+			result = append(result, ProjectFlag{Name: name, Value: value})
+		}
+	}
+	addAll := func(name string, values []string, resolve func(string) string) {
+		for _, value := range values {
+			add(name, resolve(value))
+		}
+	}
+	keep := func(value string) string { return value }
+
+	add("ubuntu", p.Image.Ubuntu)
+	add("image", p.path(p.Image.File))
+	add("cache.dir", p.path(p.Image.CacheDir))
+	if p.Image.BootPartition != 0 {
+		add("boot.partition", strconv.Itoa(p.Image.BootPartition))
+	}
+	if p.Image.Size != nil {
+		add("size", fmt.Sprint(p.Image.Size))
+	}
+	if p.Image.GrowRootFS {
+		add("size.rootfs", "true")
+	}
+	add("disk.id", p.Image.DiskID)
+	add("output", p.path(p.Output))
+	addAll("format", p.Formats, keep)
+	addAll("vendor", p.Vendor, p.path)
+
+	add("pass.config", p.path(p.Pass.Config))
+	add("pass.store.dir", p.path(p.Pass.StoreDir))
+	for _, secret := range p.Secrets {
+		add("plain", p.path(secret.Plain))
+		add("pass", secret.Pass)
+		add("set", secret.Set)
+		add("unset", secret.Unset)
+	}
+	for _, key := range sortedKeys(p.Variables) {
+		add("set", key+"="+fmt.Sprint(p.Variables[key]))
+	}
+
+	add("hostname", p.Hostname)
+	add("network-config", p.path(p.NetworkConfig))
+	add("meta-data", p.path(p.MetaData))
+	for _, key := range sortedKeys(p.MetaDataSet) {
+		add("meta-data.set", key+"="+fmt.Sprint(p.MetaDataSet[key]))
+	}
+	addAll("boot.firmware.file", p.BootFiles, p.path)
+	addAll("root.file", p.RootFiles, func(value string) string {
+		// SRC:DEST[:UID:GID[:MODE]]
+		parts := strings.SplitN(value, ":", 2)
+		parts[0] = p.path(parts[0])
+		return strings.Join(parts, ":")
+	})
+	addAll("partition", p.Partitions, func(value string) string {
+		// LABEL:SIZE:FS[:SRC[:MOUNTPOINT]]
+		parts := strings.SplitN(value, ":", 5)
+		if len(parts) > 3 {
+			parts[3] = p.path(parts[3])
+		}
+		return strings.Join(parts, ":")
+	})
+	addAll("config.txt.set", p.ConfigTxt.Set, keep)
+	addAll("config.txt.add", p.ConfigTxt.Add, keep)
+	addAll("config.txt.remove", p.ConfigTxt.Remove, keep)
+	addAll("cmdline.set", p.Cmdline.Set, keep)
+	addAll("cmdline.add", p.Cmdline.Add, keep)
+	addAll("cmdline.remove", p.Cmdline.Remove, keep)
+	if p.Reproducible {
+		add("reproducible", "true")
+	}
+	if p.Verify != nil {
+		add("verify", strconv.FormatBool(*p.Verify))
+	}
+	add("lock.timeout", p.LockTimeout)
+	add("inventory", p.path(p.Inventory))
+	add("manifest.key", p.path(p.ManifestKey))
+	return result
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
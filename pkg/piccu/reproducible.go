@@ -0,0 +1,116 @@
+package piccu
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rtreffer/piccu/pkg/ext4"
+)
+
+// fatEpoch is the earliest time FAT can store
+var fatEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SourceDateEpoch reads SOURCE_DATE_EPOCH, it defaults to the FAT epoch
+// 1980-01-01 because earlier times can't be stored on the boot partition
+func SourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return fatEpoch, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %s: %s", value, err)
+	}
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// Sources are the clock and identifier source of one build, each build has
+// its own so that concurrent builds don't share clocks or identifier
+// streams. The zero value uses the system clock and crypto/rand.
+type Sources struct {
+	// Now is the time of new files
+	Now func() time.Time
+	// Random is the source of file system UUIDs, volume IDs and partition
+	// GUIDs
+	Random io.Reader
+	// Reproducible normalizes file systems created by other tools to Now
+	Reproducible bool
+}
+
+// Reproducible returns sources that make builds with identical inputs
+// byte-identical: new FAT and ext4 timestamps are epoch (in UTC, FAT clamped
+// to 1980) and file system UUIDs, volume IDs and partition GUIDs come from a
+// stream seeded with epoch
+func Reproducible(epoch time.Time) Sources {
+	epoch = epoch.UTC()
+	return Sources{
+		Now:          func() time.Time { return epoch },
+		Random:       newSeededReader(fmt.Sprintf("piccu %d", epoch.Unix())),
+		Reproducible: true,
+	}
+}
+
+func (s Sources) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// fatNow is now clamped to the earliest time FAT can store
+func (s Sources) fatNow() time.Time {
+	if t := s.now(); !t.Before(fatEpoch) {
+		return t
+	}
+	return fatEpoch
+}
+
+func (s Sources) random() io.Reader {
+	if s.Random == nil {
+		return rand.Reader
+	}
+	return s.Random
+}
+
+func (s Sources) ext4() ext4.Sources {
+	return ext4.Sources{Now: s.now, Rand: s.random()}
+}
+
+// seededReader is a deterministic byte stream, sha256 in counter mode
+type seededReader struct {
+	seed    [sha256.Size]byte
+	counter uint64
+	buffer  []byte
+}
+
+func newSeededReader(seed string) *seededReader {
+	return &seededReader{seed: sha256.Sum256([]byte(seed))}
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	for n := 0; n < len(p); {
+		if len(r.buffer) == 0 {
+			block := make([]byte, len(r.seed)+8)
+			copy(block, r.seed[:])
+			binary.LittleEndian.PutUint64(block[len(r.seed):], r.counter)
+			r.counter++
+			sum := sha256.Sum256(block)
+			r.buffer = sum[:]
+		}
+		copied := copy(p[n:], r.buffer)
+		r.buffer = r.buffer[copied:]
+		n += copied
+	}
+	return len(p), nil
+}
+
+// uuid returns a version 4 UUID from the identifier source
+func (s Sources) uuid() (string, error) {
+	return readUUID(s.random())
+}
@@ -0,0 +1,33 @@
+package piccu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReproducibleSources(t *testing.T) {
+	first, second := Reproducible(time.Unix(0, 0)), Reproducible(time.Unix(0, 0))
+	if !first.Reproducible || !first.now().Equal(time.Unix(0, 0)) || !first.ext4().Now().Equal(time.Unix(0, 0)) || !first.fatNow().Equal(fatEpoch) {
+		t.Error("Reproducible didn't set the clocks to the epoch")
+	}
+	a, err := first.uuid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := first.uuid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// builds don't share the identifier stream
+	if again, err := second.uuid(); err != nil || again != a || a == b {
+		t.Errorf("identifiers differ between builds: %s, %s, %s (%v)", a, b, again, err)
+	}
+
+	var system Sources
+	if system.Reproducible || time.Since(system.now()) > time.Minute || time.Since(system.fatNow()) > time.Minute {
+		t.Error("the zero sources don't use the system clock")
+	}
+	if x, err := system.uuid(); err != nil || x == a {
+		t.Errorf("random identifier %s (%v)", x, err)
+	}
+}
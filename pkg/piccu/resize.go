@@ -0,0 +1,143 @@
+package piccu
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/partition/gpt"
+	"github.com/diskfs/go-diskfs/partition/mbr"
+)
+
+// gptEntries is the partition array size go-diskfs writes
+const gptEntries = 128
+
+// GrowImage extends the image file to size bytes and grows the last
+// partition up to the end of the image. File systems are not touched, see
+// GrowRootFS.
+func GrowImage(file string, size int64) (Partition, error) {
+	stat, err := os.Stat(file)
+	if err != nil {
+		return Partition{}, err
+	}
+	if size < stat.Size() {
+		return Partition{}, fmt.Errorf("can't shrink %s from %d to %d bytes", file, stat.Size(), size)
+	}
+	if err := os.Truncate(file, size); err != nil {
+		return Partition{}, err
+	}
+
+	disk, err := diskfs.OpenWithMode(file, diskfs.ReadWriteExclusive)
+	if err != nil {
+		return Partition{}, err
+	}
+	defer disk.File.Close()
+	partitionTable, err := disk.GetPartitionTable()
+	if err != nil {
+		return Partition{}, err
+	}
+
+	var result Partition
+	switch table := partitionTable.(type) {
+	case *mbr.Table:
+		result, err = growMBR(table, size)
+	case *gpt.Table:
+		table = rebuildGPT(table)
+		result, err = growGPT(table, size)
+		partitionTable = table
+	default:
+		err = fmt.Errorf("unsupported partition table %s", partitionTable.Type())
+	}
+	if err != nil {
+		return Partition{}, err
+	}
+	if err := partitionTable.Write(disk.File, size); err != nil {
+		return Partition{}, err
+	}
+	return result, disk.File.Sync()
+}
+
+// rebuildGPT copies a table without its geometry, go-diskfs places the
+// backup header and partition array at the end of the disk when writing it
+func rebuildGPT(table *gpt.Table) *gpt.Table {
+	return &gpt.Table{
+		Partitions:         table.Partitions,
+		LogicalSectorSize:  table.LogicalSectorSize,
+		PhysicalSectorSize: table.PhysicalSectorSize,
+		GUID:               table.GUID,
+		ProtectiveMBR:      table.ProtectiveMBR,
+	}
+}
+
+func growMBR(table *mbr.Table, size int64) (Partition, error) {
+	var last *mbr.Partition
+	index := 0
+	for i, p := range table.Partitions {
+		if p.Type != mbr.Empty && (last == nil || p.Start > last.Start) {
+			last, index = p, i+1
+		}
+	}
+	if last == nil {
+		return Partition{}, fmt.Errorf("no partition to grow")
+	}
+	switch last.Type {
+	case mbr.ExtendedCHS, mbr.ExtendedLBA, mbr.LinuxExtended:
+		return Partition{}, fmt.Errorf("can't grow extended partition %d", index)
+	}
+	sectors := size / int64(table.LogicalSectorSize)
+	if sectors > math.MaxUint32 {
+		return Partition{}, fmt.Errorf("%d bytes exceed the MBR limit of 2TiB", size)
+	}
+	last.Size = uint32(sectors) - last.Start
+	// the end is beyond CHS addressing
+	last.EndCylinder, last.EndHead, last.EndSector = 0xff, 0xfe, 0xff
+	result, _ := newPartition(index, last)
+	return result, nil
+}
+
+func growGPT(table *gpt.Table, size int64) (Partition, error) {
+	if len(table.Partitions) > gptEntries {
+		return Partition{}, fmt.Errorf("can't grow GPT with %d entries", len(table.Partitions))
+	}
+	var last *gpt.Partition
+	index := 0
+	for i, p := range table.Partitions {
+		if p.Type != gpt.Unused && (last == nil || p.Start > last.Start) {
+			last, index = p, i+1
+		}
+	}
+	if last == nil {
+		return Partition{}, fmt.Errorf("no partition to grow")
+	}
+	// the backup partition array and header take the last sectors
+	sectorSize := uint64(table.LogicalSectorSize)
+	arraySectors := (gptEntries*128 + sectorSize - 1) / sectorSize
+	last.End = uint64(size)/sectorSize - arraySectors - 2
+	last.Size = (last.End - last.Start + 1) * sectorSize
+	result, _ := newPartition(index, last)
+	return result, nil
+}
+
+// GrowRootFS grows the root file system to the end of its partition, as far
+// as possible without resize2fs. It returns the old and new size in bytes,
+// cloud-init grows the rest on first boot.
+func (img *Image) GrowRootFS() (int64, int64, error) {
+	rootfs, err := img.RootFS()
+	if err != nil {
+		return 0, 0, err
+	}
+	blockSize := int64(rootfs.Superblock().BlockSize)
+	old := int64(rootfs.Superblock().BlocksCount) * blockSize
+	blocks := uint64(img.rootPartition.Size / blockSize)
+	if limit := rootfs.GrowLimit(); blocks > limit {
+		blocks = limit
+	}
+	if blocks <= rootfs.Superblock().BlocksCount {
+		return old, old, nil
+	}
+	if err := rootfs.Grow(blocks); err != nil {
+		return old, old, err
+	}
+	return old, int64(rootfs.Superblock().BlocksCount) * blockSize, nil
+}
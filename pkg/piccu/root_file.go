@@ -0,0 +1,173 @@
+package piccu
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rtreffer/piccu/pkg/ext4"
+)
+
+// RootFile is a local file or directory to copy into the root file system
+type RootFile struct {
+	Source string
+	Target string
+	UID    uint32
+	GID    uint32
+	// Mode overrides the permissions of copied files, directories keep the
+	// permissions of the source
+	Mode fs.FileMode
+}
+
+// ParseRootFile parses SRC:DEST[:UID:GID[:MODE]], e.g.
+// app.service:/etc/systemd/system/app.service or
+// app/:/opt/app:1000:1000:0640
+func ParseRootFile(value string) (RootFile, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 && len(parts) != 4 && len(parts) != 5 {
+		return RootFile{}, fmt.Errorf("invalid root file %s, expected SRC:DEST[:UID:GID[:MODE]]", value)
+	}
+	result := RootFile{
+		Source: parts[0],
+		Target: path.Clean("/" + parts[1]),
+	}
+	if parts[0] == "" || parts[1] == "" {
+		return result, fmt.Errorf("invalid root file %s, expected SRC:DEST[:UID:GID[:MODE]]", value)
+	}
+	if len(parts) >= 4 {
+		uid, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return result, fmt.Errorf("invalid uid in %s: %s", value, err)
+		}
+		gid, err := strconv.ParseUint(parts[3], 10, 32)
+		if err != nil {
+			return result, fmt.Errorf("invalid gid in %s: %s", value, err)
+		}
+		result.UID, result.GID = uint32(uid), uint32(gid)
+	}
+	if len(parts) == 5 {
+		mode, err := strconv.ParseUint(parts[4], 8, 32)
+		if err != nil || mode > 07777 {
+			return result, fmt.Errorf("invalid mode in %s", value)
+		}
+		result.Mode = fileMode(uint32(mode))
+	}
+	return result, nil
+}
+
+// fileMode converts unix permission bits including setuid, setgid and sticky
+func fileMode(mode uint32) fs.FileMode {
+	result := fs.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		result |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		result |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		result |= fs.ModeSticky
+	}
+	return result
+}
+
+func (file RootFile) String() string {
+	return fmt.Sprintf("%s:%s:%d:%d:%04o", file.Source, file.Target, file.UID, file.GID, file.Mode.Perm())
+}
+
+// Apply copies the file or directory tree into the root file system,
+// missing parents of the target are created owned by root
+func (file RootFile) Apply(img *Image) error {
+	rootfs, err := img.RootFS()
+	if err != nil {
+		return err
+	}
+	return copyTree(rootfs, file.Source, file.Target, file.UID, file.GID, file.Mode)
+}
+
+// copyTree copies a local file or directory tree to target on an ext4 file
+// system, mode overrides the permissions of regular files if set
+func copyTree(fsys *ext4.FileSystem, source, target string, uid, gid uint32, mode fs.FileMode) error {
+	target = strings.TrimPrefix(path.Clean("/"+target), "/")
+	if target == "" {
+		target = "."
+	}
+	if err := fsys.MkdirAll(path.Dir(target), ext4.Attr{Mode: 0755}); err != nil {
+		return err
+	}
+	return filepath.Walk(source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(target, filepath.ToSlash(rel))
+		attr := ext4.Attr{Mode: info.Mode(), UID: uid, GID: gid}
+		switch {
+		case info.IsDir():
+			if dest == "." {
+				return nil
+			}
+			if stat, err := fsys.Stat(dest); err == nil && stat.IsDir() {
+				return nil
+			}
+			return fsys.Mkdir(dest, attr)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			fsys.Remove(dest)
+			return fsys.Symlink(link, dest, attr)
+		case info.Mode().IsRegular():
+			if mode != 0 {
+				attr.Mode = mode
+			}
+			src, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			return fsys.CreateFile(dest, src, info.Size(), attr)
+		}
+		return fmt.Errorf("%s: unsupported file type %s", name, info.Mode().Type())
+	})
+}
+
+// RootFiles records --root.file flags in the order given
+type RootFiles []RootFile
+
+var _ flag.Value = (*RootFiles)(nil)
+
+func (files *RootFiles) Set(value string) error {
+	file, err := ParseRootFile(value)
+	if err != nil {
+		return err
+	}
+	*files = append(*files, file)
+	return nil
+}
+
+func (files *RootFiles) String() string {
+	entries := make([]string, 0, len(*files))
+	for _, file := range *files {
+		entries = append(entries, file.String())
+	}
+	return strings.Join(entries, " ")
+}
+
+// Apply copies all files into the root file system
+func (files RootFiles) Apply(img *Image) error {
+	for _, file := range files {
+		if err := file.Apply(img); err != nil {
+			return fmt.Errorf("%s: %s", file.Source, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package piccu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// VerifyImage reopens a finished image read-only, reads back the injected
+// files, compares their sha256 and checks the FAT of the boot partition. It
+// returns the problems found, an empty result means the image is good.
+func VerifyImage(file string, bootPartition int, injected map[string]string) []error {
+	img, err := OpenImageWith(file, OpenOptions{ReadOnly: true, BootPartition: bootPartition})
+	if err != nil {
+		return []error{fmt.Errorf("can't reopen %s: %s", file, err)}
+	}
+	defer img.Close()
+
+	var problems []error
+	paths := make([]string, 0, len(injected))
+	for path := range injected {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		data, err := img.ReadFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: can't read back: %s", path, err))
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if actual := hex.EncodeToString(sum[:]); actual != injected[path] {
+			problems = append(problems, fmt.Errorf("%s: sha256 %s, expected %s", path, actual, injected[path]))
+		}
+	}
+	return append(problems, img.CheckFAT()...)
+}
@@ -0,0 +1,26 @@
+package piccu
+
+import "runtime/debug"
+
+// Version is the piccu release, set at link time with
+// -ldflags "-X github.com/rtreffer/piccu/pkg/piccu.Version=v1.2.3"
+var Version = ""
+
+// GetVersion returns Version, the module version of go install builds or
+// "dev" for builds from a checkout
+func GetVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			return info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return "dev-" + setting.Value
+			}
+		}
+	}
+	return "dev"
+}
@@ -0,0 +1,74 @@
+package progress
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is a single JSON line
+type Event struct {
+	Time    time.Time   `json:"time"`
+	Type    string      `json:"type"`
+	Message string      `json:"message,omitempty"`
+	Name    string      `json:"name,omitempty"`
+	Bytes   int64       `json:"bytes,omitempty"`
+	Total   int64       `json:"total,omitempty"`
+	Summary interface{} `json:"summary,omitempty"`
+}
+
+type jsonReporter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewJSON returns a reporter that writes one JSON object per line to out
+func NewJSON(out io.Writer) Reporter {
+	return &jsonReporter{encoder: json.NewEncoder(out)}
+}
+
+func (j *jsonReporter) emit(event Event) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	event.Time = time.Now().UTC()
+	j.encoder.Encode(event)
+}
+
+func (j *jsonReporter) Step(message string) {
+	j.emit(Event{Type: "step", Message: message})
+}
+
+func (j *jsonReporter) Warning(err error) {
+	j.emit(Event{Type: "warning", Message: err.Error()})
+}
+
+func (j *jsonReporter) Error(err error) {
+	j.emit(Event{Type: "error", Message: err.Error()})
+}
+
+func (j *jsonReporter) Summary(summary interface{}) {
+	j.emit(Event{Type: "summary", Summary: summary})
+}
+
+func (j *jsonReporter) Transfer(name string, total int64) Transfer {
+	j.emit(Event{Type: "transfer", Message: "started", Name: name, Total: total})
+	return &jsonTransfer{reporter: j, throttle: throttle{name: name, total: total}}
+}
+
+// jsonTransfer emits an event every 10 percent like the plain reporter
+type jsonTransfer struct {
+	reporter *jsonReporter
+	throttle
+}
+
+func (t *jsonTransfer) Write(p []byte) (int, error) {
+	if t.advance(len(p)) {
+		t.reporter.emit(Event{Type: "transfer", Message: "progress", Name: t.name, Bytes: t.written, Total: t.total})
+	}
+	return len(p), nil
+}
+
+func (t *jsonTransfer) Done() {
+	t.reporter.emit(Event{Type: "transfer", Message: "done", Name: t.name, Bytes: t.written, Total: t.total})
+}
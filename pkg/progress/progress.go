@@ -0,0 +1,153 @@
+// Package progress reports the steps, warnings and byte transfers of
+// long-running operations to terminals, logs or machines.
+package progress
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Reporter receives the progress of an operation
+type Reporter interface {
+	// Step reports the start or result of a step
+	Step(message string)
+	// Warning reports a problem that doesn't stop the operation
+	Warning(err error)
+	// Error reports the problem that stopped the operation
+	Error(err error)
+	// Transfer starts a byte transfer (download, copy, checksum) of total
+	// bytes, total is -1 if unknown
+	Transfer(name string, total int64) Transfer
+	// Summary reports the final, machine readable result
+	Summary(summary interface{})
+}
+
+// Transfer tracks a byte transfer, written bytes count as progress
+type Transfer interface {
+	io.Writer
+	// Done ends the transfer, complete or not
+	Done()
+}
+
+// Formats are the values of --log-format
+var Formats = []string{"text", "plain", "json"}
+
+// New returns the reporter for a --log-format: text draws progress bars on
+// terminals and falls back to plain lines, json writes JSON lines to out.
+// quiet drops everything but errors and the summary.
+func New(format string, quiet bool, out, errOut *os.File) (Reporter, error) {
+	var reporter Reporter
+	switch format {
+	case "", "text":
+		if isTerminal(errOut) {
+			reporter = NewTTY(out, errOut)
+		} else {
+			reporter = NewPlain(out, errOut)
+		}
+	case "plain":
+		reporter = NewPlain(out, errOut)
+	case "json":
+		reporter = NewJSON(out)
+	default:
+		return nil, fmt.Errorf("invalid log format %s, expected text, plain or json", format)
+	}
+	if quiet {
+		reporter = Quiet(reporter)
+	}
+	return reporter, nil
+}
+
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// OrSilent returns reporter, or Silent if it is nil
+func OrSilent(reporter Reporter) Reporter {
+	if reporter == nil {
+		return Silent{}
+	}
+	return reporter
+}
+
+// Silent discards all reports
+type Silent struct{}
+
+func (Silent) Step(string)                     {}
+func (Silent) Warning(error)                   {}
+func (Silent) Error(error)                     {}
+func (Silent) Transfer(string, int64) Transfer { return discard{} }
+func (Silent) Summary(interface{})             {}
+
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+func (discard) Done()                       {}
+
+type quiet struct {
+	Reporter
+}
+
+// Quiet forwards only errors and the summary to reporter
+func Quiet(reporter Reporter) Reporter {
+	return quiet{reporter}
+}
+
+func (quiet) Step(string)                     {}
+func (quiet) Warning(error)                   {}
+func (quiet) Transfer(string, int64) Transfer { return discard{} }
+
+// Flags are the --quiet and --log-format flags shared by all commands
+type Flags struct {
+	Quiet  bool
+	Format string
+}
+
+// RegisterFlags adds --quiet and --log-format to flagSet, where tells the
+// help text where the JSON lines go
+func RegisterFlags(flagSet *flag.FlagSet, where string) *Flags {
+	f := &Flags{}
+	flagSet.BoolVar(&f.Quiet, "quiet", false, "only report errors and the summary")
+	flagSet.StringVar(&f.Format, "log-format", "text", "progress output: "+strings.Join(Formats, ", ")+" (JSON lines on "+where+")")
+	return f
+}
+
+// New returns the reporter selected by the flags
+func (f *Flags) New(out, errOut *os.File) (Reporter, error) {
+	return New(f.Format, f.Quiet, out, errOut)
+}
+
+type prefixed struct {
+	reporter Reporter
+	prefix   string
+}
+
+// Prefixed prefixes the messages and transfer names of reporter, e.g. with
+// the host of a batch build. The plain and json reporters can be shared by
+// concurrent prefixed reporters.
+func Prefixed(reporter Reporter, prefix string) Reporter {
+	return &prefixed{reporter: reporter, prefix: prefix}
+}
+
+func (p *prefixed) Step(message string) {
+	p.reporter.Step(p.prefix + message)
+}
+
+func (p *prefixed) Warning(err error) {
+	p.reporter.Warning(fmt.Errorf("%s%w", p.prefix, err))
+}
+
+func (p *prefixed) Error(err error) {
+	p.reporter.Error(fmt.Errorf("%s%w", p.prefix, err))
+}
+
+func (p *prefixed) Transfer(name string, total int64) Transfer {
+	return p.reporter.Transfer(p.prefix+name, total)
+}
+
+func (p *prefixed) Summary(summary interface{}) {
+	p.reporter.Summary(summary)
+}
@@ -0,0 +1,153 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// tty prints steps to out and draws progress bars and warnings on errOut
+type tty struct {
+	out, errOut io.Writer
+}
+
+// NewTTY returns a reporter for interactive terminals
+func NewTTY(out, errOut io.Writer) Reporter {
+	return &tty{out: out, errOut: errOut}
+}
+
+func (t *tty) Step(message string) {
+	fmt.Fprintln(t.out, message)
+}
+
+func (t *tty) Warning(err error) {
+	fmt.Fprintln(t.errOut, "WARNING:", err)
+}
+
+func (t *tty) Error(err error) {
+	fmt.Fprintln(t.errOut, err)
+}
+
+func (t *tty) Summary(interface{}) {}
+
+func (t *tty) Transfer(name string, total int64) Transfer {
+	bar := progressbar.NewOptions64(
+		total,
+		progressbar.OptionSetDescription(name),
+		progressbar.OptionSetWriter(t.errOut),
+		progressbar.OptionShowBytes(true),
+		progressbar.OptionSetWidth(10),
+		progressbar.OptionThrottle(65*time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(t.errOut, "\n")
+		}),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionFullWidth(),
+		progressbar.OptionSetRenderBlankState(true),
+	)
+	return &barTransfer{bar: bar, total: total}
+}
+
+type barTransfer struct {
+	bar     *progressbar.ProgressBar
+	total   int64
+	written int64
+}
+
+func (b *barTransfer) Write(p []byte) (int, error) {
+	b.written += int64(len(p))
+	return b.bar.Write(p)
+}
+
+// Done ends the line of an unfinished bar, finished bars end it themselves
+func (b *barTransfer) Done() {
+	if b.total < 0 || b.written < b.total {
+		b.bar.Exit()
+	}
+}
+
+// plain prints steps and transfers as lines without control characters,
+// e.g. for CI logs
+type plain struct {
+	out, errOut io.Writer
+}
+
+// NewPlain returns a reporter for logs and pipes
+func NewPlain(out, errOut io.Writer) Reporter {
+	return &plain{out: out, errOut: errOut}
+}
+
+func (p *plain) Step(message string) {
+	fmt.Fprintln(p.out, message)
+}
+
+func (p *plain) Warning(err error) {
+	fmt.Fprintln(p.errOut, "WARNING:", err)
+}
+
+func (p *plain) Error(err error) {
+	fmt.Fprintln(p.errOut, err)
+}
+
+func (p *plain) Summary(interface{}) {}
+
+func (p *plain) Transfer(name string, total int64) Transfer {
+	fmt.Fprintf(p.out, "%s: started\n", name)
+	return &lineTransfer{out: p.out, throttle: throttle{name: name, total: total}}
+}
+
+// lineTransfer prints a line every 10 percent
+type lineTransfer struct {
+	out io.Writer
+	throttle
+}
+
+func (l *lineTransfer) Write(p []byte) (int, error) {
+	if l.advance(len(p)) {
+		if l.total > 0 {
+			fmt.Fprintf(l.out, "%s: %d%% (%d/%d bytes)\n", l.name, l.written*100/l.total, l.written, l.total)
+		} else {
+			fmt.Fprintf(l.out, "%s: %d bytes\n", l.name, l.written)
+		}
+	}
+	return len(p), nil
+}
+
+func (l *lineTransfer) Done() {
+	fmt.Fprintf(l.out, "%s: done (%d bytes)\n", l.name, l.written)
+}
+
+// unknownTotalStep is the reporting interval of transfers of unknown size
+const unknownTotalStep = 100 * 1024 * 1024
+
+// throttle counts the bytes of a transfer and limits reports to every 10
+// percent, or every 100MiB if the total is unknown
+type throttle struct {
+	name    string
+	total   int64
+	written int64
+	next    int64
+}
+
+// advance adds n written bytes, it returns true if progress should be
+// reported
+func (t *throttle) advance(n int) bool {
+	t.written += int64(n)
+	step := int64(unknownTotalStep)
+	if t.total > 0 {
+		step = (t.total + 9) / 10
+	}
+	if t.next == 0 {
+		t.next = step
+	}
+	if t.written < t.next || (t.total >= 0 && t.written >= t.total) {
+		return false
+	}
+	for t.next <= t.written {
+		t.next += step
+	}
+	return true
+}
@@ -20,7 +20,10 @@ func (e Environment) Envv() []string {
 	return result
 }
 
-func ParseEnvironmentFile(name, content string) (Environment, error) {
+// ParseEnvironmentFile evaluates the assignments of an environment file,
+// variables like ${HOME} are looked up in parent, nil is the process
+// environment. Only the assigned variables are returned.
+func ParseEnvironmentFile(name, content string, parent Environment) (Environment, error) {
 	// an environment file can be seen as a POSIX shell script
 	// let's try to parse it
 	parser := syntax.NewParser(syntax.Variant(syntax.LangBash))
@@ -30,9 +33,10 @@ func ParseEnvironmentFile(name, content string) (Environment, error) {
 	}
 
 	// needed for e.g. ${HOME}
-	parent, err := ParseEnvironment(os.Environ())
-	if err != nil {
-		return nil, err
+	if parent == nil {
+		if parent, err = ParseEnvironment(os.Environ()); err != nil {
+			return nil, err
+		}
 	}
 
 	shenv := shellEnv{
@@ -0,0 +1,98 @@
+package secretary
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Flags are the secret loading flags shared by secretary and piccu
+type Flags struct {
+	Loads        LoadFlags
+	PassConfig   string
+	PassStoreDir string
+}
+
+// RegisterFlags adds --plain, --pass, --set, --unset, --pass.config and
+// --pass.store.dir to flagSet
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	f := &Flags{Loads: make(LoadFlags, 0)}
+	flagSet.Var((*LoadPlainFileFlag)(&f.Loads), "plain", "plain environment file to load")
+	flagSet.Var((*LoadPassFlag)(&f.Loads), "pass", "pass secret name to load")
+	flagSet.Var((*SetFlag)(&f.Loads), "set", "set environment variables")
+	flagSet.Var((*UnsetFlag)(&f.Loads), "unset", "unset environment variables")
+	flagSet.StringVar(&f.PassConfig, "pass.config", "", "pass config file to load")
+	flagSet.StringVar(&f.PassStoreDir, "pass.store.dir", "", "pass store directory to use")
+	return f
+}
+
+// Load applies the flags in order to env, it returns the names of the keys
+// that were loaded or set. Environment files are evaluated against the
+// process environment and env as loaded so far, so a later --plain or
+// --pass can use the variables of earlier ones.
+func (f *Flags) Load(env Environment) ([]string, error) {
+	if f.PassConfig != "" {
+		PassSetConfig(f.PassConfig)
+	}
+	if f.PassStoreDir != "" {
+		PassSetStoreDir(f.PassStoreDir)
+	}
+	// parent is what environment files see, it follows every change to env
+	parent, err := ParseEnvironment(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range env {
+		parent[k] = v
+	}
+	set := func(k, v string) {
+		env[k] = v
+		parent[k] = v
+	}
+	keys := make([]string, 0, 32)
+	for _, flagValue := range f.Loads {
+		switch flagValue.Type {
+		case LoadPlainFile:
+			loaded, err := PlainLoadSecret(flagValue.Name, parent)
+			if err != nil {
+				return nil, fmt.Errorf("can't load %s: %s", flagValue.Name, err)
+			}
+			for k, v := range loaded {
+				set(k, v)
+				keys = append(keys, k)
+			}
+		case LoadPass:
+			loaded, err := PassLoadSecret(flagValue.Name, parent)
+			if err != nil {
+				return nil, fmt.Errorf("can't load %s: %s", flagValue.Name, err)
+			}
+			if len(loaded) == 0 {
+				return nil, fmt.Errorf("no secrets loaded from %s", flagValue.Name)
+			}
+			for k, v := range loaded {
+				set(k, v)
+				keys = append(keys, k)
+			}
+		case Unset:
+			delete(env, flagValue.Name)
+			delete(parent, flagValue.Name)
+		case Set:
+			parts := strings.SplitN(flagValue.Name, "=", 2)
+			if len(parts) == 1 {
+				set(parts[0], "")
+				continue
+			}
+			set(parts[0], parts[1])
+			keys = append(keys, parts[0])
+		}
+	}
+	return keys, nil
+}
+
+// Secrets loads the flags into a new environment
+func (f *Flags) Secrets() (Environment, error) {
+	env := make(Environment)
+	_, err := f.Load(env)
+	return env, err
+}
@@ -15,7 +15,7 @@ func PassSetConfig(conf string) {
 	os.Setenv("GOPASS_CONFIG", conf)
 }
 
-func PassLoadSecret(name string) (Environment, error) {
+func PassLoadSecret(name string, parent Environment) (Environment, error) {
 	pstore, err := api.New(context.Background())
 	if err != nil {
 		return nil, err
@@ -25,5 +25,5 @@ func PassLoadSecret(name string) (Environment, error) {
 		return nil, err
 	}
 	data := string(secret.Bytes())
-	return ParseEnvironmentFile(name, data)
+	return ParseEnvironmentFile(name, data, parent)
 }
@@ -4,10 +4,10 @@ import (
 	"os"
 )
 
-func PlainLoadSecret(name string) (Environment, error) {
+func PlainLoadSecret(name string, parent Environment) (Environment, error) {
 	data, err := os.ReadFile(name)
 	if err != nil {
 		return nil, err
 	}
-	return ParseEnvironmentFile(name, string(data))
+	return ParseEnvironmentFile(name, string(data), parent)
 }